@@ -8,12 +8,70 @@ type AppRequest struct {
 	Image          string            `json:"image"`
 	ImageTag       string            `json:"image_tag"`
 	DomainAddress  string            `json:"domain_address"`
-	Port           int32             `json:"port"`
+	Port           int32             `json:"port"`      // single port shorthand, used when Ports is empty
+	Ports          []AppPort         `json:"ports"`     // named ports, takes precedence over Port
 	Resources      string            `json:"resources"` // includes CPU,RAM,DISK respectively. For instance: "500m,128Mi,1Gi"
 	Envs           map[string]string `json:"envs"`
 	Secrets        map[string]string `json:"secrets"`
 	ExternalAccess bool              `json:"external_access"`
+	Ingress        *AppIngress       `json:"ingress"` // if nil, DomainAddress/ is routed to the ingress port
+	TLS            *AppTLS           `json:"tls"`
 	Monitor        bool              `json:"monitor"`
+	Bindings       []DBBinding       `json:"bindings"`
+}
+
+// AdoptRequest names an existing deployment to bring under KaaS management. If
+// Environment is set, the app becomes part of the manifest of that environment.
+type AdoptRequest struct {
+	Name        string `json:"name"`
+	Environment string `json:"environment"`
+}
+
+// DBBinding passes the address and credentials of a database to an app through
+// the PREFIX_HOST, PREFIX_PORT, PREFIX_NAME, PREFIX_USER and PREFIX_PASSWORD variables.
+type DBBinding struct {
+	Database  string `json:"database"`
+	EnvPrefix string `json:"env_prefix"` // defaults to DB
+}
+
+type AppPort struct {
+	Name          string `json:"name"`
+	ContainerPort int32  `json:"container_port"`
+	ServicePort   int32  `json:"service_port"` // defaults to ContainerPort
+	Protocol      string `json:"protocol"`     // TCP or UDP, defaults to TCP
+	Ingress       bool   `json:"ingress"`      // whether the port is exposed through the ingress
+}
+
+type AppIngress struct {
+	Mode        string            `json:"mode"`       // shared or dedicated, defaults to the mode in kaas-config
+	ClassName   string            `json:"class_name"` // ingress class of a dedicated ingress
+	Rules       []IngressRule     `json:"rules"`
+	Rewrite     string            `json:"rewrite"`     // rewrite target of the matched paths, e.g. "/$2"; dedicated mode only
+	Annotations map[string]string `json:"annotations"` // dedicated mode only
+}
+
+type IngressRule struct {
+	Host  string        `json:"host"`  // defaults to DomainAddress
+	Paths []IngressPath `json:"paths"` // defaults to a single "/" prefix path
+}
+
+type IngressPath struct {
+	Path     string `json:"path"`
+	PathType string `json:"path_type"` // Prefix or Exact, defaults to Prefix
+	Port     string `json:"port"`      // name or service port number, defaults to the ingress port
+}
+
+type AppTLS struct {
+	SecretName  string `json:"secret_name"`  // existing secret of type kubernetes.io/tls
+	Cert        string `json:"cert"`         // PEM certificate chain, used when SecretName is empty
+	Key         string `json:"key"`          // PEM private key of Cert
+	SSLRedirect *bool  `json:"ssl_redirect"` // if nil, the ingress controller default is kept; dedicated mode only
+}
+
+type TLSStatus struct {
+	SecretName string    `json:"secret_name"`
+	NotAfter   time.Time `json:"not_after"`
+	Warning    string    `json:"warning,omitempty"` // set when the certificate expires soon or can't be read
 }
 
 type PodStatus struct {
@@ -30,6 +88,7 @@ type AppStatus struct {
 	Replicas       int32       `json:"replicas"`
 	ReadyReplicas  int32       `json:"ready_replicas"`
 	PodStatuses    []PodStatus `json:"pod_statuses"`
+	TLS            *TLSStatus  `json:"tls,omitempty"`
 	ErrMsg         string      `json:"err_msg"`
 }
 
@@ -37,19 +96,262 @@ type AllAppsStatus struct {
 	Apps []AppStatus `json:"apps"`
 }
 
+type Route struct {
+	Host     string `json:"host"`
+	Path     string `json:"path"`
+	PathType string `json:"path_type"`
+	App      string `json:"app"`
+	Port     string `json:"port"`
+	Ingress  string `json:"ingress"`
+}
+
+type AllRoutes struct {
+	Routes []Route `json:"routes"`
+}
+
+type IngressMigration struct {
+	Migrated []string `json:"migrated"`
+	Skipped  []string `json:"skipped"` // apps left in the shared ingress, with the reason
+}
+
+type APIKeyRequest struct {
+	Subject string `json:"subject"`
+	Tenant  string `json:"tenant"` // defaults to the tenant of the caller
+}
+
+type APIKey struct {
+	Subject string `json:"subject"`
+	Tenant  string `json:"tenant"`
+	Key     string `json:"key"` // shown only once, KaaS stores just its hash
+}
+
+type WhoAmI struct {
+	Subject     string   `json:"subject"`
+	Tenant      string   `json:"tenant"`
+	Method      string   `json:"method"`
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+}
+
+type RoleBindingRequest struct {
+	Subject string `json:"subject"`
+	Tenant  string `json:"tenant"` // empty binds the role in every tenant
+	Role    string `json:"role"`
+}
+
+type AuditRecord struct {
+	Subject    string    `json:"subject"`
+	Tenant     string    `json:"tenant"`
+	SourceIP   string    `json:"source_ip"`
+	Method     string    `json:"method"`
+	Route      string    `json:"route"`
+	AppName    string    `json:"app_name"`
+	Body       string    `json:"body"` // secrets, passwords and keys are redacted
+	Status     int       `json:"status"`
+	Objects    []string  `json:"objects"` // kind/name of the created objects
+	DurationMS int64     `json:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type AllAuditRecords struct {
+	Records []AuditRecord `json:"records"`
+}
+
+type Quota struct {
+	Tenant string            `json:"tenant"`
+	Hard   map[string]string `json:"hard"` // keyed by cpu, memory, ephemeral_storage, storage and pods
+	Used   map[string]string `json:"used"`
+}
+
+type QuotaRequest struct {
+	Hard map[string]string `json:"hard"`
+}
+
+type QuotaUsage struct {
+	Resource  string `json:"resource"`
+	Used      string `json:"used"`
+	Requested string `json:"requested"`
+	Allowed   string `json:"allowed"`
+}
+
+type QuotaExceeded struct {
+	Error  string       `json:"error"`
+	Tenant string       `json:"tenant"`
+	Usage  []QuotaUsage `json:"usage"`
+}
+
+// Manifest describes the apps and databases of an environment. Apps and databases
+// of the environment that are missing from the manifest are deleted when it's applied.
+type Manifest struct {
+	Environment string       `json:"environment"`
+	Databases   []DBRequest  `json:"databases"`
+	Apps        []AppRequest `json:"apps"`
+}
+
+type PlanStep struct {
+	Kind   string `json:"kind"` // app or database
+	Name   string `json:"name"`
+	Action string `json:"action"`           // create, update, delete, keep or unchanged
+	Status string `json:"status,omitempty"` // applied, failed or skipped, empty on dry runs
+}
+
+type ApplyResult struct {
+	Environment string     `json:"environment"`
+	DryRun      bool       `json:"dry_run"`
+	Plan        []PlanStep `json:"plan"`
+	Error       string     `json:"error,omitempty"` // set when a step failed, later steps are skipped
+}
+
+// DryRunResult holds the objects a request would create or update, as returned
+// by the Kubernetes API for a server-side dry run. Secret values are redacted.
+type DryRunResult struct {
+	Objects []any `json:"objects"`
+}
+
 type DBRequest struct {
-	DBName         string `json:"name"`
-	Resources      string `json:"resources"` // includes CPU,RAM,DISK respectively. For instance: "500m,128Mi,1Gi"
-	ExternalAccess bool   `json:"external_access"`
+	DBName         string            `json:"name"`
+	Engine         string            `json:"engine"`    // postgres, mysql, mariadb, redis or mongodb, defaults to postgres
+	Resources      string            `json:"resources"` // includes CPU,RAM,DISK respectively. For instance: "500m,128Mi,1Gi"
+	ExternalAccess bool              `json:"external_access"`
+	Backup         *DBBackup         `json:"backup"`      // if nil, the database isn't backed up
+	FromBackup     string            `json:"from_backup"` // ID of a backup restored into the new database
+	CloneOf        string            `json:"clone_of"`    // database whose data is copied into the new database
+	HA             bool              `json:"ha"`          // runs a primary with streaming replicas, postgres only
+	Replicas       int32             `json:"replicas"`    // servers of an HA database, primary included; defaults to replica of db-request-config, at least 2
+	Pooler         *DBPooler         `json:"pooler"`      // if nil, clients connect to the server directly; postgres only
+	Parameters     map[string]string `json:"parameters"`  // postgresql.conf settings, override the ones derived from the memory; postgres only
+	Extensions     []string          `json:"extensions"`  // enabled once the server is up, e.g. pgcrypto; postgres only
+}
+
+// DBPooler runs PgBouncer in front of a postgres database, so many clients
+// share a bounded number of server connections.
+type DBPooler struct {
+	Mode          string `json:"mode"`            // session, transaction or statement, defaults to transaction
+	PoolSize      int32  `json:"pool_size"`       // server connections per user and database, defaults to 20
+	MaxClientConn int32  `json:"max_client_conn"` // client connections per pooler, defaults to 1000
+	Replicas      int32  `json:"replicas"`        // defaults to 1
+}
+
+// DatabaseRequest creates a database inside a postgres server.
+type DatabaseRequest struct {
+	Name  string `json:"name"`
+	Owner string `json:"owner"` // user owning the database, defaults to the user of the server
+}
+
+// DBUserRequest creates a login role inside a postgres server.
+type DBUserRequest struct {
+	Name string `json:"name"`
+}
+
+type DBUser struct {
+	Name       string `json:"name"`
+	Password   string `json:"password"`
+	SecretName string `json:"secret_name"` // secret with the username and password of the user
+}
+
+// GrantRequest grants a user access to the tables of a database.
+type GrantRequest struct {
+	User     string `json:"user"`
+	Database string `json:"database"`
+	Access   string `json:"access"` // read, write or all
+}
+
+// DBResizeRequest changes the resources of the servers of a database. Empty
+// fields are left unchanged.
+type DBResizeRequest struct {
+	CPU     string `json:"cpu"`
+	Memory  string `json:"memory"`
+	Storage string `json:"storage"` // volume size of every server, can only grow
+}
+
+type FailoverRequest struct {
+	Target string `json:"target"` // pod of the replica to promote, defaults to the first ready one
+}
+
+// DBBackup schedules logical backups of a database, taken with pg_dump.
+type DBBackup struct {
+	Schedule  string    `json:"schedule"`  // cron schedule, e.g. "0 3 * * *"
+	Retention int32     `json:"retention"` // number of backups kept, defaults to 7
+	Target    string    `json:"target"`    // pvc or s3, defaults to pvc
+	Size      string    `json:"size"`      // size of the backup volume, defaults to the volume size of the database
+	S3        *S3Target `json:"s3"`        // required by the s3 target
+}
+
+type S3Target struct {
+	Endpoint   string `json:"endpoint"` // e.g. http://minio.minio.svc:9000
+	Bucket     string `json:"bucket"`
+	SecretName string `json:"secret_name"` // secret with access_key and secret_key entries
+}
+
+type Backup struct {
+	Name           string     `json:"name"`
+	Status         string     `json:"status"` // running, succeeded or failed
+	StartTime      time.Time  `json:"start_time"`
+	CompletionTime *time.Time `json:"completion_time,omitempty"`
+	Size           int64      `json:"size"`               // in bytes, set once succeeded
+	Location       string     `json:"location,omitempty"` // path on the backup volume or S3 URL of the dump
+	Message        string     `json:"message,omitempty"`  // why the backup failed
+}
+
+type AllBackups struct {
+	Backups []Backup `json:"backups"`
+}
+
+type RestoreRequest struct {
+	Backup string `json:"backup"` // ID of the backup, as listed by the backups endpoint
+}
+
+type RestoreStatus struct {
+	Name           string     `json:"name"`                  // name of the restore job
+	FromBackup     string     `json:"from_backup,omitempty"` // backup the data is restored from
+	CloneOf        string     `json:"clone_of,omitempty"`    // database the data is copied from
+	Status         string     `json:"status"`                // running, succeeded or failed
+	StartTime      time.Time  `json:"start_time"`
+	CompletionTime *time.Time `json:"completion_time,omitempty"`
+	Message        string     `json:"message,omitempty"` // why the restore failed
+}
+
+// DBConnection is the connection string of a database in one format.
+type DBConnection struct {
+	Format   string `json:"format"`
+	Internal string `json:"internal"`           // through the DNS name of the service in the cluster
+	External string `json:"external,omitempty"` // if ExternalAccess=true, through the node port
+}
+
+type DBStatus struct {
+	Name          string         `json:"name"`
+	Engine        string         `json:"engine"`
+	Namespace     string         `json:"namespace"`
+	Replicas      int32          `json:"replicas"`
+	ReadyReplicas int32          `json:"ready_replicas"`
+	Resources     string         `json:"resources"`            // CPU,RAM,DISK of every server
+	Primary       string         `json:"primary,omitempty"`    // if HA, pod of the primary
+	Restore       *RestoreStatus `json:"restore,omitempty"`    // the last restore into the database
+	Extensions    []DBExtension  `json:"extensions,omitempty"` // outcome of the last time the extensions were enabled
+}
+
+type DBExtension struct {
+	Name   string `json:"name"`
+	Status string `json:"status"` // enabled, unavailable or failed
+	Error  string `json:"error,omitempty"`
 }
 
 type DBCredentials struct {
-	DBName      string `json:"name"`
-	Username    string `json:"username"`
-	Password    string `json:"password"`
-	ServiceName string `json:"service_name"` // equal to ClusterIP
-	ServicePort int32  `json:"service_port"` // port of service in the cluster
-	ExternalIP  string `json:"external_ip"`  // if ExternalAccess=true, ip of the node
-	NodePort    int32  `json:"node_port"`    // if ExternalAccess=true, port of the service on the node
-	ExternalURL string `json:"external_url"` // if ExternalAccess=true, external url of the service
+	DBName        string `json:"name"`
+	Engine        string `json:"engine"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	ServiceName   string `json:"service_name"`             // equal to ClusterIP
+	ServicePort   int32  `json:"service_port"`             // port of service in the cluster
+	ExternalIP    string `json:"external_ip"`              // if ExternalAccess=true, address of the node or of the load balancer
+	NodePort      int32  `json:"node_port"`                // if ExternalAccess=true, port of the service on the node
+	URL           string `json:"url"`                      // connection url of the database in the cluster
+	ExternalURL   string `json:"external_url"`             // if ExternalAccess=true, connection url through the node port
+	RWService     string `json:"rw_service,omitempty"`     // if HA, service of the primary
+	ROService     string `json:"ro_service,omitempty"`     // if HA, service spreading reads over all servers
+	RWURL         string `json:"rw_url,omitempty"`         // if HA, connection url of the primary
+	ROURL         string `json:"ro_url,omitempty"`         // if HA, connection url of the read-only service
+	PoolerService string `json:"pooler_service,omitempty"` // if pooled, service of the pooler
+	PoolerPort    int32  `json:"pooler_port,omitempty"`    // if pooled, port of the pooler service
+	PoolerURL     string `json:"pooler_url,omitempty"`     // if pooled, connection url through the pooler
 }
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"os"
 
+	"github.com/SepehrNoey/KaaS/pkg/audit"
+	"github.com/SepehrNoey/KaaS/pkg/auth"
 	"github.com/SepehrNoey/KaaS/pkg/cluster"
+	"github.com/SepehrNoey/KaaS/pkg/database"
 	"github.com/SepehrNoey/KaaS/pkg/handlers"
 	"github.com/gorilla/mux"
 )
@@ -15,16 +20,111 @@ func main() {
 		log.Fatalf("Failed to create cluster manager: %v", err)
 	}
 
-	h := handlers.NewHandler(cm)
+	ctx := context.Background()
+	pool, err := database.Connect(ctx)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer pool.Close()
+
+	keys, err := auth.NewKeyStore(ctx, pool)
+	if err != nil {
+		log.Fatalf("Failed to create key store: %v", err)
+	}
+	if adminKey := os.Getenv("AUTH_ADMIN_API_KEY"); adminKey != "" {
+		if err := keys.AddAPIKey(ctx, adminKey, auth.AdminSubject, "", "bootstrap"); err != nil {
+			log.Fatalf("Failed to add admin api key: %v", err)
+		}
+	}
+
+	authz, err := auth.NewAuthorizer(ctx, pool)
+	if err != nil {
+		log.Fatalf("Failed to create authorizer: %v", err)
+	}
+	if err := authz.Bind(ctx, auth.AdminSubject, "", "admin"); err != nil {
+		log.Fatalf("Failed to bind admin role: %v", err)
+	}
+
+	auditStore, err := audit.NewStore(ctx, pool)
+	if err != nil {
+		log.Fatalf("Failed to create audit store: %v", err)
+	}
+	auditStore.TrustedProxies, err = audit.ParseTrustedProxies(os.Getenv("AUDIT_TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalf("Failed to parse trusted proxies: %v", err)
+	}
+
+	authenticators := []auth.Authenticator{keys}
+	jwtAuth, err := jwtAuthenticator(ctx)
+	if err != nil {
+		log.Fatalf("Failed to create JWT authenticator: %v", err)
+	}
+	if jwtAuth != nil {
+		authenticators = append(authenticators, jwtAuth)
+	}
+
+	h := handlers.NewHandler(cm, keys, authz, auditStore)
 
 	router := mux.NewRouter()
-	router.HandleFunc("/api/apps/", h.AddApp).Methods("POST")
-	router.HandleFunc("/api/apps/{name}", h.GetAppStatus).Methods("GET")
-	router.HandleFunc("/api/apps/", h.GetAllAppsStatus).Methods("GET")
-	router.HandleFunc("/api/db/", h.AddDB).Methods("POST")
+	router.Use(auth.Middleware(authenticators...))
+	router.Use(h.TenantMiddleware)
+	router.Use(auditStore.Middleware)
+	router.Handle("/api/apps/", authz.Require(auth.PermDeploy, h.AddApp)).Methods("POST")
+	router.Handle("/api/apps/{name}", authz.Require(auth.PermRead, h.GetAppStatus)).Methods("GET")
+	router.Handle("/api/apps/", authz.Require(auth.PermRead, h.GetAllAppsStatus)).Methods("GET")
+	router.Handle("/api/apps/adopt", authz.Require(auth.PermDeploy, h.AdoptApp)).Methods("POST")
+	router.Handle("/api/apps/{name}/export", authz.Require(auth.PermRead, h.ExportApp)).Methods("GET")
+	router.Handle("/api/routes", authz.Require(auth.PermRead, h.GetRoutes)).Methods("GET")
+	router.Handle("/api/routes/migrate", authz.Require(auth.PermManageRoutes, h.MigrateIngress)).Methods("POST")
+	router.Handle("/api/db/", authz.Require(auth.PermDeploy, h.AddDB)).Methods("POST")
+	router.Handle("/api/db/{name}", authz.Require(auth.PermRead, h.GetDBStatus)).Methods("GET")
+	router.Handle("/api/db/{name}", authz.Require(auth.PermDeploy, h.ResizeDB)).Methods("PATCH")
+	router.Handle("/api/db/{name}/restore", authz.Require(auth.PermDeploy, h.RestoreDB)).Methods("POST")
+	router.Handle("/api/db/{name}/failover", authz.Require(auth.PermDeploy, h.FailoverDB)).Methods("POST")
+	router.Handle("/api/db/{name}/databases", authz.Require(auth.PermDeploy, h.CreateDatabase)).Methods("POST")
+	router.Handle("/api/db/{name}/users", authz.Require(auth.PermDeploy, h.CreateDBUser)).Methods("POST")
+	router.Handle("/api/db/{name}/grants", authz.Require(auth.PermDeploy, h.GrantDB)).Methods("POST")
+	router.Handle("/api/db/{name}/backups", authz.Require(auth.PermRead, h.GetBackups)).Methods("GET")
+	router.Handle("/api/db/{name}/export", authz.Require(auth.PermRead, h.ExportDB)).Methods("GET")
+	router.Handle("/api/db/{name}/connection", authz.Require(auth.PermReadSecrets, h.GetDBConnection)).Methods("GET")
+	router.Handle("/api/apply", authz.Require(auth.PermDeploy, h.Apply)).Methods("POST")
+	router.Handle("/api/keys", authz.Require(auth.PermManageKeys, h.AddAPIKey)).Methods("POST")
+	router.Handle("/api/quotas/{tenant}", authz.Require(auth.PermRead, h.GetQuota)).Methods("GET")
+	router.Handle("/api/quotas/{tenant}", authz.RequireGlobal(auth.PermManageQuotas, h.SetQuota)).Methods("PUT")
+	router.Handle("/api/rolebindings", authz.RequireGlobal(auth.PermManageRoles, h.AddRoleBinding)).Methods("POST")
+	router.Handle("/api/audit", authz.Require(auth.PermReadAudit, h.GetAudit)).Methods("GET")
+	router.HandleFunc("/api/whoami", h.WhoAmI).Methods("GET")
 
 	log.Println("Starting server on :2024")
 	if err := http.ListenAndServe(":2024", router); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
+
+// jwtAuthenticator returns the bearer token authenticator configured through the
+// environment, or nil if neither a JWKS file nor an OIDC issuer is set.
+func jwtAuthenticator(ctx context.Context) (*auth.JWTAuthenticator, error) {
+	jwksFile := os.Getenv("AUTH_JWKS_FILE")
+	issuer := os.Getenv("AUTH_OIDC_ISSUER")
+
+	var keySet auth.KeySet
+	var err error
+	switch {
+	case jwksFile != "":
+		keySet, err = auth.LoadJWKSFile(jwksFile)
+	case issuer != "":
+		keySet, err = auth.NewOIDCKeySet(ctx, issuer)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &auth.JWTAuthenticator{
+		Keys:        keySet,
+		Issuer:      issuer,
+		Audience:    os.Getenv("AUTH_JWT_AUDIENCE"),
+		TenantClaim: os.Getenv("AUTH_TENANT_CLAIM"),
+	}, nil
+}
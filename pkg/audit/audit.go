@@ -0,0 +1,352 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SepehrNoey/KaaS/api"
+	"github.com/SepehrNoey/KaaS/pkg/auth"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"sigs.k8s.io/yaml"
+)
+
+// bodies larger than this are stored truncated
+const maxBodySize = 64 << 10
+
+// requests with larger bodies are rejected
+const maxRequestSize = 4 << 20
+
+const redacted = "[REDACTED]"
+
+// Store keeps a record of every mutating API call in postgres.
+type Store struct {
+	Pool *pgxpool.Pool
+	// X-Forwarded-For is only honored for requests coming from these networks
+	TrustedProxies []*net.IPNet
+}
+
+func NewStore(ctx context.Context, pool *pgxpool.Pool) (*Store, error) {
+	createAuditTableSQL := `
+        CREATE TABLE IF NOT EXISTS audit_log (
+            id BIGSERIAL PRIMARY KEY,
+            subject TEXT NOT NULL,
+            tenant TEXT NOT NULL,
+            source_ip TEXT NOT NULL,
+            method TEXT NOT NULL,
+            route TEXT NOT NULL,
+            app_name TEXT NOT NULL,
+            body TEXT NOT NULL,
+            status INT4 NOT NULL,
+            objects TEXT[] NOT NULL,
+            duration_ms INT8 NOT NULL,
+            created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+        );
+    `
+	if _, err := pool.Exec(ctx, createAuditTableSQL); err != nil {
+		return nil, fmt.Errorf("failed to create audit_log table: %v", err)
+	}
+
+	return &Store{Pool: pool}, nil
+}
+
+// entry collects the objects created while a request is handled.
+type entry struct {
+	mu      sync.Mutex
+	objects []string
+}
+
+type contextKey struct{}
+
+// AddObject records an object created for the request in ctx. It's a no-op
+// for requests that aren't audited.
+func AddObject(ctx context.Context, kind, name string) {
+	e, ok := ctx.Value(contextKey{}).(*entry)
+	if !ok {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.objects = append(e.objects, kind+"/"+name)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Middleware writes an audit record for every POST, PUT, PATCH and DELETE request.
+func (s *Store) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("request body is larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		e := &entry{objects: []string{}}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), contextKey{}, e)))
+
+		record := api.AuditRecord{
+			SourceIP:   s.sourceIP(r),
+			Method:     r.Method,
+			Route:      r.URL.Path,
+			AppName:    appName(r, body),
+			Body:       redactBody(body),
+			Status:     recorder.status,
+			Objects:    e.objects,
+			DurationMS: time.Since(start).Milliseconds(),
+		}
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				record.Route = template
+			}
+		}
+		if identity := auth.IdentityFromContext(r.Context()); identity != nil {
+			record.Subject = identity.Subject
+			record.Tenant = identity.Tenant
+		}
+
+		// written in the background so the response isn't held back by the audit log
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := s.write(ctx, &record); err != nil {
+				log.Printf("failed to write audit record for %s %s: %v", record.Method, record.Route, err)
+			}
+		}()
+	})
+}
+
+func (s *Store) write(ctx context.Context, record *api.AuditRecord) error {
+	_, err := s.Pool.Exec(ctx, `
+        INSERT INTO audit_log (subject, tenant, source_ip, method, route, app_name, body, status, objects, duration_ms)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+    `, record.Subject, record.Tenant, record.SourceIP, record.Method, record.Route, record.AppName,
+		record.Body, record.Status, record.Objects, record.DurationMS)
+	return err
+}
+
+// Filter selects audit records, empty fields match everything.
+type Filter struct {
+	Subject string
+	Tenant  string
+	App     string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+func (s *Store) List(ctx context.Context, f Filter) ([]api.AuditRecord, error) {
+	query := `
+        SELECT subject, tenant, source_ip, method, route, app_name, body, status, objects, duration_ms, created_at
+        FROM audit_log WHERE TRUE
+    `
+	args := []any{}
+	addCondition := func(condition string, value any) {
+		args = append(args, value)
+		query += fmt.Sprintf(" AND %s $%d", condition, len(args))
+	}
+	if f.Subject != "" {
+		addCondition("subject =", f.Subject)
+	}
+	if f.Tenant != "" {
+		addCondition("tenant =", f.Tenant)
+	}
+	if f.App != "" {
+		addCondition("app_name =", f.App)
+	}
+	if !f.Since.IsZero() {
+		addCondition("created_at >=", f.Since.UTC())
+	}
+	if !f.Until.IsZero() {
+		addCondition("created_at <", f.Until.UTC())
+	}
+	if f.Limit <= 0 || f.Limit > 1000 {
+		f.Limit = 100
+	}
+	args = append(args, f.Limit)
+	query += fmt.Sprintf(" ORDER BY created_at DESC LIMIT $%d", len(args))
+
+	rows, err := s.Pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit log: %v", err)
+	}
+	defer rows.Close()
+
+	records := []api.AuditRecord{}
+	for rows.Next() {
+		var record api.AuditRecord
+		err := rows.Scan(&record.Subject, &record.Tenant, &record.SourceIP, &record.Method, &record.Route,
+			&record.AppName, &record.Body, &record.Status, &record.Objects, &record.DurationMS, &record.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// ParseTrustedProxies parses a comma separated list of IPs and CIDRs.
+func ParseTrustedProxies(list string) ([]*net.IPNet, error) {
+	proxies := []*net.IPNet{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", item)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", item, err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (s *Store) trusted(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && slices.ContainsFunc(s.TrustedProxies, func(network *net.IPNet) bool { return network.Contains(ip) })
+}
+
+// sourceIP returns the address of the caller. X-Forwarded-For is only
+// honored when the request comes from a trusted proxy, and the addresses the
+// trusted proxies appended to it are skipped.
+func (s *Store) sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !s.trusted(host) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop == "" {
+			continue
+		}
+		if !s.trusted(hop) {
+			return hop
+		}
+		host = hop
+	}
+	return host
+}
+
+// appName returns the app or database the request is about, from the route or the body.
+func appName(r *http.Request, body []byte) string {
+	if name, ok := mux.Vars(r)["name"]; ok {
+		return name
+	}
+	var named struct {
+		Name string `json:"name"`
+	}
+	if err := yaml.Unmarshal(body, &named); err != nil {
+		return ""
+	}
+	return named.Name
+}
+
+// redactBody replaces secrets, passwords, keys and tokens in a JSON or YAML body.
+func redactBody(body []byte) string {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return ""
+	}
+
+	var doc any
+	if err := yaml.Unmarshal(body, &doc); err != nil {
+		return "[unparsable body omitted]"
+	}
+	data, err := json.Marshal(redact(doc))
+	if err != nil {
+		return "[unparsable body omitted]"
+	}
+	if len(data) > maxBodySize {
+		return string(data[:maxBodySize]) + "...[truncated]"
+	}
+	return string(data)
+}
+
+func redact(v any) any {
+	switch value := v.(type) {
+	case map[string]any:
+		for key, item := range value {
+			if sensitiveKey(key) {
+				value[key] = redactValue(item)
+			} else {
+				value[key] = redact(item)
+			}
+		}
+		return value
+	case []any:
+		for i, item := range value {
+			value[i] = redact(item)
+		}
+		return value
+	default:
+		return v
+	}
+}
+
+// redactValue hides the values but keeps the keys of maps, so the record shows
+// which secrets were set.
+func redactValue(v any) any {
+	if m, ok := v.(map[string]any); ok {
+		for key := range m {
+			m[key] = redacted
+		}
+		return m
+	}
+	return redacted
+}
+
+func sensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	return key == "secrets" || key == "key" || strings.HasSuffix(key, "_key") ||
+		strings.Contains(key, "password") || strings.Contains(key, "token")
+}
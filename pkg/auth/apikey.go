@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const apiKeyHeader = "X-API-Key"
+
+// AdminSubject is the subject of the bootstrap admin key.
+const AdminSubject = "admin"
+
+// reservedSubjects can't get keys through the API.
+var reservedSubjects = map[string]bool{AdminSubject: true, "bootstrap": true}
+
+// IsReservedSubject reports whether subject is reserved for KaaS itself.
+func IsReservedSubject(subject string) bool {
+	return reservedSubjects[subject]
+}
+
+// KeyStore keeps API keys in postgres. Only the SHA-256 of a key is stored,
+// the key itself is returned once when it's created.
+type KeyStore struct {
+	Pool querier
+}
+
+// querier is the part of *pgxpool.Pool the KeyStore uses.
+type querier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+func NewKeyStore(ctx context.Context, pool *pgxpool.Pool) (*KeyStore, error) {
+	createKeyTableSQL := `
+        CREATE TABLE IF NOT EXISTS api_keys (
+            key_hash TEXT PRIMARY KEY,
+            subject TEXT NOT NULL,
+            created_by TEXT NOT NULL,
+            revoked BOOLEAN NOT NULL DEFAULT FALSE,
+            created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+        );
+    `
+	if _, err := pool.Exec(ctx, createKeyTableSQL); err != nil {
+		return nil, fmt.Errorf("failed to create api_keys table: %v", err)
+	}
+
+	addTenantSQL := `ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT ''`
+	if _, err := pool.Exec(ctx, addTenantSQL); err != nil {
+		return nil, fmt.Errorf("failed to add tenant to api_keys table: %v", err)
+	}
+
+	return &KeyStore{Pool: pool}, nil
+}
+
+// CreateAPIKey generates a new key for subject of tenant and returns it.
+func (s *KeyStore) CreateAPIKey(ctx context.Context, subject, tenant, createdBy string) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	key := "kaas_" + hex.EncodeToString(buf)
+
+	if err := s.AddAPIKey(ctx, key, subject, tenant, createdBy); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// AddAPIKey stores a key chosen by the caller, e.g. the bootstrap admin key.
+// Adding a key that already exists is a no-op.
+func (s *KeyStore) AddAPIKey(ctx context.Context, key, subject, tenant, createdBy string) error {
+	_, err := s.Pool.Exec(ctx,
+		`INSERT INTO api_keys (key_hash, subject, tenant, created_by) VALUES ($1, $2, $3, $4) ON CONFLICT (key_hash) DO NOTHING`,
+		hashKey(key), subject, tenant, createdBy)
+	if err != nil {
+		return fmt.Errorf("failed to store api key: %v", err)
+	}
+	return nil
+}
+
+// SubjectTenants returns the tenants the keys of subject were created in.
+func (s *KeyStore) SubjectTenants(ctx context.Context, subject string) ([]string, error) {
+	rows, err := s.Pool.Query(ctx, `SELECT DISTINCT tenant FROM api_keys WHERE subject = $1 ORDER BY tenant`, subject)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get api keys: %v", err)
+	}
+	defer rows.Close()
+
+	tenants := []string{}
+	for rows.Next() {
+		var tenant string
+		if err := rows.Scan(&tenant); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, tenant)
+	}
+	return tenants, rows.Err()
+}
+
+func (s *KeyStore) Authenticate(r *http.Request) (*Identity, error) {
+	key := r.Header.Get(apiKeyHeader)
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+
+	var subject, tenant string
+	err := s.Pool.QueryRow(r.Context(),
+		`SELECT subject, tenant FROM api_keys WHERE key_hash = $1 AND NOT revoked`, hashKey(key)).Scan(&subject, &tenant)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errors.New("unknown or revoked api key")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up api key: %v", err)
+	}
+
+	return &Identity{Subject: subject, Tenant: tenant, Method: "api_key"}, nil
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
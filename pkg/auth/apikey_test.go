@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+type storedKey struct {
+	subject string
+	tenant  string
+	revoked bool
+}
+
+// fakeKeyTable answers the api_keys lookups of Authenticate from a map keyed
+// by key hash, and records the arguments of the queries.
+type fakeKeyTable struct {
+	keys map[string]storedKey
+	err  error
+	args [][]any
+}
+
+func (f *fakeKeyTable) Exec(context.Context, string, ...any) (pgconn.CommandTag, error) {
+	return pgconn.CommandTag{}, errors.New("not implemented")
+}
+
+func (f *fakeKeyTable) Query(context.Context, string, ...any) (pgx.Rows, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (f *fakeKeyTable) QueryRow(_ context.Context, sql string, args ...any) pgx.Row {
+	f.args = append(f.args, args)
+	if f.err != nil {
+		return fakeRow{err: f.err}
+	}
+	if !strings.Contains(sql, "key_hash = $1") || len(args) != 1 {
+		return fakeRow{err: errors.New("unexpected query")}
+	}
+	hash, _ := args[0].(string)
+	key, ok := f.keys[hash]
+	if !ok || key.revoked {
+		return fakeRow{err: pgx.ErrNoRows}
+	}
+	return fakeRow{values: []string{key.subject, key.tenant}}
+}
+
+type fakeRow struct {
+	values []string
+	err    error
+}
+
+func (r fakeRow) Scan(dest ...any) error {
+	if r.err != nil {
+		return r.err
+	}
+	for i := range dest {
+		*dest[i].(*string) = r.values[i]
+	}
+	return nil
+}
+
+func TestHashKey(t *testing.T) {
+	// SHA-256 of "abc"
+	want := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	if got := hashKey("abc"); got != want {
+		t.Fatalf("hashKey(abc) = %s, want %s", got, want)
+	}
+	if hashKey("kaas_a") == hashKey("kaas_b") {
+		t.Fatalf("different keys have the same hash")
+	}
+}
+
+func TestKeyStoreAuthenticate(t *testing.T) {
+	table := &fakeKeyTable{keys: map[string]storedKey{
+		hashKey("kaas_alice"):   {subject: "alice", tenant: "team"},
+		hashKey("kaas_admin"):   {subject: AdminSubject},
+		hashKey("kaas_revoked"): {subject: "bob", tenant: "team", revoked: true},
+	}}
+	store := &KeyStore{Pool: table}
+
+	tests := []struct {
+		name     string
+		key      string
+		identity *Identity
+		err      string
+	}{
+		{name: "tenant key", key: "kaas_alice", identity: &Identity{Subject: "alice", Tenant: "team", Method: "api_key"}},
+		{name: "global key", key: "kaas_admin", identity: &Identity{Subject: AdminSubject, Method: "api_key"}},
+		{name: "unknown key", key: "kaas_mallory", err: "unknown or revoked api key"},
+		{name: "revoked key", key: "kaas_revoked", err: "unknown or revoked api key"},
+		{name: "hash as key", key: hashKey("kaas_alice"), err: "unknown or revoked api key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table.args = nil
+			r := httptest.NewRequest("GET", "/api/apps", nil)
+			r.Header.Set(apiKeyHeader, tt.key)
+
+			identity, err := store.Authenticate(r)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Authenticate returned %v, want %q", err, tt.err)
+				}
+			} else if err != nil {
+				t.Fatalf("Authenticate failed: %v", err)
+			} else if *identity != *tt.identity {
+				t.Fatalf("Authenticate returned %+v, want %+v", identity, tt.identity)
+			}
+
+			// only the hash of the key is sent to the database
+			if len(table.args) != 1 || table.args[0][0] != hashKey(tt.key) {
+				t.Fatalf("looked up %v, want the hash of the key", table.args)
+			}
+		})
+	}
+}
+
+func TestKeyStoreAuthenticateNoKey(t *testing.T) {
+	table := &fakeKeyTable{}
+	store := &KeyStore{Pool: table}
+
+	r := httptest.NewRequest("GET", "/api/apps", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	if _, err := store.Authenticate(r); !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("Authenticate returned %v, want ErrNoCredentials", err)
+	}
+	if len(table.args) != 0 {
+		t.Fatalf("a request without key was looked up")
+	}
+}
+
+func TestKeyStoreAuthenticateDatabaseError(t *testing.T) {
+	store := &KeyStore{Pool: &fakeKeyTable{err: errors.New("connection refused")}}
+
+	r := httptest.NewRequest("GET", "/api/apps", nil)
+	r.Header.Set(apiKeyHeader, "kaas_alice")
+	_, err := store.Authenticate(r)
+	if err == nil || !strings.Contains(err.Error(), "failed to look up api key") {
+		t.Fatalf("Authenticate returned %v, want a lookup error", err)
+	}
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// ErrNoCredentials is returned by an Authenticator when the request doesn't
+// carry credentials of its kind, so the next authenticator is tried.
+var ErrNoCredentials = errors.New("no credentials")
+
+// Identity is the authenticated caller of a request.
+type Identity struct {
+	Subject string `json:"subject"`
+	Tenant  string `json:"tenant"` // empty for callers that don't belong to a tenant
+	Method  string `json:"method"` // api_key or jwt
+}
+
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+type contextKey struct{}
+
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, identity)
+}
+
+// IdentityFromContext returns the identity stored by Middleware, or nil.
+func IdentityFromContext(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(contextKey{}).(*Identity)
+	return identity
+}
+
+// Middleware rejects requests that none of the authenticators accepts and
+// stores the identity of the caller in the request context.
+func Middleware(authenticators ...Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, authenticator := range authenticators {
+				identity, err := authenticator.Authenticate(r)
+				if errors.Is(err, ErrNoCredentials) {
+					continue
+				}
+				if err != nil {
+					log.Printf("authentication failed for %s %s: %v", r.Method, r.URL.Path, err)
+					unauthorized(w)
+					return
+				}
+
+				next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), identity)))
+				return
+			}
+
+			unauthorized(w)
+		})
+	}
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="kaas"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// oidcServer serves the discovery document and the JWKS of an OIDC issuer.
+type oidcServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	keys    []jwk
+	fetches int
+}
+
+func newOIDCServer(t *testing.T, keys ...jwk) *oidcServer {
+	t.Helper()
+	s := &oidcServer{keys: keys}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": s.URL, "jwks_uri": s.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.fetches++
+		json.NewEncoder(w).Encode(jwks{Keys: s.keys})
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *oidcServer) setKeys(keys ...jwk) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
+
+func (s *oidcServer) fetchCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fetches
+}
+
+func TestOIDCKeySet(t *testing.T) {
+	server := newOIDCServer(t, publicJWK("rsa", testKeys.rsa))
+	ctx := context.Background()
+
+	keys, err := NewOIDCKeySet(ctx, server.URL+"/")
+	if err != nil {
+		t.Fatalf("NewOIDCKeySet failed: %v", err)
+	}
+	authenticator := &JWTAuthenticator{Keys: keys, Issuer: server.URL, Audience: testAudience}
+	authenticate := func(kid string, key any) error {
+		claims := withClaims(map[string]any{"iss": server.URL})
+		r := httptest.NewRequest("GET", "/api/apps", nil)
+		r.Header.Set("Authorization", "Bearer "+signToken(t, map[string]any{"alg": "RS256", "kid": kid}, claims, key))
+		_, err := authenticator.Authenticate(r)
+		return err
+	}
+
+	if err := authenticate("rsa", testKeys.rsa); err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+
+	// the issuer rotates its key, unknown key ids are only fetched once per refreshInterval
+	server.setKeys(publicJWK("rsa", testKeys.rsa), publicJWK("rotated", testKeys.otherRSA))
+	if err := authenticate("rotated", testKeys.otherRSA); err == nil || !strings.Contains(err.Error(), "unknown token key") {
+		t.Fatalf("Authenticate returned %v before the refresh interval, want an unknown key", err)
+	}
+	if fetches := server.fetchCount(); fetches != 1 {
+		t.Fatalf("JWKS was fetched %d times, want 1", fetches)
+	}
+
+	keys.(*oidcKeySet).fetchedAt = time.Now().Add(-refreshInterval)
+	if err := authenticate("rotated", testKeys.otherRSA); err != nil {
+		t.Fatalf("Authenticate with the rotated key failed: %v", err)
+	}
+	if fetches := server.fetchCount(); fetches != 2 {
+		t.Fatalf("JWKS was fetched %d times, want 2", fetches)
+	}
+
+	// the refresh doesn't make unknown keys valid
+	keys.(*oidcKeySet).fetchedAt = time.Now().Add(-refreshInterval)
+	if err := authenticate("unknown", testKeys.rsa); err == nil || !strings.Contains(err.Error(), `unknown token key "unknown"`) {
+		t.Fatalf("Authenticate returned %v, want an unknown key", err)
+	}
+}
+
+func TestNewOIDCKeySetErrors(t *testing.T) {
+	ctx := context.Background()
+
+	noJWKS := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"issuer": "https://issuer.example.com"}`))
+	}))
+	defer noJWKS.Close()
+	if _, err := NewOIDCKeySet(ctx, noJWKS.URL); err == nil || !strings.Contains(err.Error(), "has no jwks_uri") {
+		t.Fatalf("NewOIDCKeySet returned %v, want a missing jwks_uri", err)
+	}
+
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	if _, err := NewOIDCKeySet(ctx, notFound.URL); err == nil || !strings.Contains(err.Error(), "failed to discover OIDC issuer") {
+		t.Fatalf("NewOIDCKeySet returned %v, want a discovery error", err)
+	}
+
+	noKeys := newOIDCServer(t)
+	if _, err := NewOIDCKeySet(ctx, noKeys.URL); err == nil || !strings.Contains(err.Error(), "no signing keys") {
+		t.Fatalf("NewOIDCKeySet returned %v, want no signing keys", err)
+	}
+}
+
+func TestLoadJWKSFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	data, err := json.Marshal(jwks{Keys: []jwk{publicJWK("ec", testKeys.ec)}})
+	if err != nil {
+		t.Fatalf("failed to encode JWKS: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("failed to write JWKS file: %v", err)
+	}
+
+	keys, err := LoadJWKSFile(path)
+	if err != nil {
+		t.Fatalf("LoadJWKSFile failed: %v", err)
+	}
+	// a token without kid is verified with the only key
+	key, err := keys.Key(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Key failed: %v", err)
+	}
+	if !testKeys.ec.PublicKey.Equal(key) {
+		t.Fatalf("Key returned another key")
+	}
+
+	if _, err := LoadJWKSFile(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Fatalf("LoadJWKSFile of a missing file succeeded")
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	encryption := publicJWK("enc", testKeys.otherRSA)
+	encryption.Use = "enc"
+
+	tests := []struct {
+		name string
+		keys []jwk
+		kids []string
+		err  string
+	}{
+		{name: "signing keys", keys: []jwk{publicJWK("rsa", testKeys.rsa), publicJWK("ec", testKeys.ec)}, kids: []string{"ec", "rsa"}},
+		{name: "encryption keys are skipped", keys: []jwk{publicJWK("rsa", testKeys.rsa), encryption}, kids: []string{"rsa"}},
+		{name: "only encryption keys", keys: []jwk{encryption}, err: "no signing keys"},
+		{name: "unsupported key type", keys: []jwk{{Kty: "oct", Kid: "hmac"}}, err: `unsupported key type "oct"`},
+		{name: "unsupported curve", keys: []jwk{{Kty: "EC", Kid: "ec", Crv: "P-224"}}, err: `unsupported curve "P-224"`},
+		{name: "malformed modulus", keys: []jwk{{Kty: "RSA", Kid: "rsa", N: "!", E: "AQAB"}}, err: `malformed key "rsa"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(jwks{Keys: tt.keys})
+			if err != nil {
+				t.Fatalf("failed to encode JWKS: %v", err)
+			}
+			keys, err := parseJWKS(data)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("parseJWKS returned %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseJWKS failed: %v", err)
+			}
+			if len(keys) != len(tt.kids) {
+				t.Fatalf("parseJWKS returned %d keys, want %v", len(keys), tt.kids)
+			}
+			for _, kid := range tt.kids {
+				if _, ok := keys[kid]; !ok {
+					t.Fatalf("parseJWKS didn't return key %q", kid)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// allowed difference between our clock and the clock of the token issuer
+const clockSkew = time.Minute
+
+// JWTAuthenticator accepts bearer tokens signed by one of the keys of Keys.
+type JWTAuthenticator struct {
+	Keys        KeySet
+	Issuer      string // if set, the iss claim must match
+	Audience    string // if set, the aud claim must contain it
+	TenantClaim string // claim holding the tenant of the caller, defaults to "tenant"
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *int64          `json:"exp"`
+	NotBefore *int64          `json:"nbf"`
+}
+
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	authorization := r.Header.Get("Authorization")
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+	key, err := a.Keys.Key(r.Context(), header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %v", err)
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %v", err)
+	}
+	if err := a.validateClaims(&claims, time.Now()); err != nil {
+		return nil, err
+	}
+
+	tenantClaim := a.TenantClaim
+	if tenantClaim == "" {
+		tenantClaim = "tenant"
+	}
+	var allClaims map[string]any
+	if err := decodeSegment(parts[1], &allClaims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %v", err)
+	}
+	// callers without a tenant would work in the global namespace
+	tenant, _ := allClaims[tenantClaim].(string)
+	if tenant == "" {
+		return nil, fmt.Errorf("token has no %s claim", tenantClaim)
+	}
+
+	return &Identity{Subject: claims.Subject, Tenant: tenant, Method: "jwt"}, nil
+}
+
+func (a *JWTAuthenticator) validateClaims(claims *jwtClaims, now time.Time) error {
+	if claims.Subject == "" {
+		return errors.New("token has no subject")
+	}
+	if claims.ExpiresAt == nil {
+		return errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(*claims.ExpiresAt, 0).Add(clockSkew)) {
+		return errors.New("token is expired")
+	}
+	if claims.NotBefore != nil && now.Before(time.Unix(*claims.NotBefore, 0).Add(-clockSkew)) {
+		return errors.New("token is not valid yet")
+	}
+	if a.Issuer != "" && claims.Issuer != a.Issuer {
+		return fmt.Errorf("unexpected token issuer %q", claims.Issuer)
+	}
+
+	if a.Audience != "" {
+		var audiences []string
+		var single string
+		if err := json.Unmarshal(claims.Audience, &single); err == nil {
+			audiences = []string{single}
+		} else if err := json.Unmarshal(claims.Audience, &audiences); err != nil {
+			return errors.New("malformed token audience")
+		}
+		if !slices.Contains(audiences, a.Audience) {
+			return errors.New("token is not issued for this audience")
+		}
+	}
+
+	return nil
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		var err error
+		switch alg[:2] {
+		case "RS":
+			err = rsa.VerifyPKCS1v15(k, hash, digest, signature)
+		case "PS":
+			err = rsa.VerifyPSS(k, hash, digest, signature, nil)
+		default:
+			return fmt.Errorf("algorithm %s doesn't match an RSA key", alg)
+		}
+		if err != nil {
+			return errors.New("invalid token signature")
+		}
+
+	case *ecdsa.PublicKey:
+		if alg[:2] != "ES" {
+			return fmt.Errorf("algorithm %s doesn't match an EC key", alg)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("invalid token signature")
+		}
+
+	default:
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+
+	return nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,281 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://issuer.example.com"
+	testAudience = "kaas"
+)
+
+// testKeys are generated once, RSA keys are slow to generate.
+var testKeys = struct {
+	rsa, otherRSA *rsa.PrivateKey
+	ec            *ecdsa.PrivateKey
+}{
+	rsa:      mustRSAKey(),
+	otherRSA: mustRSAKey(),
+	ec:       mustECKey(),
+}
+
+func mustRSAKey() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func mustECKey() *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// publicJWK returns the JWK of the public part of key.
+func publicJWK(kid string, key crypto.Signer) jwk {
+	encode := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+	switch k := key.Public().(type) {
+	case *rsa.PublicKey:
+		return jwk{Kty: "RSA", Kid: kid, Use: "sig", N: encode(k.N), E: encode(big.NewInt(int64(k.E)))}
+	case *ecdsa.PublicKey:
+		return jwk{Kty: "EC", Kid: kid, Use: "sig", Crv: k.Curve.Params().Name, X: encode(k.X), Y: encode(k.Y)}
+	}
+	panic("unsupported key")
+}
+
+// signToken encodes header and claims and signs them with key. Signing keys
+// are crypto.Signers, HS256 takes the HMAC secret as []byte.
+func signToken(t *testing.T, header, claims map[string]any, key any) string {
+	t.Helper()
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("failed to encode token: %v", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(header) + "." + encode(claims)
+
+	var signature []byte
+	alg, _ := header["alg"].(string)
+	switch {
+	case alg == "none":
+	case alg == "HS256":
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	default:
+		hash := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}[alg[2:]]
+		h := hash.New()
+		h.Write([]byte(signed))
+		digest := h.Sum(nil)
+
+		var err error
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			if strings.HasPrefix(alg, "PS") {
+				signature, err = rsa.SignPSS(rand.Reader, k, hash, digest, nil)
+			} else {
+				signature, err = rsa.SignPKCS1v15(rand.Reader, k, hash, digest)
+			}
+		case *ecdsa.PrivateKey:
+			var r, s *big.Int
+			r, s, err = ecdsa.Sign(rand.Reader, k, digest)
+			size := (k.Curve.Params().BitSize + 7) / 8
+			signature = make([]byte, 2*size)
+			if err == nil {
+				r.FillBytes(signature[:size])
+				s.FillBytes(signature[size:])
+			}
+		}
+		if err != nil {
+			t.Fatalf("failed to sign token: %v", err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func validClaims() map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"sub":    "alice",
+		"iss":    testIssuer,
+		"aud":    testAudience,
+		"exp":    now.Add(time.Hour).Unix(),
+		"nbf":    now.Add(-time.Minute).Unix(),
+		"tenant": "team",
+	}
+}
+
+func withClaims(changes map[string]any) map[string]any {
+	claims := validClaims()
+	for key, value := range changes {
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+	}
+	return claims
+}
+
+func testKeySet(t *testing.T) KeySet {
+	t.Helper()
+	data, err := json.Marshal(jwks{Keys: []jwk{publicJWK("rsa", testKeys.rsa), publicJWK("ec", testKeys.ec)}})
+	if err != nil {
+		t.Fatalf("failed to encode JWKS: %v", err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		t.Fatalf("parseJWKS failed: %v", err)
+	}
+	return &staticKeySet{keys: keys}
+}
+
+func TestJWTAuthenticate(t *testing.T) {
+	now := time.Now()
+	rsaPublicDER, err := x509.MarshalPKIXPublicKey(&testKeys.rsa.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to marshal public key: %v", err)
+	}
+	rs256 := func(kid string) map[string]any { return map[string]any{"alg": "RS256", "kid": kid} }
+
+	tests := []struct {
+		name   string
+		header map[string]any
+		claims map[string]any
+		key    any
+		tamper func(token string) string
+		err    string // empty if the token is accepted
+	}{
+		{name: "RS256", header: rs256("rsa"), claims: validClaims(), key: testKeys.rsa},
+		{name: "RS512", header: map[string]any{"alg": "RS512", "kid": "rsa"}, claims: validClaims(), key: testKeys.rsa},
+		{name: "PS256", header: map[string]any{"alg": "PS256", "kid": "rsa"}, claims: validClaims(), key: testKeys.rsa},
+		{name: "ES256", header: map[string]any{"alg": "ES256", "kid": "ec"}, claims: validClaims(), key: testKeys.ec},
+		{name: "audience list", header: rs256("rsa"), claims: withClaims(map[string]any{"aud": []string{"other", testAudience}}), key: testKeys.rsa},
+
+		{name: "signed by another key", header: rs256("rsa"), claims: validClaims(), key: testKeys.otherRSA, err: "invalid token signature"},
+		{
+			name: "tampered claims", header: rs256("rsa"), claims: validClaims(), key: testKeys.rsa, err: "invalid token signature",
+			tamper: func(token string) string {
+				parts := strings.Split(token, ".")
+				claims, _ := json.Marshal(withClaims(map[string]any{"tenant": "other"}))
+				parts[1] = base64.RawURLEncoding.EncodeToString(claims)
+				return strings.Join(parts, ".")
+			},
+		},
+		{name: "EC algorithm with RSA key", header: map[string]any{"alg": "ES256", "kid": "rsa"}, claims: validClaims(), key: testKeys.ec, err: "doesn't match an RSA key"},
+		{name: "RSA algorithm with EC key", header: map[string]any{"alg": "RS256", "kid": "ec"}, claims: validClaims(), key: testKeys.rsa, err: "doesn't match an EC key"},
+		{name: "alg none", header: map[string]any{"alg": "none", "kid": "rsa"}, claims: validClaims(), err: "unsupported token algorithm"},
+		{name: "HS256 with the RSA public key", header: map[string]any{"alg": "HS256", "kid": "rsa"}, claims: validClaims(), key: rsaPublicDER, err: "unsupported token algorithm"},
+		{name: "unknown kid", header: rs256("other"), claims: validClaims(), key: testKeys.rsa, err: `unknown token key "other"`},
+		{name: "no kid with several keys", header: map[string]any{"alg": "RS256"}, claims: validClaims(), key: testKeys.rsa, err: `unknown token key ""`},
+
+		{name: "expired within skew", header: rs256("rsa"), claims: withClaims(map[string]any{"exp": now.Add(-clockSkew / 2).Unix()}), key: testKeys.rsa},
+		{name: "expired", header: rs256("rsa"), claims: withClaims(map[string]any{"exp": now.Add(-2 * clockSkew).Unix()}), key: testKeys.rsa, err: "token is expired"},
+		{name: "no expiry", header: rs256("rsa"), claims: withClaims(map[string]any{"exp": nil}), key: testKeys.rsa, err: "token has no expiry"},
+		{name: "not before within skew", header: rs256("rsa"), claims: withClaims(map[string]any{"nbf": now.Add(clockSkew / 2).Unix()}), key: testKeys.rsa},
+		{name: "not valid yet", header: rs256("rsa"), claims: withClaims(map[string]any{"nbf": now.Add(2 * clockSkew).Unix()}), key: testKeys.rsa, err: "token is not valid yet"},
+
+		{name: "wrong issuer", header: rs256("rsa"), claims: withClaims(map[string]any{"iss": "https://evil.example.com"}), key: testKeys.rsa, err: "unexpected token issuer"},
+		{name: "wrong audience", header: rs256("rsa"), claims: withClaims(map[string]any{"aud": "other"}), key: testKeys.rsa, err: "not issued for this audience"},
+		{name: "audience list without ours", header: rs256("rsa"), claims: withClaims(map[string]any{"aud": []string{"a", "b"}}), key: testKeys.rsa, err: "not issued for this audience"},
+		{name: "no audience", header: rs256("rsa"), claims: withClaims(map[string]any{"aud": nil}), key: testKeys.rsa, err: "malformed token audience"},
+		{name: "no subject", header: rs256("rsa"), claims: withClaims(map[string]any{"sub": nil}), key: testKeys.rsa, err: "token has no subject"},
+		{name: "no tenant", header: rs256("rsa"), claims: withClaims(map[string]any{"tenant": nil}), key: testKeys.rsa, err: "token has no tenant claim"},
+		{name: "empty tenant", header: rs256("rsa"), claims: withClaims(map[string]any{"tenant": ""}), key: testKeys.rsa, err: "token has no tenant claim"},
+		{name: "tenant not a string", header: rs256("rsa"), claims: withClaims(map[string]any{"tenant": []string{"team"}}), key: testKeys.rsa, err: "token has no tenant claim"},
+	}
+
+	authenticator := &JWTAuthenticator{Keys: testKeySet(t), Issuer: testIssuer, Audience: testAudience}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := signToken(t, tt.header, tt.claims, tt.key)
+			if tt.tamper != nil {
+				token = tt.tamper(token)
+			}
+			r := httptest.NewRequest("GET", "/api/apps", nil)
+			r.Header.Set("Authorization", "Bearer "+token)
+
+			identity, err := authenticator.Authenticate(r)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Authenticate returned %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Authenticate failed: %v", err)
+			}
+			want := Identity{Subject: "alice", Tenant: "team", Method: "jwt"}
+			if *identity != want {
+				t.Fatalf("Authenticate returned %+v, want %+v", identity, want)
+			}
+		})
+	}
+}
+
+func TestJWTAuthenticateTenantClaim(t *testing.T) {
+	authenticator := &JWTAuthenticator{Keys: testKeySet(t), TenantClaim: "org"}
+	claims := withClaims(map[string]any{"org": "acme"})
+
+	r := httptest.NewRequest("GET", "/api/apps", nil)
+	r.Header.Set("Authorization", "Bearer "+signToken(t, map[string]any{"alg": "RS256", "kid": "rsa"}, claims, testKeys.rsa))
+	identity, err := authenticator.Authenticate(r)
+	if err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	if identity.Tenant != "acme" {
+		t.Fatalf("tenant is %q, want the org claim", identity.Tenant)
+	}
+}
+
+func TestJWTAuthenticateMalformed(t *testing.T) {
+	authenticator := &JWTAuthenticator{Keys: testKeySet(t)}
+
+	tests := []struct {
+		name          string
+		authorization string
+		err           string
+	}{
+		{name: "no header", authorization: "", err: ErrNoCredentials.Error()},
+		{name: "basic auth", authorization: "Basic YWxpY2U6c2VjcmV0", err: ErrNoCredentials.Error()},
+		{name: "two segments", authorization: "Bearer a.b", err: "malformed token"},
+		{name: "header not base64", authorization: "Bearer !.b.c", err: "malformed token header"},
+		{name: "signature not base64", authorization: "Bearer " + base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"rsa"}`)) + ".e30.!", err: "malformed token signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/apps", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			_, err := authenticator.Authenticate(r)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("Authenticate returned %v, want %q", err, tt.err)
+			}
+			if tt.err == ErrNoCredentials.Error() && !errors.Is(err, ErrNoCredentials) {
+				t.Fatalf("Authenticate returned %v, want ErrNoCredentials", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type Permission string
+
+const (
+	PermRead         Permission = "read"          // GET endpoints
+	PermDeploy       Permission = "deploy"        // creating apps and databases
+	PermExternalDB   Permission = "db:external"   // databases with external access
+	PermManageRoutes Permission = "routes:manage" // migrating the shared ingress
+	PermManageKeys   Permission = "keys:manage"   // creating api keys
+	PermManageQuotas Permission = "quotas:manage" // changing quotas, only through global bindings
+	PermManageRoles  Permission = "roles:manage"  // binding roles, only through global bindings
+	PermReadAudit    Permission = "audit:read"    // reading the audit log
+	PermReadSecrets  Permission = "secrets:read"  // reading the credentials of databases
+)
+
+// defaultRoles are added to the roles table at startup, roles that already
+// exist get the permissions they miss and keep the ones added to them.
+var defaultRoles = map[string][]Permission{
+	"viewer":   {PermRead},
+	"deployer": {PermRead, PermDeploy, PermReadSecrets},
+	"admin": {
+		PermRead, PermDeploy, PermExternalDB, PermManageRoutes,
+		PermManageKeys, PermManageQuotas, PermManageRoles, PermReadAudit,
+		PermReadSecrets,
+	},
+}
+
+// Authorizer resolves the permissions of callers from the roles bound to them.
+// A binding without tenant applies to every tenant, but only to callers that
+// don't belong to a tenant, so a key created in a tenant never inherits it.
+type Authorizer struct {
+	Pool *pgxpool.Pool
+}
+
+func NewAuthorizer(ctx context.Context, pool *pgxpool.Pool) (*Authorizer, error) {
+	createRoleTableSQL := `
+        CREATE TABLE IF NOT EXISTS roles (
+            name TEXT PRIMARY KEY,
+            permissions TEXT[] NOT NULL
+        );
+    `
+	if _, err := pool.Exec(ctx, createRoleTableSQL); err != nil {
+		return nil, fmt.Errorf("failed to create roles table: %v", err)
+	}
+
+	createBindingTableSQL := `
+        CREATE TABLE IF NOT EXISTS role_bindings (
+            subject TEXT NOT NULL,
+            tenant TEXT NOT NULL DEFAULT '',
+            role TEXT NOT NULL REFERENCES roles (name),
+            created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+            PRIMARY KEY (subject, tenant, role)
+        );
+    `
+	if _, err := pool.Exec(ctx, createBindingTableSQL); err != nil {
+		return nil, fmt.Errorf("failed to create role_bindings table: %v", err)
+	}
+
+	for name, permissions := range defaultRoles {
+		_, err := pool.Exec(ctx,
+			`INSERT INTO roles (name, permissions) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE
+             SET permissions = ARRAY(SELECT DISTINCT unnest(roles.permissions || EXCLUDED.permissions))`,
+			name, permissions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to add role %s: %v", name, err)
+		}
+	}
+
+	return &Authorizer{Pool: pool}, nil
+}
+
+// Bind binds role to subject in tenant, or in every tenant if tenant is empty.
+func (a *Authorizer) Bind(ctx context.Context, subject, tenant, role string) error {
+	_, err := a.Pool.Exec(ctx,
+		`INSERT INTO role_bindings (subject, tenant, role) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`,
+		subject, tenant, role)
+	if err != nil {
+		return fmt.Errorf("failed to bind role: %v", err)
+	}
+	return nil
+}
+
+// BindingTenants returns the tenants subject has roles bound in, "" for global bindings.
+func (a *Authorizer) BindingTenants(ctx context.Context, subject string) ([]string, error) {
+	rows, err := a.Pool.Query(ctx, `SELECT DISTINCT tenant FROM role_bindings WHERE subject = $1 ORDER BY tenant`, subject)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get role bindings: %v", err)
+	}
+	defer rows.Close()
+
+	tenants := []string{}
+	for rows.Next() {
+		var tenant string
+		if err := rows.Scan(&tenant); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, tenant)
+	}
+	return tenants, rows.Err()
+}
+
+// Roles returns the roles bound to the caller in tenant, including the global
+// ones if the caller doesn't belong to a tenant.
+func (a *Authorizer) Roles(ctx context.Context, identity *Identity, tenant string) ([]string, error) {
+	rows, err := a.Pool.Query(ctx,
+		`SELECT DISTINCT role FROM role_bindings WHERE subject = $1 AND ((tenant = '' AND $3) OR tenant = $2) ORDER BY role`,
+		identity.Subject, tenant, identity.Tenant == "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get role bindings: %v", err)
+	}
+	defer rows.Close()
+
+	roles := []string{}
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+// Permissions returns the permissions the caller has in tenant. With global set,
+// only bindings that apply to every tenant are considered. Those never apply to
+// callers that belong to a tenant.
+func (a *Authorizer) Permissions(ctx context.Context, identity *Identity, tenant string, global bool) ([]Permission, error) {
+	query := `
+        SELECT DISTINCT unnest(r.permissions) FROM role_bindings b JOIN roles r ON r.name = b.role
+        WHERE b.subject = $1 AND ((b.tenant = '' AND $4) OR (NOT $3 AND b.tenant = $2))
+    `
+	rows, err := a.Pool.Query(ctx, query, identity.Subject, tenant, global, identity.Tenant == "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get permissions: %v", err)
+	}
+	defer rows.Close()
+
+	permissions := []Permission{}
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, Permission(p))
+	}
+	slices.Sort(permissions)
+	return permissions, rows.Err()
+}
+
+// Allowed reports whether the caller has the permission in its own tenant.
+func (a *Authorizer) Allowed(ctx context.Context, identity *Identity, permission Permission) (bool, error) {
+	permissions, err := a.Permissions(ctx, identity, identity.Tenant, false)
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(permissions, permission), nil
+}
+
+// Require wraps a handler so it's only called for callers with the permission.
+// The tenant in the route, if any, is checked instead of the tenant of the caller.
+func (a *Authorizer) Require(permission Permission, next http.HandlerFunc) http.Handler {
+	return a.require(permission, false, next)
+}
+
+// RequireGlobal is like Require, but only bindings that apply to every tenant count.
+func (a *Authorizer) RequireGlobal(permission Permission, next http.HandlerFunc) http.Handler {
+	return a.require(permission, true, next)
+}
+
+func (a *Authorizer) require(permission Permission, global bool, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := IdentityFromContext(r.Context())
+		if identity == nil {
+			unauthorized(w)
+			return
+		}
+
+		tenant := identity.Tenant
+		if routeTenant, ok := mux.Vars(r)["tenant"]; ok {
+			tenant = routeTenant
+		}
+
+		permissions, err := a.Permissions(r.Context(), identity, tenant, global)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !slices.Contains(permissions, permission) {
+			http.Error(w, fmt.Sprintf("permission %s is required", permission), http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	})
+}
@@ -0,0 +1,448 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/SepehrNoey/KaaS/api"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/util/retry"
+)
+
+// AdoptApp brings an existing deployment under the management of KaaS. The
+// deployment has to fit what KaaS builds for an app: a single container without
+// volumes, commands or probes, a service with the name of the deployment and
+// optionally ingress rules, either in the shared ingress or in an ingress with
+// the name of the deployment. The request KaaS would build the app from is
+// derived from the objects, validated and recorded, and then returned with its
+// secret values redacted.
+func (c *ClusterManager) AdoptApp(ctx context.Context, req *api.AdoptRequest) (*api.AppRequest, error) {
+	if req.Environment != "" {
+		if errs := validation.IsValidLabelValue(req.Environment); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid environment %q: %v", req.Environment, errs)
+		}
+	}
+
+	namespace := c.namespace(ctx)
+	deployment, err := c.Clientset.AppsV1().Deployments(namespace).Get(ctx, req.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deployment: %v", err)
+	}
+	if deployment.Labels[managedByLabel] == managedByValue {
+		return nil, fmt.Errorf("deployment %s is already managed by KaaS", req.Name)
+	}
+
+	appreq, err := c.appRequestOf(ctx, deployment)
+	if err != nil {
+		return nil, fmt.Errorf("deployment %s doesn't fit KaaS: %v", req.Name, err)
+	}
+
+	// building the app validates the derived request, including its routes and certificate
+	objs, err := c.buildApp(ctx, appreq, req.Environment, nil)
+	if err != nil {
+		return nil, fmt.Errorf("deployment %s doesn't fit KaaS: %w", req.Name, err)
+	}
+
+	depClient := c.Clientset.AppsV1().Deployments(namespace)
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := depClient.Get(ctx, req.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if current.Labels == nil {
+			current.Labels = map[string]string{}
+		}
+		for key, value := range objs.deployment.Labels {
+			current.Labels[key] = value
+		}
+		if current.Annotations == nil {
+			current.Annotations = map[string]string{}
+		}
+		for key, value := range objs.deployment.Annotations {
+			current.Annotations[key] = value
+		}
+
+		deployment, err = depClient.Update(ctx, current, updateOptions(ctx))
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to label deployment: %v", err)
+	}
+
+	if err := c.adoptServiceAndSecret(ctx, req.Name, len(appreq.Secrets) > 0); err != nil {
+		return nil, err
+	}
+	if objs.ingMode == IngressModeDedicated {
+		if err := c.adoptIngress(ctx, deployment); err != nil {
+			return nil, err
+		}
+	}
+
+	for key := range appreq.Secrets {
+		appreq.Secrets[key] = redactedValue
+	}
+	return appreq, nil
+}
+
+// managedLabels adds the labels of the objects KaaS creates for an app to labels.
+func managedLabels(labels map[string]string, app string) map[string]string {
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels["app"] = app
+	labels[managedByLabel] = managedByValue
+	return labels
+}
+
+// legacyApp reports whether a deployment without the managed-by label was
+// created by a version of KaaS that didn't label apps: its pods are selected by
+// their app and monitor labels, the service with its name selects them by app
+// like KaaS does, and its secrets come from the secret of the app.
+func legacyApp(deployment *appsv1.Deployment, services map[string]*corev1.Service) bool {
+	if _, ok := deployment.Labels[managedByLabel]; ok {
+		return false
+	}
+	selector := deployment.Spec.Selector
+	if selector == nil || selector.MatchLabels["app"] != deployment.Name {
+		return false
+	}
+	if _, ok := selector.MatchLabels["monitor"]; !ok {
+		return false
+	}
+
+	service, ok := services[deployment.Name]
+	if !ok || service.Labels["app"] != deployment.Name || len(service.Spec.Selector) != 1 || service.Spec.Selector["app"] != deployment.Name {
+		return false
+	}
+
+	for _, container := range deployment.Spec.Template.Spec.Containers {
+		for _, env := range container.Env {
+			if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil && env.ValueFrom.SecretKeyRef.Name != deployment.Name+"-secret" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// adoptServiceAndSecret labels the service of the app, and its secret if it
+// has one, like the ones KaaS creates.
+func (c *ClusterManager) adoptServiceAndSecret(ctx context.Context, name string, hasSecret bool) error {
+	namespace := c.namespace(ctx)
+	svcClient := c.Clientset.CoreV1().Services(namespace)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		service, err := svcClient.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		service.Labels = managedLabels(service.Labels, name)
+		_, err = svcClient.Update(ctx, service, updateOptions(ctx))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to label service: %v", err)
+	}
+
+	if !hasSecret {
+		return nil
+	}
+	secretClient := c.Clientset.CoreV1().Secrets(namespace)
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		secret, err := secretClient.Get(ctx, name+"-secret", metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		secret.Labels = managedLabels(secret.Labels, name)
+		_, err = secretClient.Update(ctx, secret, updateOptions(ctx))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to label secret: %v", err)
+	}
+	return nil
+}
+
+// adoptIngress labels the ingress of the app as its dedicated ingress and lets
+// the deployment own it, like the ones KaaS creates.
+func (c *ClusterManager) adoptIngress(ctx context.Context, owner *appsv1.Deployment) error {
+	ingClient := c.Clientset.NetworkingV1().Ingresses(owner.Namespace)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		ingress, err := ingClient.Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		ingress.Labels = managedLabels(ingress.Labels, owner.Name)
+		if metav1.GetControllerOf(ingress) == nil {
+			ingress.OwnerReferences = append(ingress.OwnerReferences,
+				*metav1.NewControllerRef(owner, appsv1.SchemeGroupVersion.WithKind("Deployment")))
+		}
+
+		_, err = ingClient.Update(ctx, ingress, updateOptions(ctx))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to label Ingress resource: %v", err)
+	}
+	return nil
+}
+
+// appRequestOf derives the request KaaS would build the deployment from, or
+// returns why the deployment can't be expressed as one.
+func (c *ClusterManager) appRequestOf(ctx context.Context, deployment *appsv1.Deployment) (*api.AppRequest, error) {
+	name := deployment.Name
+	podSpec := deployment.Spec.Template.Spec
+	if len(podSpec.Containers) != 1 {
+		return nil, fmt.Errorf("it has %d containers, KaaS runs a single one", len(podSpec.Containers))
+	}
+	if len(podSpec.InitContainers) > 0 || len(podSpec.Volumes) > 0 {
+		return nil, fmt.Errorf("it has init containers or volumes")
+	}
+	container := podSpec.Containers[0]
+	if len(container.Command) > 0 || len(container.Args) > 0 || len(container.EnvFrom) > 0 || len(container.VolumeMounts) > 0 {
+		return nil, fmt.Errorf("its container sets a command, arguments, envFrom or volume mounts")
+	}
+	if container.LivenessProbe != nil || container.ReadinessProbe != nil || container.StartupProbe != nil {
+		return nil, fmt.Errorf("its container has probes")
+	}
+	if app, ok := deployment.Spec.Selector.MatchLabels["app"]; ok && app != name {
+		return nil, fmt.Errorf("its selector has app=%s, KaaS selects the pods of an app by its name", app)
+	}
+
+	appreq := &api.AppRequest{
+		Name:     name,
+		Replicas: 1,
+		Monitor:  deployment.Spec.Template.Labels["monitor"] == "true",
+	}
+	if deployment.Spec.Replicas != nil {
+		appreq.Replicas = *deployment.Spec.Replicas
+	}
+
+	if strings.Contains(container.Image, "@") {
+		return nil, fmt.Errorf("its image is pinned by digest")
+	}
+	appreq.Image, appreq.ImageTag = container.Image, "latest"
+	if i := strings.LastIndex(container.Image, ":"); i > strings.LastIndex(container.Image, "/") {
+		appreq.Image, appreq.ImageTag = container.Image[:i], container.Image[i+1:]
+	}
+
+	resources := []string{}
+	for _, resourceName := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory, corev1.ResourceEphemeralStorage} {
+		q, ok := container.Resources.Requests[resourceName]
+		if !ok {
+			q, ok = container.Resources.Limits[resourceName]
+		}
+		if !ok {
+			resources = append(resources, "0")
+			continue
+		}
+		resources = append(resources, q.String())
+	}
+	appreq.Resources = strings.Join(resources, ",")
+
+	if err := c.envOf(ctx, appreq, container.Env); err != nil {
+		return nil, err
+	}
+
+	service, err := c.serviceOf(ctx, deployment)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range service.Spec.Ports {
+		port := api.AppPort{
+			Name:        p.Name,
+			ServicePort: p.Port,
+			Protocol:    string(p.Protocol),
+		}
+		switch {
+		case p.TargetPort.IntVal != 0:
+			port.ContainerPort = p.TargetPort.IntVal
+		case p.TargetPort.StrVal != "":
+			for _, cp := range container.Ports {
+				if cp.Name == p.TargetPort.StrVal {
+					port.ContainerPort = cp.ContainerPort
+				}
+			}
+			if port.ContainerPort == 0 {
+				return nil, fmt.Errorf("service port %d targets unknown container port %s", p.Port, p.TargetPort.StrVal)
+			}
+		default:
+			port.ContainerPort = p.Port
+		}
+		appreq.Ports = append(appreq.Ports, port)
+	}
+
+	if err := c.ingressOf(ctx, appreq); err != nil {
+		return nil, err
+	}
+	if service.Spec.Type == corev1.ServiceTypeNodePort && !appreq.ExternalAccess {
+		return nil, fmt.Errorf("service %s is exposed on node ports without ingress rules", name)
+	}
+	if service.Spec.Type != corev1.ServiceTypeNodePort && service.Spec.Type != corev1.ServiceTypeClusterIP {
+		return nil, fmt.Errorf("service %s is of type %s", name, service.Spec.Type)
+	}
+
+	return appreq, nil
+}
+
+// envOf fills the variables and secrets of the request. Secrets have to come
+// from the secret of the app, under the name of the variable.
+func (c *ClusterManager) envOf(ctx context.Context, appreq *api.AppRequest, env []corev1.EnvVar) error {
+	secretName := appreq.Name + "-secret"
+	var secret *corev1.Secret
+	for _, e := range env {
+		if e.ValueFrom == nil {
+			if appreq.Envs == nil {
+				appreq.Envs = map[string]string{}
+			}
+			appreq.Envs[e.Name] = e.Value
+			continue
+		}
+
+		ref := e.ValueFrom.SecretKeyRef
+		if ref == nil || ref.Name != secretName || ref.Key != e.Name {
+			return fmt.Errorf("variable %s must be a plain value or the key %s of secret %s", e.Name, e.Name, secretName)
+		}
+		if secret == nil {
+			var err error
+			secret, err = c.Clientset.CoreV1().Secrets(c.namespace(ctx)).Get(ctx, secretName, metav1.GetOptions{})
+			if err != nil {
+				return fmt.Errorf("failed to get secret: %v", err)
+			}
+		}
+		value, ok := secret.Data[ref.Key]
+		if !ok {
+			return fmt.Errorf("secret %s has no key %s", secretName, ref.Key)
+		}
+		if appreq.Secrets == nil {
+			appreq.Secrets = map[string]string{}
+		}
+		appreq.Secrets[e.Name] = string(value)
+	}
+	return nil
+}
+
+// serviceOf returns the only service that selects the pods of the deployment,
+// which has to have the name of the deployment.
+func (c *ClusterManager) serviceOf(ctx context.Context, deployment *appsv1.Deployment) (*corev1.Service, error) {
+	services, err := c.Clientset.CoreV1().Services(deployment.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list services: %v", err)
+	}
+
+	podLabels := labels.Set(deployment.Spec.Template.Labels)
+	matching := []corev1.Service{}
+	for _, s := range services.Items {
+		if len(s.Spec.Selector) > 0 && labels.SelectorFromSet(s.Spec.Selector).Matches(podLabels) {
+			matching = append(matching, s)
+		}
+	}
+	if len(matching) != 1 {
+		return nil, fmt.Errorf("%d services select its pods, KaaS expects exactly one", len(matching))
+	}
+	if matching[0].Name != deployment.Name {
+		return nil, fmt.Errorf("its service is named %s, KaaS expects the name of the deployment", matching[0].Name)
+	}
+	return &matching[0], nil
+}
+
+// ingressOf fills the ingress section of the request from the routes to the
+// service of the app, which have to be either in the shared ingress or all in
+// one ingress with the name of the app.
+func (c *ClusterManager) ingressOf(ctx context.Context, appreq *api.AppRequest) error {
+	namespace := c.namespace(ctx)
+	ingresses, err := c.Clientset.NetworkingV1().Ingresses(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list Ingress resources: %v", err)
+	}
+
+	var routed *netv1.Ingress
+	for i := range ingresses.Items {
+		ingress := &ingresses.Items[i]
+		if len(appRules(ingress, appreq.Name)) == 0 {
+			continue
+		}
+		if routed != nil {
+			return fmt.Errorf("both ingress %s and %s route to it", routed.Name, ingress.Name)
+		}
+		routed = ingress
+	}
+	if routed == nil {
+		return nil
+	}
+
+	mode := IngressModeShared
+	if routed.Name != c.AppConf.IngressName {
+		if routed.Name != appreq.Name {
+			return fmt.Errorf("ingress %s routes to it, KaaS expects the ingress of an app to have its name", routed.Name)
+		}
+		if others, _ := withoutPaths(routed.Spec.Rules, func(name string) bool { return name == appreq.Name }); len(others) > 0 {
+			return fmt.Errorf("ingress %s routes to other services too", routed.Name)
+		}
+		mode = IngressModeDedicated
+	}
+
+	rules := appRules(routed, appreq.Name)
+	appIng := &api.AppIngress{Mode: mode, Annotations: map[string]string{}}
+	for _, rule := range rules {
+		r := api.IngressRule{Host: rule.Host}
+		for _, p := range rule.HTTP.Paths {
+			path := api.IngressPath{Path: p.Path, Port: p.Backend.Service.Port.Name}
+			if p.PathType != nil {
+				path.PathType = string(*p.PathType)
+			}
+			if path.Port == "" {
+				path.Port = strconv.FormatInt(int64(p.Backend.Service.Port.Number), 10)
+			}
+			r.Paths = append(r.Paths, path)
+		}
+		appIng.Rules = append(appIng.Rules, r)
+	}
+
+	// the annotations and class of the shared ingress aren't the app's
+	if mode == IngressModeDedicated {
+		if routed.Spec.IngressClassName != nil {
+			appIng.ClassName = *routed.Spec.IngressClassName
+		}
+		for key, value := range routed.Annotations {
+			switch key {
+			case corev1.LastAppliedConfigAnnotation, tlsAppsAnnotation:
+			case rewriteTargetAnnotation:
+				appIng.Rewrite = value
+			default:
+				appIng.Annotations[key] = value
+			}
+		}
+	}
+
+	secrets := []string{}
+	for _, entry := range hostsTLS(routed.Spec.TLS, rules) {
+		if !slices.Contains(secrets, entry.SecretName) {
+			secrets = append(secrets, entry.SecretName)
+		}
+	}
+	if len(secrets) > 1 {
+		return fmt.Errorf("its hosts are served with %d certificates, KaaS uses one per app", len(secrets))
+	}
+	if len(secrets) == 1 {
+		appreq.TLS = &api.AppTLS{SecretName: secrets[0]}
+	}
+
+	appreq.ExternalAccess = true
+	appreq.DomainAddress = rules[0].Host
+	appreq.Ingress = appIng
+	return nil
+}
+
+// appRules returns the rules of the ingress with only their paths to the app.
+func appRules(ingress *netv1.Ingress, name string) []netv1.IngressRule {
+	rules, _ := withoutPaths(ingress.Spec.Rules, func(app string) bool { return app != name })
+	return slices.DeleteFunc(rules, func(rule netv1.IngressRule) bool { return rule.HTTP == nil })
+}
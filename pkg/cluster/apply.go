@@ -0,0 +1,438 @@
+package cluster
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/SepehrNoey/KaaS/api"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	environmentLabel = "kaas.io/environment" // set on the workloads of applied manifests
+	specAnnotation   = "kaas.io/spec"        // request the workload was built from, secrets are hashed
+
+	defaultBindingPrefix = "DB"
+
+	PlanCreate    = "create"
+	PlanUpdate    = "update"
+	PlanDelete    = "delete"
+	PlanUnchanged = "unchanged"
+	PlanKeep      = "keep" // databases missing from a manifest applied without pruning
+
+	kindApp      = "app"
+	kindDatabase = "database"
+)
+
+func workloadLabels(environment string) map[string]string {
+	labels := map[string]string{managedByLabel: managedByValue}
+	if environment != "" {
+		labels[environmentLabel] = environment
+	}
+	return labels
+}
+
+// appSpec encodes the request of an app for the spec annotation, with the values
+// of secrets and the TLS key replaced by their hashes.
+func appSpec(appreq *api.AppRequest) (string, error) {
+	spec := *appreq
+	if len(appreq.Secrets) > 0 {
+		spec.Secrets = map[string]string{}
+		for key, value := range appreq.Secrets {
+			spec.Secrets[key] = hashValue(value)
+		}
+	}
+	if appreq.TLS != nil && appreq.TLS.Key != "" {
+		tls := *appreq.TLS
+		tls.Key = hashValue(tls.Key)
+		spec.TLS = &tls
+	}
+
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode app spec: %v", err)
+	}
+	return string(data), nil
+}
+
+func hashValue(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// bindingEnv returns the variables that pass the bound databases to an app.
+// The engines of databases planned along with the app are looked up in dbEngines.
+func (c *ClusterManager) bindingEnv(ctx context.Context, bindings []api.DBBinding, dbEngines map[string]string) ([]corev1.EnvVar, error) {
+	env := []corev1.EnvVar{}
+	for _, b := range bindings {
+		engineName, ok := dbEngines[b.Database]
+		if !ok {
+			statefulSet, err := c.Clientset.AppsV1().StatefulSets(c.namespace(ctx)).Get(ctx, b.Database, metav1.GetOptions{})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get statefulset: %v", err)
+			}
+			engineName = statefulSet.Labels[engineLabel]
+		}
+		_, conf, err := c.engine(engineName)
+		if err != nil {
+			return nil, err
+		}
+
+		prefix := b.EnvPrefix
+		if prefix == "" {
+			prefix = defaultBindingPrefix
+		}
+		secretRef := func(key string) *corev1.EnvVarSource {
+			return &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: b.Database + "-secret"},
+					Key:                  key,
+				},
+			}
+		}
+		env = append(env,
+			corev1.EnvVar{Name: prefix + "_HOST", Value: b.Database},
+			corev1.EnvVar{Name: prefix + "_PORT", Value: strconv.FormatInt(int64(conf.Port), 10)},
+			corev1.EnvVar{Name: prefix + "_NAME", Value: b.Database},
+			corev1.EnvVar{Name: prefix + "_USER", ValueFrom: secretRef("username")},
+			corev1.EnvVar{Name: prefix + "_PASSWORD", ValueFrom: secretRef("password")},
+		)
+	}
+	return env, nil
+}
+
+// checkBindings verifies that the databases the app binds to exist. Databases
+// planned by a manifest are looked up in planned, with false for deleted ones.
+func (c *ClusterManager) checkBindings(ctx context.Context, appreq *api.AppRequest, planned map[string]bool) error {
+	prefixes := map[string]bool{}
+	for _, b := range appreq.Bindings {
+		if b.Database == "" {
+			return fmt.Errorf("binding of app %s has no database", appreq.Name)
+		}
+		prefix := b.EnvPrefix
+		if prefix == "" {
+			prefix = defaultBindingPrefix
+		}
+		if prefixes[prefix] {
+			return fmt.Errorf("app %s binds several databases with the prefix %s", appreq.Name, prefix)
+		}
+		prefixes[prefix] = true
+
+		if kept, ok := planned[b.Database]; ok {
+			if !kept {
+				return fmt.Errorf("app %s binds to database %s, which is removed from the manifest", appreq.Name, b.Database)
+			}
+			continue
+		}
+		_, err := c.Clientset.AppsV1().StatefulSets(c.namespace(ctx)).Get(ctx, b.Database, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return fmt.Errorf("app %s binds to unknown database %s", appreq.Name, b.Database)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get statefulset: %v", err)
+		}
+	}
+	return nil
+}
+
+// plan holds the steps of a manifest together with what they were planned against.
+type plan struct {
+	environment string
+	steps       []api.PlanStep
+	apps        map[string]*appsv1.Deployment  // existing deployments of the apps in the manifest
+	databases   map[string]*appsv1.StatefulSet // existing statefulsets of the databases in the manifest
+	appObjs     map[string]*appObjects
+	dbObjs      map[string]*dbObjects
+	appRequests map[string]*api.AppRequest
+	dbRequests  map[string]*api.DBRequest
+}
+
+// Apply brings the environment of the manifest to the state it describes.
+// Everything is validated and checked against the quota before the first change,
+// then databases are created and updated before the apps that bind to them,
+// and removed apps are deleted before removed databases. Removed databases are
+// only deleted with prune set, otherwise they're kept. With dryRun set, only
+// the plan is returned. An error is returned if the manifest can't be applied
+// at all; failures while applying are reported in the result.
+func (c *ClusterManager) Apply(ctx context.Context, manifest *api.Manifest, dryRun, prune bool) (*api.ApplyResult, error) {
+	p, err := c.plan(ctx, manifest, prune)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.validatePlan(ctx, p); err != nil {
+		return nil, err
+	}
+
+	result := &api.ApplyResult{Environment: manifest.Environment, DryRun: dryRun, Plan: p.steps}
+	if dryRun {
+		return result, nil
+	}
+
+	// the steps are planned in the order they're applied
+	for i := range result.Plan {
+		step := &result.Plan[i]
+		if step.Action == PlanUnchanged || step.Action == PlanKeep {
+			continue
+		}
+		if result.Error != "" {
+			step.Status = "skipped"
+			continue
+		}
+
+		if err := c.applyStep(ctx, p, step); err != nil {
+			step.Status = "failed"
+			result.Error = fmt.Sprintf("failed to %s %s %s: %v", step.Action, step.Kind, step.Name, err)
+			continue
+		}
+		step.Status = "applied"
+	}
+
+	return result, nil
+}
+
+func (c *ClusterManager) plan(ctx context.Context, manifest *api.Manifest, prune bool) (*plan, error) {
+	env := manifest.Environment
+	if env == "" {
+		return nil, fmt.Errorf("environment is required")
+	}
+	if errs := validation.IsValidLabelValue(env); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid environment %q: %v", env, errs)
+	}
+
+	namespace := c.namespace(ctx)
+	p := &plan{
+		environment: env,
+		steps:       []api.PlanStep{},
+		apps:        map[string]*appsv1.Deployment{},
+		databases:   map[string]*appsv1.StatefulSet{},
+		appObjs:     map[string]*appObjects{},
+		dbObjs:      map[string]*dbObjects{},
+		appRequests: map[string]*api.AppRequest{},
+		dbRequests:  map[string]*api.DBRequest{},
+	}
+
+	for i := range manifest.Databases {
+		dbreq := &manifest.Databases[i]
+		if dbreq.DBName == "" {
+			return nil, fmt.Errorf("every database needs a name")
+		}
+		if _, ok := p.dbRequests[dbreq.DBName]; ok {
+			return nil, fmt.Errorf("database %s is declared twice", dbreq.DBName)
+		}
+		p.dbRequests[dbreq.DBName] = dbreq
+
+		spec, err := json.Marshal(dbreq)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode database spec: %v", err)
+		}
+
+		existing, err := c.Clientset.AppsV1().StatefulSets(namespace).Get(ctx, dbreq.DBName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			if err := c.checkDBName(ctx, dbreq.DBName); err != nil {
+				return nil, err
+			}
+			p.steps = append(p.steps, api.PlanStep{Kind: kindDatabase, Name: dbreq.DBName, Action: PlanCreate})
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get statefulset: %v", err)
+		}
+		if existing.Labels[environmentLabel] != env {
+			return nil, fmt.Errorf("database %s exists and isn't part of environment %s", dbreq.DBName, env)
+		}
+		p.databases[dbreq.DBName] = existing
+		p.steps = append(p.steps, api.PlanStep{Kind: kindDatabase, Name: dbreq.DBName, Action: changeAction(existing.Annotations, string(spec))})
+	}
+
+	for i := range manifest.Apps {
+		appreq := &manifest.Apps[i]
+		if appreq.Name == "" {
+			return nil, fmt.Errorf("every app needs a name")
+		}
+		if _, ok := p.appRequests[appreq.Name]; ok {
+			return nil, fmt.Errorf("app %s is declared twice", appreq.Name)
+		}
+		if _, ok := p.dbRequests[appreq.Name]; ok {
+			return nil, fmt.Errorf("app %s has the name of a database", appreq.Name)
+		}
+		p.appRequests[appreq.Name] = appreq
+
+		spec, err := appSpec(appreq)
+		if err != nil {
+			return nil, err
+		}
+
+		existing, err := c.Clientset.AppsV1().Deployments(namespace).Get(ctx, appreq.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			if err := c.checkAppName(ctx, appreq.Name); err != nil {
+				return nil, err
+			}
+			p.steps = append(p.steps, api.PlanStep{Kind: kindApp, Name: appreq.Name, Action: PlanCreate})
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get deployment: %v", err)
+		}
+		if existing.Labels[environmentLabel] != env {
+			return nil, fmt.Errorf("app %s exists and isn't part of environment %s", appreq.Name, env)
+		}
+		p.apps[appreq.Name] = existing
+		p.steps = append(p.steps, api.PlanStep{Kind: kindApp, Name: appreq.Name, Action: changeAction(existing.Annotations, spec)})
+	}
+
+	// workloads of the environment that were removed from the manifest
+	selector := metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s", environmentLabel, env)}
+	deployments, err := c.Clientset.AppsV1().Deployments(namespace).List(ctx, selector)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list deployments: %v", err)
+	}
+	removed := []string{}
+	for _, d := range deployments.Items {
+		if _, ok := p.appRequests[d.Name]; !ok {
+			removed = append(removed, d.Name)
+		}
+	}
+	sort.Strings(removed)
+	for _, name := range removed {
+		p.steps = append(p.steps, api.PlanStep{Kind: kindApp, Name: name, Action: PlanDelete})
+	}
+
+	statefulSets, err := c.Clientset.AppsV1().StatefulSets(namespace).List(ctx, selector)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list statefulsets: %v", err)
+	}
+	removed = []string{}
+	for _, s := range statefulSets.Items {
+		if _, ok := p.dbRequests[s.Name]; !ok {
+			removed = append(removed, s.Name)
+		}
+	}
+	sort.Strings(removed)
+	action := PlanKeep
+	if prune {
+		action = PlanDelete
+	}
+	for _, name := range removed {
+		p.steps = append(p.steps, api.PlanStep{Kind: kindDatabase, Name: name, Action: action})
+	}
+
+	return p, nil
+}
+
+func changeAction(annotations map[string]string, spec string) string {
+	if annotations[specAnnotation] == spec {
+		return PlanUnchanged
+	}
+	return PlanUpdate
+}
+
+// validatePlan builds the objects of every created and updated workload, which
+// validates them, and checks what they add to the namespace against the quota.
+func (c *ClusterManager) validatePlan(ctx context.Context, p *plan) error {
+	requested := corev1.ResourceList{}
+	routes := map[string]string{} // host and path to the app of the manifest routing them
+
+	// bindings of unchanged apps are checked too, their database may be removed
+	planned := map[string]bool{}
+	dbEngines := map[string]string{}
+	for _, step := range p.steps {
+		if step.Kind != kindDatabase {
+			continue
+		}
+		planned[step.Name] = step.Action != PlanDelete
+		if dbreq, ok := p.dbRequests[step.Name]; ok {
+			dbEngines[step.Name] = dbreq.Engine
+		}
+	}
+	for _, step := range p.steps {
+		if step.Kind != kindApp || step.Action == PlanDelete {
+			continue
+		}
+		if err := c.checkBindings(ctx, p.appRequests[step.Name], planned); err != nil {
+			return err
+		}
+	}
+
+	for _, step := range p.steps {
+		if step.Action != PlanCreate && step.Action != PlanUpdate {
+			continue
+		}
+		switch step.Kind {
+		case kindDatabase:
+			objs, err := c.buildDB(ctx, p.dbRequests[step.Name], p.environment)
+			if err != nil {
+				return fmt.Errorf("database %s: %w", step.Name, err)
+			}
+			addResources(requested, objs.usage)
+			if existing := p.databases[step.Name]; existing != nil {
+				if err := checkDBUpdate(existing, objs); err != nil {
+					return err
+				}
+				subtractResources(requested, statefulSetUsage(existing))
+				pooler, err := c.poolerUsage(ctx, step.Name)
+				if err != nil {
+					return err
+				}
+				subtractResources(requested, pooler)
+			} else if objs.restore, err = c.buildDBRestore(ctx, p.dbRequests[step.Name]); err != nil {
+				return fmt.Errorf("database %s: %w", step.Name, err)
+			}
+			p.dbObjs[step.Name] = objs
+
+		case kindApp:
+			appreq := p.appRequests[step.Name]
+			objs, err := c.buildApp(ctx, appreq, p.environment, dbEngines)
+			if err != nil {
+				return fmt.Errorf("app %s: %w", step.Name, err)
+			}
+			addResources(requested, objs.usage)
+			if existing := p.apps[step.Name]; existing != nil {
+				subtractResources(requested, deploymentUsage(existing))
+			}
+			p.appObjs[step.Name] = objs
+
+			// routes are only checked against the cluster, so apps of the manifest are checked against each other
+			if objs.routing != nil {
+				for _, rule := range objs.routing.rules {
+					for _, path := range rule.HTTP.Paths {
+						if owner, ok := routes[rule.Host+path.Path]; ok {
+							return &ConflictError{Host: rule.Host, Path: path.Path, App: owner}
+						}
+						routes[rule.Host+path.Path] = step.Name
+					}
+				}
+			}
+		}
+	}
+
+	return c.checkQuota(ctx, requested)
+}
+
+func (c *ClusterManager) applyStep(ctx context.Context, p *plan, step *api.PlanStep) error {
+	switch {
+	case step.Kind == kindDatabase && step.Action == PlanCreate:
+		_, err := c.createDB(ctx, p.dbRequests[step.Name], p.dbObjs[step.Name])
+		return err
+	case step.Kind == kindDatabase && step.Action == PlanUpdate:
+		return c.updateDB(ctx, p.dbRequests[step.Name], p.dbObjs[step.Name])
+	case step.Kind == kindDatabase && step.Action == PlanDelete:
+		return c.deleteDB(ctx, step.Name)
+	case step.Kind == kindApp && step.Action == PlanCreate:
+		return c.createApp(ctx, p.appRequests[step.Name], p.appObjs[step.Name])
+	case step.Kind == kindApp && step.Action == PlanUpdate:
+		return c.updateApp(ctx, p.appRequests[step.Name], p.appObjs[step.Name])
+	case step.Kind == kindApp && step.Action == PlanDelete:
+		return c.deleteApp(ctx, step.Name)
+	default:
+		return fmt.Errorf("unsupported step")
+	}
+}
@@ -0,0 +1,440 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SepehrNoey/KaaS/api"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	BackupTargetPVC = "pvc"
+	BackupTargetS3  = "s3"
+
+	// statuses of backups and restores
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+
+	// backupLabel holds the database of backup jobs and volumes. Backup pods
+	// don't get the app label, so the service of the database doesn't select them.
+	backupLabel            = "kaas.io/backup"
+	defaultBackupRetention = 7
+	backupMountPath        = "/backups"
+)
+
+// dumpScript dumps the database into $BACKUP_DIR, keeps the last $RETENTION
+// dumps, and reports where the dump is and its size in the termination message.
+const dumpScript = `set -e
+file="$BACKUP_DIR/$BACKUP_NAME.dump"
+if ! pg_dump -Fc -f "$file"; then rm -f "$file"; exit 1; fi
+size=$(wc -c < "$file")
+ls -1 "$BACKUP_DIR" | grep '\.dump$' | sort -r | tail -n +$((RETENTION + 1)) | while read -r old; do rm -f "$BACKUP_DIR/$old"; done
+printf '{"location":"%s","size":%s}' "$file" "$size" > /dev/termination-log
+`
+
+// uploadScript uploads the dump to S3 and keeps the last $RETENTION dumps there.
+const uploadScript = `set -e
+mc alias set backup "$S3_ENDPOINT" "$S3_ACCESS_KEY" "$S3_SECRET_KEY" > /dev/null
+target="backup/$S3_BUCKET/$S3_PREFIX"
+mc cp "$BACKUP_DIR/$BACKUP_NAME.dump" "$target/$BACKUP_NAME.dump" > /dev/null
+size=$(wc -c < "$BACKUP_DIR/$BACKUP_NAME.dump")
+mc find "$target" --name '*.dump' | sort -r | tail -n +$((RETENTION + 1)) | while read -r old; do mc rm "$old" > /dev/null; done
+printf '{"location":"s3://%s/%s/%s.dump","size":%s}' "$S3_BUCKET" "$S3_PREFIX" "$BACKUP_NAME" "$size" > /dev/termination-log
+`
+
+// buildBackup builds the cronjob that backs up the database, and for the pvc
+// target the volume the dumps are kept on.
+func (c *ClusterManager) buildBackup(ctx context.Context, dbreq *api.DBRequest, disk resource.Quantity, environment string) (*batchv1.CronJob, *corev1.PersistentVolumeClaim, error) {
+	backup := dbreq.Backup
+	if dbreq.Engine != "" && dbreq.Engine != EnginePostgres {
+		return nil, nil, fmt.Errorf("backups are only supported for %s databases", EnginePostgres)
+	}
+	_, pg, err := c.engine(EnginePostgres)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkSchedule(backup.Schedule); err != nil {
+		return nil, nil, err
+	}
+	if backup.Retention < 0 {
+		return nil, nil, fmt.Errorf("backup retention can't be negative")
+	}
+	retention := backup.Retention
+	if retention == 0 {
+		retention = defaultBackupRetention
+	}
+
+	namespace := c.namespace(ctx)
+	name := dbreq.DBName + "-backup"
+	podLabels := map[string]string{backupLabel: dbreq.DBName, managedByLabel: managedByValue}
+
+	pgEnv := pgEnv(dbreq.DBName, pg.Port)
+	dump := corev1.Container{
+		Name:                     "pg-dump",
+		Image:                    pg.Image.Repository,
+		ImagePullPolicy:          pg.Image.PullPolicy,
+		Command:                  []string{"/bin/sh", "-c", dumpScript},
+		Env:                      append(pgEnv, backupEnv(retention)...),
+		VolumeMounts:             []corev1.VolumeMount{{Name: "backups", MountPath: backupMountPath}},
+		TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+	}
+
+	podSpec := corev1.PodSpec{RestartPolicy: corev1.RestartPolicyNever}
+	var volume *corev1.PersistentVolumeClaim
+	switch backup.Target {
+	case "", BackupTargetPVC:
+		size := disk
+		if backup.Size != "" {
+			size, err = resource.ParseQuantity(backup.Size)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid backup size %q: %v", backup.Size, err)
+			}
+		}
+		if size.IsZero() {
+			return nil, nil, fmt.Errorf("backup size is required for databases without a volume size")
+		}
+		volume = &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+				Labels:    map[string]string{backupLabel: dbreq.DBName, managedByLabel: managedByValue},
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteMany},
+				Resources: corev1.VolumeResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceStorage: size},
+				},
+			},
+		}
+		podSpec.Containers = []corev1.Container{dump}
+		podSpec.Volumes = []corev1.Volume{{
+			Name: "backups",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: name},
+			},
+		}}
+
+	case BackupTargetS3:
+		s3 := backup.S3
+		if s3 == nil || s3.Endpoint == "" || s3.Bucket == "" || s3.SecretName == "" {
+			return nil, nil, fmt.Errorf("the s3 backup target requires an endpoint, bucket and secret name")
+		}
+		if c.DBConf.BackupImage == "" {
+			return nil, nil, fmt.Errorf("the s3 backup target requires backup.image in db-request-config")
+		}
+		// the dump is taken into an empty dir, so only the last one is kept there
+		dump.Env = append(pgEnv, backupEnv(1)...)
+		upload := corev1.Container{
+			Name:    "upload",
+			Image:   c.DBConf.BackupImage,
+			Command: []string{"/bin/sh", "-c", uploadScript},
+			Env: append([]corev1.EnvVar{
+				{Name: "S3_ENDPOINT", Value: s3.Endpoint},
+				{Name: "S3_BUCKET", Value: s3.Bucket},
+				{Name: "S3_PREFIX", Value: namespace + "/" + dbreq.DBName},
+				secretEnv("S3_ACCESS_KEY", s3.SecretName, "access_key"),
+				secretEnv("S3_SECRET_KEY", s3.SecretName, "secret_key"),
+				{Name: "MC_CONFIG_DIR", Value: "/tmp/.mc"},
+			}, backupEnv(retention)...),
+			VolumeMounts:             []corev1.VolumeMount{{Name: "backups", MountPath: backupMountPath}},
+			TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+		}
+		podSpec.InitContainers = []corev1.Container{dump}
+		podSpec.Containers = []corev1.Container{upload}
+		podSpec.Volumes = []corev1.Volume{{
+			Name:         "backups",
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		}}
+
+	default:
+		return nil, nil, fmt.Errorf("unknown backup target %q, expected %s or %s", backup.Target, BackupTargetPVC, BackupTargetS3)
+	}
+
+	backoffLimit := int32(2)
+	failedHistory := int32(3)
+	cronJob := &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    map[string]string{backupLabel: dbreq.DBName, managedByLabel: managedByValue},
+		},
+		Spec: batchv1.CronJobSpec{
+			Schedule:          backup.Schedule,
+			ConcurrencyPolicy: batchv1.ForbidConcurrent,
+			// the jobs of kept dumps are kept too, so they can be listed
+			SuccessfulJobsHistoryLimit: &retention,
+			FailedJobsHistoryLimit:     &failedHistory,
+			JobTemplate: batchv1.JobTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: podLabels},
+				Spec: batchv1.JobSpec{
+					BackoffLimit: &backoffLimit,
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{Labels: podLabels},
+						Spec:       podSpec,
+					},
+				},
+			},
+		},
+	}
+	if environment != "" {
+		cronJob.Labels[environmentLabel] = environment
+	}
+
+	return cronJob, volume, nil
+}
+
+// checkSchedule rejects schedules that aren't a macro or five cron fields. The
+// fields themselves are validated by Kubernetes.
+func checkSchedule(schedule string) error {
+	if strings.HasPrefix(schedule, "@") || len(strings.Fields(schedule)) == 5 {
+		return nil
+	}
+	return fmt.Errorf("invalid backup schedule %q, expected five cron fields", schedule)
+}
+
+// pgEnv returns the libpq variables that connect to a database with its credentials.
+func pgEnv(name string, port int32) []corev1.EnvVar {
+	return []corev1.EnvVar{
+		{Name: "PGHOST", Value: name},
+		{Name: "PGPORT", Value: strconv.FormatInt(int64(port), 10)},
+		{Name: "PGDATABASE", Value: name},
+		secretEnv("PGUSER", name+"-secret", "username"),
+		secretEnv("PGPASSWORD", name+"-secret", "password"),
+	}
+}
+
+// backupEnv returns the variables the backup scripts share. Dumps are named
+// after the job that takes them.
+func backupEnv(retention int32) []corev1.EnvVar {
+	return []corev1.EnvVar{
+		{Name: "BACKUP_DIR", Value: backupMountPath},
+		{
+			Name: "BACKUP_NAME",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.labels['" + batchv1.JobNameLabel + "']"},
+			},
+		},
+		{Name: "RETENTION", Value: strconv.FormatInt(int64(retention), 10)},
+	}
+}
+
+func secretEnv(name, secretName, key string) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: name,
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: secretName},
+				Key:                  key,
+			},
+		},
+	}
+}
+
+// applyBackup creates or updates the backup cronjob of a database, or deletes
+// it if the database isn't backed up anymore. Backup volumes are created if
+// missing, and are never deleted or resized, so the dumps outlive the database.
+func (c *ClusterManager) applyBackup(ctx context.Context, name string, objs *dbObjects) error {
+	namespace := c.namespace(ctx)
+	cronClient := c.Clientset.BatchV1().CronJobs(namespace)
+
+	if objs.backup == nil {
+		return c.deleteBackup(ctx, name)
+	}
+
+	if objs.backupVolume != nil {
+		pvcClient := c.Clientset.CoreV1().PersistentVolumeClaims(namespace)
+		volume, err := pvcClient.Create(ctx, objs.backupVolume, createOptions(ctx))
+		if err == nil {
+			created(ctx, volume)
+		} else if !apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("failed to create backup volume: %v", err)
+		}
+	}
+
+	cronJob, err := cronClient.Create(ctx, objs.backup, createOptions(ctx))
+	if err == nil {
+		created(ctx, cronJob)
+		return nil
+	}
+	if !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create backup cronjob: %v", err)
+	}
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := cronClient.Get(ctx, objs.backup.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		current.Labels = objs.backup.Labels
+		current.Spec = objs.backup.Spec
+		cronJob, err := cronClient.Update(ctx, current, updateOptions(ctx))
+		if err != nil {
+			return err
+		}
+		updated(ctx, cronJob)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update backup cronjob: %v", err)
+	}
+	return nil
+}
+
+// deleteBackup deletes the backup cronjob of a database with its jobs. The
+// dumps are kept.
+func (c *ClusterManager) deleteBackup(ctx context.Context, name string) error {
+	options := deleteOptions(ctx)
+	propagation := metav1.DeletePropagationBackground
+	options.PropagationPolicy = &propagation
+	err := c.Clientset.BatchV1().CronJobs(c.namespace(ctx)).Delete(ctx, name+"-backup", options)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete backup cronjob: %v", err)
+	}
+	return nil
+}
+
+// ListBackups returns the backups of a database that still have a job, newest
+// first. Sizes and locations are read from the termination message of the pods.
+func (c *ClusterManager) ListBackups(ctx context.Context, name string) ([]api.Backup, error) {
+	namespace := c.namespace(ctx)
+	if _, err := c.Clientset.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{}); err != nil {
+		return nil, fmt.Errorf("failed to get database: %v", err)
+	}
+
+	selector := metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s", backupLabel, name)}
+	jobs, err := c.Clientset.BatchV1().Jobs(namespace).List(ctx, selector)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backup jobs: %v", err)
+	}
+	pods, err := c.Clientset.CoreV1().Pods(namespace).List(ctx, selector)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backup pods: %v", err)
+	}
+
+	lastPods := lastJobPods(pods.Items)
+	backups := []api.Backup{}
+	for i := range jobs.Items {
+		backups = append(backups, backupOf(&jobs.Items[i], lastPods[jobs.Items[i].Name]))
+	}
+
+	sort.Slice(backups, func(i, j int) bool { return backups[i].StartTime.After(backups[j].StartTime) })
+	return backups, nil
+}
+
+// getBackup returns the job of a backup with the backup it took.
+func (c *ClusterManager) getBackup(ctx context.Context, id string) (*batchv1.Job, *api.Backup, error) {
+	namespace := c.namespace(ctx)
+	job, err := c.Clientset.BatchV1().Jobs(namespace).Get(ctx, id, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) || (err == nil && job.Labels[backupLabel] == "") {
+		return nil, nil, fmt.Errorf("backup %s not found", id)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get backup job: %v", err)
+	}
+
+	pods, err := c.Clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", batchv1.JobNameLabel, id),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list backup pods: %v", err)
+	}
+
+	backup := backupOf(job, lastJobPods(pods.Items)[id])
+	return job, &backup, nil
+}
+
+// backupOf returns the backup taken by a job. The size and location are read
+// from the termination message of its last pod.
+func backupOf(job *batchv1.Job, pod *corev1.Pod) api.Backup {
+	progress := progressOf(job, pod)
+	backup := api.Backup{
+		Name:           job.Name,
+		Status:         progress.status,
+		StartTime:      progress.start,
+		CompletionTime: progress.completion,
+		Message:        progress.message,
+	}
+
+	var result struct {
+		Location string `json:"location"`
+		Size     int64  `json:"size"`
+	}
+	if backup.Status == StatusSucceeded && pod != nil && json.Unmarshal([]byte(terminationMessage(pod)), &result) == nil {
+		backup.Location, backup.Size = result.Location, result.Size
+	}
+	return backup
+}
+
+// jobProgress is the status of a job, when it ran, and why it failed.
+type jobProgress struct {
+	status     string
+	start      time.Time
+	completion *time.Time
+	message    string
+}
+
+// progressOf returns the progress of a job. Failures are explained by the
+// termination message of its last pod, which falls back to the logs.
+func progressOf(job *batchv1.Job, pod *corev1.Pod) jobProgress {
+	progress := jobProgress{status: StatusRunning, start: job.CreationTimestamp.Time}
+	if job.Status.StartTime != nil {
+		progress.start = job.Status.StartTime.Time
+	}
+	if job.Status.CompletionTime != nil {
+		completion := job.Status.CompletionTime.Time
+		progress.completion = &completion
+	}
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == batchv1.JobFailed && condition.Status == corev1.ConditionTrue {
+			progress.status = StatusFailed
+			progress.message = condition.Message
+		}
+	}
+	if job.Status.Succeeded > 0 {
+		progress.status = StatusSucceeded
+	}
+
+	if progress.status == StatusFailed && pod != nil {
+		if message := terminationMessage(pod); message != "" {
+			progress.message = message
+		}
+	}
+	return progress
+}
+
+// lastJobPods returns the last pod of every job, which decides its outcome.
+func lastJobPods(pods []corev1.Pod) map[string]*corev1.Pod {
+	lastPods := map[string]*corev1.Pod{}
+	for i := range pods {
+		pod := &pods[i]
+		jobName := pod.Labels[batchv1.JobNameLabel]
+		if last, ok := lastPods[jobName]; !ok || last.CreationTimestamp.Before(&pod.CreationTimestamp) {
+			lastPods[jobName] = pod
+		}
+	}
+	return lastPods
+}
+
+// terminationMessage returns the message of the last terminated container of
+// the pod, checking the main containers before the init containers.
+func terminationMessage(pod *corev1.Pod) string {
+	statuses := append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	for i := len(statuses) - 1; i >= 0; i-- {
+		if terminated := statuses[i].State.Terminated; terminated != nil && terminated.Message != "" {
+			return strings.TrimSpace(terminated.Message)
+		}
+	}
+	return ""
+}
@@ -2,17 +2,19 @@ package cluster
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"math/rand"
-	"os"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/SepehrNoey/KaaS/api"
+	"github.com/SepehrNoey/KaaS/pkg/database"
 	"github.com/jackc/pgx/v5"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
-	netv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
@@ -20,9 +22,20 @@ import (
 	"k8s.io/client-go/rest"
 )
 
+const (
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedByValue = "kaas"
+
+	// databaseLabel holds the database of a credentials secret, which is kept
+	// with the volumes of the database after it's deleted
+	databaseLabel = "kaas.io/database"
+)
+
 type AppCnfMap struct {
-	IngressName string
-	Namespace   string
+	IngressName      string
+	IngressMode      string
+	IngressClassName string
+	Namespace        string
 }
 
 type DBCnfMap struct {
@@ -31,6 +44,11 @@ type DBCnfMap struct {
 	Port    int32
 	PVCSize string
 	Image   Image
+
+	BackupImage string // image with a shell and the MinIO client, used by the s3 backup target
+	PoolerImage string // image with a shell and PgBouncer, used by pooled databases
+	Engines     map[string]EngineConf
+	External    ExternalAccessConf
 }
 
 type Image struct {
@@ -39,9 +57,13 @@ type Image struct {
 }
 
 type ClusterManager struct {
-	Clientset *kubernetes.Clientset
-	AppConf   AppCnfMap
-	DBConf    DBCnfMap
+	Clientset  kubernetes.Interface
+	AppConf    AppCnfMap
+	DBConf     DBCnfMap
+	TenantConf TenantCnf
+
+	ingressMu sync.Mutex // serializes updates of the shared ingress within this process
+	tenants   sync.Map   // tenants whose namespace is known to exist
 }
 
 func NewClusterManager() (*ClusterManager, error) {
@@ -72,9 +94,12 @@ func NewClusterManager() (*ClusterManager, error) {
 	return &ClusterManager{
 		Clientset: clientset,
 		AppConf: AppCnfMap{
-			IngressName: appConf.Data["ingress.name"],
-			Namespace:   appConf.Data["namespace"],
+			IngressName:      appConf.Data["ingress.name"],
+			IngressMode:      appConf.Data["ingress.mode"],
+			IngressClassName: appConf.Data["ingress.className"],
+			Namespace:        appConf.Data["namespace"],
 		},
+		TenantConf: parseTenantConf(appConf.Data),
 		DBConf: DBCnfMap{
 			Replica: parseInt32(dbConf.Data["replica"]),
 			MaxConn: parseInt32(dbConf.Data["maxConnections"]),
@@ -84,16 +109,16 @@ func NewClusterManager() (*ClusterManager, error) {
 				Repository: dbConf.Data["image.repository"],
 				PullPolicy: corev1.PullPolicy(dbConf.Data["image.pullPolicy"]),
 			},
+			BackupImage: dbConf.Data["backup.image"],
+			PoolerImage: dbConf.Data["pooler.image"],
+			Engines:     parseEngines(dbConf.Data),
+			External:    parseExternalAccess(dbConf.Data),
 		},
 	}, nil
 }
 
 func createHistoryTables(ctx context.Context) error {
-	masterHost := os.Getenv("POSTGRESQL_MASTER_HOST")
-	pass := os.Getenv("POSTGRESQL_PASSWORD")
-	masterURL := fmt.Sprintf("postgres://postgres:%s@%s:5432/postgres?sslmode=disable", pass, masterHost)
-
-	master, err := pgx.Connect(context.Background(), masterURL)
+	master, err := pgx.Connect(context.Background(), database.URL())
 	if err != nil {
 		return err
 	}
@@ -129,33 +154,90 @@ func createHistoryTables(ctx context.Context) error {
 	return err
 }
 
-func (c *ClusterManager) DeployApp(ctx context.Context, appreq *api.AppRequest) error {
-	namespace := c.AppConf.Namespace
+// appObjects are the objects that make up an app, built from its request.
+type appObjects struct {
+	secret     *corev1.Secret // nil if the app has no secrets
+	deployment *appsv1.Deployment
+	service    *corev1.Service
+	tlsSecret  *corev1.Secret // nil unless the certificate is uploaded as PEM
+	routing    *appRouting    // nil without external access
+	ingMode    string
+	usage      corev1.ResourceList // what the app counts against the quota
+}
 
-	if exists, err := c.resourceExists("deployment", appreq.Name); exists {
+func (c *ClusterManager) DeployApp(ctx context.Context, appreq *api.AppRequest) error {
+	if exists, err := c.resourceExists(ctx, "deployment", appreq.Name); exists {
 		return fmt.Errorf("deployment with this name exists: %v", err)
 	}
+	if err := c.checkAppName(ctx, appreq.Name); err != nil {
+		return err
+	}
+	if err := c.checkBindings(ctx, appreq, nil); err != nil {
+		return err
+	}
 
-	parts := strings.Split(appreq.Resources, ",")
-	if len(parts) != 3 {
-		return fmt.Errorf("expected 3 parts for resources, got %d", len(parts))
+	objs, err := c.buildApp(ctx, appreq, "", nil)
+	if err != nil {
+		return err
+	}
+	if err := c.checkQuota(ctx, objs.usage); err != nil {
+		return err
+	}
+
+	return c.createApp(ctx, appreq, objs)
+}
+
+// buildApp validates the request and builds the objects of the app, without
+// creating anything. Apps applied as part of an environment are labeled with it,
+// and the engines of the databases planned with them are given in dbEngines.
+func (c *ClusterManager) buildApp(ctx context.Context, appreq *api.AppRequest, environment string, dbEngines map[string]string) (*appObjects, error) {
+	namespace := c.namespace(ctx)
+
+	if appreq.Replicas < 0 {
+		return nil, fmt.Errorf("replicas can't be negative, got %d", appreq.Replicas)
+	}
+	cpu, mem, disk, err := parseResources(appreq.Resources)
+	if err != nil {
+		return nil, err
+	}
+
+	ports, err := appPorts(appreq)
+	if err != nil {
+		return nil, err
+	}
+
+	if appreq.TLS != nil && !appreq.ExternalAccess {
+		return nil, fmt.Errorf("tls requires external access")
+	}
+
+	objs := &appObjects{}
+	if appreq.ExternalAccess {
+		objs.ingMode, err = c.ingressMode(appreq)
+		if err != nil {
+			return nil, err
+		}
+		objs.routing, objs.tlsSecret, err = c.buildRouting(ctx, appreq, ports, objs.ingMode)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.checkIngress(ctx, appreq.Name, objs.routing); err != nil {
+			return nil, err
+		}
 	}
 
-	cpu := parts[0]
-	mem := parts[1]
-	disk := parts[2]
 	resReqs := corev1.ResourceRequirements{
 		Requests: corev1.ResourceList{
-			corev1.ResourceCPU:              resource.MustParse(cpu),
-			corev1.ResourceMemory:           resource.MustParse(mem),
-			corev1.ResourceEphemeralStorage: resource.MustParse(disk),
+			corev1.ResourceCPU:              cpu,
+			corev1.ResourceMemory:           mem,
+			corev1.ResourceEphemeralStorage: disk,
 		},
 		Limits: corev1.ResourceList{
-			corev1.ResourceCPU:              resource.MustParse(cpu),
-			corev1.ResourceMemory:           resource.MustParse(mem),
-			corev1.ResourceEphemeralStorage: resource.MustParse(disk),
+			corev1.ResourceCPU:              cpu,
+			corev1.ResourceMemory:           mem,
+			corev1.ResourceEphemeralStorage: disk,
 		},
 	}
+	objs.usage = workloadUsage(appreq.Replicas, resReqs.Requests, resource.Quantity{})
 
 	env := []corev1.EnvVar{}
 	for key, value := range appreq.Envs {
@@ -173,19 +255,15 @@ func (c *ClusterManager) DeployApp(ctx context.Context, appreq *api.AppRequest)
 			secretData[key] = value
 		}
 
-		secret := &corev1.Secret{
+		objs.secret = &corev1.Secret{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      secretName,
 				Namespace: namespace,
+				Labels:    managedLabels(nil, appreq.Name),
 			},
 			StringData: secretData,
 		}
 
-		_, err := c.Clientset.CoreV1().Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{})
-		if err != nil {
-			return fmt.Errorf("failed to create secret: %v", err)
-		}
-
 		for key := range appreq.Secrets {
 			env = append(env, corev1.EnvVar{
 				Name: key,
@@ -201,10 +279,23 @@ func (c *ClusterManager) DeployApp(ctx context.Context, appreq *api.AppRequest)
 		}
 	}
 
-	deployment := &appsv1.Deployment{
+	bound, err := c.bindingEnv(ctx, appreq.Bindings, dbEngines)
+	if err != nil {
+		return nil, err
+	}
+	env = append(env, bound...)
+
+	spec, err := appSpec(appreq)
+	if err != nil {
+		return nil, err
+	}
+
+	objs.deployment = &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      appreq.Name,
-			Namespace: namespace,
+			Name:        appreq.Name,
+			Namespace:   namespace,
+			Labels:      workloadLabels(environment),
+			Annotations: map[string]string{specAnnotation: spec},
 		},
 		Spec: appsv1.DeploymentSpec{
 			Selector: &metav1.LabelSelector{
@@ -227,13 +318,9 @@ func (c *ClusterManager) DeployApp(ctx context.Context, appreq *api.AppRequest)
 							Name:            appreq.Name,
 							Image:           appreq.Image + ":" + appreq.ImageTag,
 							ImagePullPolicy: corev1.PullIfNotPresent,
-							Ports: []corev1.ContainerPort{
-								{
-									ContainerPort: appreq.Port,
-								},
-							},
-							Resources: resReqs,
-							Env:       env,
+							Ports:           containerPorts(ports),
+							Resources:       resReqs,
+							Env:             env,
 						},
 					},
 				},
@@ -241,9 +328,8 @@ func (c *ClusterManager) DeployApp(ctx context.Context, appreq *api.AppRequest)
 		},
 	}
 
-	_, err := c.Clientset.AppsV1().Deployments(namespace).Create(ctx, deployment, metav1.CreateOptions{})
-	if err != nil {
-		return fmt.Errorf("failed to create deployment: %v", err)
+	if objs.routing != nil && len(objs.routing.tls) > 0 {
+		objs.deployment.Annotations[tlsSecretAnnotation] = objs.routing.tls[0].SecretName
 	}
 
 	serviceType := corev1.ServiceTypeClusterIP
@@ -251,35 +337,66 @@ func (c *ClusterManager) DeployApp(ctx context.Context, appreq *api.AppRequest)
 		serviceType = corev1.ServiceTypeNodePort
 	}
 
-	service := &corev1.Service{
+	objs.service = &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      appreq.Name,
 			Namespace: namespace,
 			Labels: map[string]string{
-				"app":     appreq.Name,
-				"monitor": strconv.FormatBool(appreq.Monitor),
+				"app":          appreq.Name,
+				"monitor":      strconv.FormatBool(appreq.Monitor),
+				managedByLabel: managedByValue,
 			},
 		},
 		Spec: corev1.ServiceSpec{
 			Selector: map[string]string{
 				"app": appreq.Name,
 			},
-			Ports: []corev1.ServicePort{
-				{
-					Port: appreq.Port,
-				},
-			},
-			Type: serviceType,
+			Ports: servicePorts(ports),
+			Type:  serviceType,
 		},
 	}
 
-	_, err = c.Clientset.CoreV1().Services(namespace).Create(ctx, service, metav1.CreateOptions{})
+	return objs, nil
+}
+
+func (c *ClusterManager) createApp(ctx context.Context, appreq *api.AppRequest, objs *appObjects) error {
+	namespace := c.namespace(ctx)
+
+	if objs.secret != nil {
+		secret, err := c.Clientset.CoreV1().Secrets(namespace).Create(ctx, objs.secret, createOptions(ctx))
+		if err != nil {
+			return fmt.Errorf("failed to create secret: %v", err)
+		}
+		created(ctx, secret)
+	}
+
+	deployment, err := c.Clientset.AppsV1().Deployments(namespace).Create(ctx, objs.deployment, createOptions(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to create deployment: %v", err)
+	}
+	created(ctx, deployment)
+
+	service, err := c.Clientset.CoreV1().Services(namespace).Create(ctx, objs.service, createOptions(ctx))
 	if err != nil {
 		return fmt.Errorf("failed to create service: %v", err)
 	}
+	created(ctx, service)
+
+	if objs.tlsSecret != nil {
+		tlsSecret, err := c.Clientset.CoreV1().Secrets(namespace).Create(ctx, objs.tlsSecret, createOptions(ctx))
+		if err != nil {
+			return fmt.Errorf("failed to create TLS secret: %v", err)
+		}
+		created(ctx, tlsSecret)
+	}
 
 	if appreq.ExternalAccess {
-		if err := c.updateIngress(ctx, appreq); err != nil {
+		if objs.ingMode == IngressModeDedicated {
+			err = c.createAppIngress(ctx, appreq, deployment, objs.routing)
+		} else {
+			err = c.updateIngress(ctx, appreq.Name, objs.routing)
+		}
+		if err != nil {
 			return err
 		}
 	}
@@ -288,7 +405,7 @@ func (c *ClusterManager) DeployApp(ctx context.Context, appreq *api.AppRequest)
 }
 
 func (c *ClusterManager) GetAppStatus(ctx context.Context, name string) (api.AppStatus, error) {
-	namespace := c.AppConf.Namespace
+	namespace := c.namespace(ctx)
 	deployment, err := c.Clientset.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
 	if err != nil {
 		return api.AppStatus{}, fmt.Errorf("failed to get deployment: %v", err)
@@ -312,24 +429,41 @@ func (c *ClusterManager) GetAppStatus(ctx context.Context, name string) (api.App
 		})
 	}
 
-	return api.AppStatus{
+	status := api.AppStatus{
 		DeploymentName: deployment.Name,
 		Namespace:      deployment.Namespace,
 		Replicas:       *deployment.Spec.Replicas,
 		ReadyReplicas:  deployment.Status.ReadyReplicas,
 		PodStatuses:    podStatuses,
-	}, nil
+	}
+	if secretName, ok := deployment.Annotations[tlsSecretAnnotation]; ok {
+		status.TLS = c.tlsStatus(ctx, secretName)
+	}
+
+	return status, nil
 }
 
 func (c *ClusterManager) GetAllAppsStatus(ctx context.Context) ([]api.AppStatus, error) {
-	namespace := c.AppConf.Namespace
+	namespace := c.namespace(ctx)
 	deployments, err := c.Clientset.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{})
 	if err != nil {
 		return nil, fmt.Errorf("failed to get deployments: %v", err)
 	}
+	services, err := c.Clientset.CoreV1().Services(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get services: %v", err)
+	}
+	servicesByName := map[string]*corev1.Service{}
+	for i := range services.Items {
+		servicesByName[services.Items[i].Name] = &services.Items[i]
+	}
 
 	var statuses []api.AppStatus
 	for _, deployment := range deployments.Items {
+		// deployments KaaS didn't create are listed once they're adopted
+		if deployment.Labels[managedByLabel] != managedByValue && !legacyApp(&deployment, servicesByName) {
+			continue
+		}
 		status, err := c.GetAppStatus(ctx, deployment.Name)
 		if err != nil {
 			statuses = append(statuses, api.AppStatus{
@@ -337,6 +471,7 @@ func (c *ClusterManager) GetAllAppsStatus(ctx context.Context) ([]api.AppStatus,
 				Namespace:      deployment.Namespace,
 				ErrMsg:         err.Error(),
 			})
+			continue
 		}
 		statuses = append(statuses, status)
 	}
@@ -344,94 +479,99 @@ func (c *ClusterManager) GetAllAppsStatus(ctx context.Context) ([]api.AppStatus,
 	return statuses, nil
 }
 
-func (c *ClusterManager) updateIngress(ctx context.Context, appreq *api.AppRequest) error {
-	namespace := c.AppConf.Namespace
-	ingName := c.AppConf.IngressName
-	ingClient := c.Clientset.NetworkingV1().Ingresses(namespace)
-	ingress, err := ingClient.Get(ctx, ingName, metav1.GetOptions{})
-	if err != nil {
-		return fmt.Errorf("failed to get Ingress resource: %v", err)
-	}
-
-	// updating rules
-	pathType := netv1.PathTypePrefix
-	host := appreq.DomainAddress
-	ingress.Spec.Rules = append(ingress.Spec.Rules, netv1.IngressRule{
-		Host: host,
-		IngressRuleValue: netv1.IngressRuleValue{
-			HTTP: &netv1.HTTPIngressRuleValue{
-				Paths: []netv1.HTTPIngressPath{
-					{
-						Path:     "/",
-						PathType: &pathType,
-						Backend: netv1.IngressBackend{
-							Service: &netv1.IngressServiceBackend{
-								Name: appreq.Name,
-								Port: netv1.ServiceBackendPort{
-									Number: appreq.Port,
-								},
-							},
-						},
-					},
-				},
-			},
-		},
-	})
+// dbObjects are the objects that make up a database server, built from its request.
+type dbObjects struct {
+	statefulSet   *appsv1.StatefulSet
+	service       *corev1.Service
+	backup        *batchv1.CronJob
+	backupVolume  *corev1.PersistentVolumeClaim
+	engine        Engine
+	haConfig      *corev1.ConfigMap // primary of an HA database and the script that lets replicas in
+	rwService     *corev1.Service
+	roService     *corev1.Service
+	pgConfig      *corev1.ConfigMap  // postgresql.conf of the servers of a postgres database
+	pooler        *appsv1.Deployment // PgBouncer in front of the service of the database
+	poolerService *corev1.Service
+	restore       *batchv1.Job        // loads the data of a new database, set only on creation
+	usage         corev1.ResourceList // what the database counts against the quota
+}
 
-	_, err = ingClient.Update(ctx, ingress, metav1.UpdateOptions{})
+func (c *ClusterManager) DeployDBServer(ctx context.Context, dbreq *api.DBRequest) (*api.DBCredentials, error) {
+	if exists, err := c.resourceExists(ctx, "statefulset", dbreq.DBName); exists {
+		return nil, fmt.Errorf("database with this name exists: %v", err)
+	}
+
+	objs, err := c.buildDB(ctx, dbreq, "")
 	if err != nil {
-		return fmt.Errorf("failed to update Ingress resource: %v", err)
+		return nil, err
+	}
+	objs.restore, err = c.buildDBRestore(ctx, dbreq)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkQuota(ctx, objs.usage); err != nil {
+		return nil, err
 	}
 
-	return nil
+	return c.createDB(ctx, dbreq, objs)
 }
 
-func (c *ClusterManager) DeployDBServer(ctx context.Context, dbreq *api.DBRequest) (*api.DBCredentials, error) {
-	namespace := c.AppConf.Namespace
-
-	maxRand := 100000
-	username := fmt.Sprintf("user-%d", rand.Intn(maxRand))
-	password := fmt.Sprintf("pass-%d", rand.Intn(maxRand))
+// buildDB validates the request and builds the objects of the database server,
+// without creating anything. Databases applied as part of an environment are labeled with it.
+func (c *ClusterManager) buildDB(ctx context.Context, dbreq *api.DBRequest, environment string) (*dbObjects, error) {
+	namespace := c.namespace(ctx)
 	secretName := dbreq.DBName + "-secret"
 
-	if exists, err := c.resourceExists("secret", secretName); exists {
-		return nil, fmt.Errorf("database with this name exists: %v", err)
+	cpu, memory, disk, err := parseResources(dbreq.Resources)
+	if err != nil {
+		return nil, err
 	}
 
-	secret := &corev1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      secretName,
-			Namespace: namespace,
-		},
-		StringData: map[string]string{
-			"username": username,
-			"password": password,
-		},
+	engineName := dbreq.Engine
+	if engineName == "" {
+		engineName = EnginePostgres
+	}
+	engine, conf, err := c.engine(engineName)
+	if err != nil {
+		return nil, err
 	}
 
-	_, err := c.Clientset.CoreV1().Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{})
+	spec, err := json.Marshal(dbreq)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create secret: %v", err)
+		return nil, fmt.Errorf("failed to encode database spec: %v", err)
 	}
 
-	// parse resources
-	resources := strings.Split(dbreq.Resources, ",")
-	if len(resources) != 3 {
-		return nil, fmt.Errorf("expected 3 parts for resources, got %d", len(resources))
+	// servers of a database that isn't HA would each have data of their own
+	replicas := int32(1)
+	if dbreq.HA {
+		if engineName != EnginePostgres {
+			return nil, fmt.Errorf("high availability is only supported for %s databases", EnginePostgres)
+		}
+		replicas, err = c.haReplicas(dbreq)
+		if err != nil {
+			return nil, err
+		}
 	}
-	cpu := resources[0]
-	memory := resources[1]
-	disk := resources[2]
+
+	podRequests := corev1.ResourceList{
+		corev1.ResourceCPU:    cpu,
+		corev1.ResourceMemory: memory,
+	}
+	objs := &dbObjects{engine: engine, usage: workloadUsage(replicas, podRequests, disk)}
+	labels := workloadLabels(environment)
+	labels[engineLabel] = engineName
 
 	// create StatefulSet
-	statefulSet := &appsv1.StatefulSet{
+	objs.statefulSet = &appsv1.StatefulSet{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      dbreq.DBName,
-			Namespace: namespace,
+			Name:        dbreq.DBName,
+			Namespace:   namespace,
+			Labels:      labels,
+			Annotations: map[string]string{specAnnotation: string(spec)},
 		},
 		Spec: appsv1.StatefulSetSpec{
 			ServiceName: dbreq.DBName,
-			Replicas:    &c.DBConf.Replica,
+			Replicas:    &replicas,
 			Selector: &metav1.LabelSelector{
 				MatchLabels: map[string]string{"app": dbreq.DBName},
 			},
@@ -442,54 +582,30 @@ func (c *ClusterManager) DeployDBServer(ctx context.Context, dbreq *api.DBReques
 				Spec: corev1.PodSpec{
 					Containers: []corev1.Container{
 						{
-							Name:            "postgres",
-							Image:           c.DBConf.Image.Repository,
-							ImagePullPolicy: c.DBConf.Image.PullPolicy,
+							Name:            engineName,
+							Image:           conf.Image.Repository,
+							ImagePullPolicy: conf.Image.PullPolicy,
+							Args:            engine.Args(),
 							Ports: []corev1.ContainerPort{
-								{ContainerPort: c.DBConf.Port},
-							},
-							Env: []corev1.EnvVar{
-								{
-									Name:  "POSTGRES_DB",
-									Value: dbreq.DBName,
-								},
-								{
-									Name: "POSTGRES_USER",
-									ValueFrom: &corev1.EnvVarSource{
-										SecretKeyRef: &corev1.SecretKeySelector{
-											LocalObjectReference: corev1.LocalObjectReference{
-												Name: secretName,
-											},
-											Key: "username",
-										},
-									},
-								},
-								{
-									Name: "POSTGRES_PASSWORD",
-									ValueFrom: &corev1.EnvVarSource{
-										SecretKeyRef: &corev1.SecretKeySelector{
-											LocalObjectReference: corev1.LocalObjectReference{
-												Name: secretName,
-											},
-											Key: "password",
-										},
-									},
-								},
+								{ContainerPort: conf.Port},
 							},
+							Env:            engine.Env(dbreq.DBName, secretName),
+							ReadinessProbe: engine.Probe(conf.Port),
+							LivenessProbe:  livenessProbe(conf.Port),
 							Resources: corev1.ResourceRequirements{
 								Requests: corev1.ResourceList{
-									corev1.ResourceCPU:    resource.MustParse(cpu),
-									corev1.ResourceMemory: resource.MustParse(memory),
+									corev1.ResourceCPU:    cpu,
+									corev1.ResourceMemory: memory,
 								},
 								Limits: corev1.ResourceList{
-									corev1.ResourceCPU:    resource.MustParse(cpu),
-									corev1.ResourceMemory: resource.MustParse(memory),
+									corev1.ResourceCPU:    cpu,
+									corev1.ResourceMemory: memory,
 								},
 							},
 							VolumeMounts: []corev1.VolumeMount{
 								{
 									Name:      "data",
-									MountPath: "/var/lib/postgresql/data",
+									MountPath: engine.DataPath(),
 								},
 							},
 						},
@@ -507,7 +623,7 @@ func (c *ClusterManager) DeployDBServer(ctx context.Context, dbreq *api.DBReques
 						},
 						Resources: corev1.VolumeResourceRequirements{
 							Requests: corev1.ResourceList{
-								corev1.ResourceStorage: resource.MustParse(disk),
+								corev1.ResourceStorage: disk,
 							},
 						},
 					},
@@ -516,13 +632,8 @@ func (c *ClusterManager) DeployDBServer(ctx context.Context, dbreq *api.DBReques
 		},
 	}
 
-	_, err = c.Clientset.AppsV1().StatefulSets(namespace).Create(ctx, statefulSet, metav1.CreateOptions{})
-	if err != nil {
-		return nil, fmt.Errorf("failed to create statefulset: %v", err)
-	}
-
 	// create service
-	service := &corev1.Service{
+	objs.service = &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      dbreq.DBName,
 			Namespace: namespace,
@@ -531,71 +642,235 @@ func (c *ClusterManager) DeployDBServer(ctx context.Context, dbreq *api.DBReques
 			Selector: map[string]string{"app": dbreq.DBName},
 			Ports: []corev1.ServicePort{
 				{
-					Port: c.DBConf.Port,
+					Port: conf.Port,
 				},
 			},
 			Type: corev1.ServiceTypeClusterIP,
 		},
 	}
 
-	// if accessible from outside the cluster, shouod be converted to NodePort service
+	// if accessible from outside the cluster, the API server allocates the node port
 	if dbreq.ExternalAccess {
-		service.Spec.Type = corev1.ServiceTypeNodePort
-		service.Spec.Ports[0].TargetPort = intstr.FromInt(int(c.DBConf.Port))
-		service.Spec.Ports[0].NodePort = int32(30000 + rand.Intn(2767))
+		objs.service.Spec.Type = c.DBConf.External.ServiceType
+		if objs.service.Spec.Type == "" {
+			objs.service.Spec.Type = corev1.ServiceTypeNodePort
+		}
+		objs.service.Spec.Ports[0].TargetPort = intstr.FromInt(int(conf.Port))
+	}
+
+	if dbreq.HA {
+		if err := c.buildHA(ctx, dbreq, objs, conf.Port); err != nil {
+			return nil, err
+		}
+	}
+
+	maxConn := c.maxConnections()
+	if engineName == EnginePostgres {
+		if err := checkExtensions(dbreq.Extensions); err != nil {
+			return nil, err
+		}
+		maxConn, err = c.buildPostgresConfig(ctx, dbreq, objs, memory)
+		if err != nil {
+			return nil, err
+		}
+	} else if len(dbreq.Parameters) > 0 || len(dbreq.Extensions) > 0 {
+		return nil, fmt.Errorf("parameters and extensions are only supported for %s databases", EnginePostgres)
+	}
+
+	if dbreq.Pooler != nil {
+		if engineName != EnginePostgres {
+			return nil, fmt.Errorf("connection pooling is only supported for %s databases", EnginePostgres)
+		}
+		if err := c.buildPooler(ctx, dbreq, objs, conf.Port, maxConn); err != nil {
+			return nil, err
+		}
+	}
+
+	if dbreq.Backup != nil {
+		objs.backup, objs.backupVolume, err = c.buildBackup(ctx, dbreq, disk, environment)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return objs, nil
+}
+
+// checkAppName returns an error if a database has the name of the app. Both
+// keep their credentials in a secret named <name>-secret.
+func (c *ClusterManager) checkAppName(ctx context.Context, name string) error {
+	_, err := c.Clientset.AppsV1().StatefulSets(c.namespace(ctx)).Get(ctx, name, metav1.GetOptions{})
+	if err == nil {
+		return fmt.Errorf("database %s exists, an app can't have the name of a database", name)
+	}
+	if !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to get statefulset: %v", err)
+	}
+	return nil
+}
+
+// checkDBName returns an error if an app has the name of the database.
+func (c *ClusterManager) checkDBName(ctx context.Context, name string) error {
+	_, err := c.Clientset.AppsV1().Deployments(c.namespace(ctx)).Get(ctx, name, metav1.GetOptions{})
+	if err == nil {
+		return fmt.Errorf("app %s exists, a database can't have the name of an app", name)
+	}
+	if !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to get deployment: %v", err)
+	}
+	return nil
+}
+
+func (c *ClusterManager) createDB(ctx context.Context, dbreq *api.DBRequest, objs *dbObjects) (*api.DBCredentials, error) {
+	namespace := c.namespace(ctx)
+
+	if err := c.checkDBName(ctx, dbreq.DBName); err != nil {
+		return nil, err
+	}
+
+	secretName := dbreq.DBName + "-secret"
+	credentials := objs.engine.Credentials(randomUsername(), randomPassword())
+	if objs.haConfig != nil {
+		credentials["replication-password"] = randomPassword()
+	}
+
+	// the credentials of a deleted database are kept with its volume, so a
+	// database recreated on the volume gets them back. Secrets of anything else
+	// are left alone.
+	existing, err := c.Clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	if err == nil {
+		if existing.Labels[databaseLabel] != dbreq.DBName {
+			return nil, fmt.Errorf("secret %s exists and doesn't belong to database %s", secretName, dbreq.DBName)
+		}
+		for key, value := range existing.Data {
+			credentials[key] = string(value)
+		}
+	} else if !apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to get secret: %v", err)
 	}
 
-	_, err = c.Clientset.CoreV1().Services(namespace).Create(ctx, service, metav1.CreateOptions{})
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretName,
+			Namespace: namespace,
+			Labels: map[string]string{
+				"app":          dbreq.DBName,
+				managedByLabel: managedByValue,
+				databaseLabel:  dbreq.DBName,
+			},
+		},
+		StringData: credentials,
+	}
+	if err := c.applySecret(ctx, secret); err != nil {
+		return nil, err
+	}
+
+	if objs.pgConfig != nil {
+		if err := c.applyConfigMap(ctx, objs.pgConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	statefulSet, err := c.Clientset.AppsV1().StatefulSets(namespace).Create(ctx, objs.statefulSet, createOptions(ctx))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create service: %v", err)
+		return nil, fmt.Errorf("failed to create statefulset: %v", err)
 	}
+	created(ctx, statefulSet)
 
-	// get external IPs
-	nodes, err := c.Clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	service, err := c.Clientset.CoreV1().Services(namespace).Create(ctx, objs.service, createOptions(ctx))
 	if err != nil {
-		return nil, fmt.Errorf("failed to list nodes: %v", err)
+		return nil, fmt.Errorf("failed to create service: %v", err)
 	}
+	created(ctx, service)
 
-	IPs := []string{}
-	for _, node := range nodes.Items {
-		for _, address := range node.Status.Addresses {
-			if address.Type == corev1.NodeInternalIP {
-				IPs = append(IPs, address.Address)
-			}
+	if objs.haConfig != nil {
+		if err := c.applyHA(ctx, objs); err != nil {
+			return nil, err
 		}
 	}
-	servicePort := service.Spec.Ports[0].Port
-	nodePort := service.Spec.Ports[0].NodePort
-	externalURL := fmt.Sprintf("http://%s:%s", IPs[0], strconv.FormatInt(int64(nodePort), 10))
 
+	if objs.pooler != nil {
+		if err := c.applyPooler(ctx, dbreq.DBName, objs); err != nil {
+			return nil, err
+		}
+	}
+
+	if objs.backup != nil {
+		if err := c.applyBackup(ctx, dbreq.DBName, objs); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(dbreq.Extensions) > 0 && !isDryRun(ctx) {
+		go c.enableExtensions(context.WithoutCancel(ctx), dbreq.DBName, dbreq.Extensions)
+	}
+
+	// the restore job waits for the database to be ready
+	if objs.restore != nil {
+		restore, err := c.Clientset.BatchV1().Jobs(namespace).Create(ctx, objs.restore, createOptions(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create restore job: %v", err)
+		}
+		created(ctx, restore)
+	}
+
+	servicePort := service.Spec.Ports[0].Port
 	creds := api.DBCredentials{
 		DBName:      dbreq.DBName,
-		Username:    username,
-		Password:    password,
+		Engine:      objs.statefulSet.Labels[engineLabel],
+		Username:    credentials["username"],
+		Password:    credentials["password"],
 		ServiceName: service.Name,
 		ServicePort: servicePort,
-		ExternalIP:  IPs[0],
-		NodePort:    nodePort,
-		ExternalURL: externalURL,
+	}
+	creds.URL = objs.engine.URL(&creds, service.Name, servicePort)
+	if dbreq.ExternalAccess {
+		var externalPort int32
+		creds.ExternalIP, externalPort, err = c.externalAddress(ctx, service)
+		if err != nil {
+			return nil, err
+		}
+		creds.NodePort = service.Spec.Ports[0].NodePort
+		if creds.ExternalIP != "" {
+			creds.ExternalURL = objs.engine.URL(&creds, creds.ExternalIP, externalPort)
+		}
+	}
+	if objs.haConfig != nil {
+		creds.RWService = objs.rwService.Name
+		creds.ROService = objs.roService.Name
+		creds.RWURL = objs.engine.URL(&creds, creds.RWService, servicePort)
+		creds.ROURL = objs.engine.URL(&creds, creds.ROService, servicePort)
+	}
+	if objs.pooler != nil {
+		creds.PoolerService = objs.poolerService.Name
+		creds.PoolerPort = poolerPort
+		creds.PoolerURL = objs.engine.URL(&creds, creds.PoolerService, poolerPort)
 	}
 
 	return &creds, nil
 
 }
 
-func (c *ClusterManager) resourceExists(resourceType, resourceName string) (bool, error) {
-	namespace := c.AppConf.Namespace
+func (c *ClusterManager) resourceExists(ctx context.Context, resourceType, resourceName string) (bool, error) {
+	namespace := c.namespace(ctx)
 
 	switch resourceType {
 	case "secret":
-		_, err := c.Clientset.CoreV1().Secrets(namespace).Get(context.Background(), resourceName, metav1.GetOptions{})
+		_, err := c.Clientset.CoreV1().Secrets(namespace).Get(ctx, resourceName, metav1.GetOptions{})
 		if err != nil {
 			return false, err
 		}
 		return true, nil
 
 	case "deployment":
-		_, err := c.Clientset.AppsV1().Deployments(namespace).Get(context.Background(), resourceName, metav1.GetOptions{})
+		_, err := c.Clientset.AppsV1().Deployments(namespace).Get(ctx, resourceName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return true, nil
+
+	case "statefulset":
+		_, err := c.Clientset.AppsV1().StatefulSets(namespace).Get(ctx, resourceName, metav1.GetOptions{})
 		if err != nil {
 			return false, err
 		}
@@ -606,6 +881,23 @@ func (c *ClusterManager) resourceExists(resourceType, resourceName string) (bool
 	}
 }
 
+// parseResources parses the CPU,RAM,DISK triple of app and database requests.
+func parseResources(s string) (cpu, mem, disk resource.Quantity, err error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 3 {
+		return cpu, mem, disk, fmt.Errorf("expected 3 parts for resources, got %d", len(parts))
+	}
+
+	quantities := make([]resource.Quantity, 3)
+	for i, part := range parts {
+		quantities[i], err = resource.ParseQuantity(strings.TrimSpace(part))
+		if err != nil {
+			return cpu, mem, disk, fmt.Errorf("invalid resource %q: %v", part, err)
+		}
+	}
+	return quantities[0], quantities[1], quantities[2], nil
+}
+
 func parseInt32(s string) int32 {
 	num, _ := strconv.ParseInt(s, 10, 32)
 	return int32(num)
@@ -0,0 +1,193 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/SepehrNoey/KaaS/api"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	FormatURI    = "uri"
+	FormatJDBC   = "jdbc"
+	FormatEnv    = "env"
+	FormatPgpass = "pgpass"
+	FormatDotnet = "dotnet"
+
+	clusterDomain = "cluster.local"
+)
+
+var sslModes = map[string]bool{
+	"disable": true, "allow": true, "prefer": true,
+	"require": true, "verify-ca": true, "verify-full": true,
+}
+
+// ConnectionOptions select what GetDBConnection renders.
+type ConnectionOptions struct {
+	Format   string // uri, jdbc, env, pgpass or dotnet, defaults to uri
+	SSLMode  string // sslmode of postgres clients, left to the client if empty
+	User     string // additional user of the server, defaults to the user of the server
+	Database string // defaults to the database of the server
+}
+
+// connectionTarget is what a connection string is rendered from.
+type connectionTarget struct {
+	engine   string
+	host     string
+	port     int32
+	database string
+	username string
+	password string
+	sslMode  string
+}
+
+// GetDBConnection renders the connection details of a database in the format
+// of opts, through the DNS name of its service in the cluster and, for
+// databases with external access, through their external address.
+func (c *ClusterManager) GetDBConnection(ctx context.Context, name string, opts ConnectionOptions) (*api.DBConnection, error) {
+	namespace := c.namespace(ctx)
+	if opts.Format == "" {
+		opts.Format = FormatURI
+	}
+	if opts.SSLMode != "" && !sslModes[opts.SSLMode] {
+		return nil, fmt.Errorf("invalid sslmode %q", opts.SSLMode)
+	}
+
+	statefulSet, err := c.Clientset.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database: %v", err)
+	}
+	engine := statefulSet.Labels[engineLabel]
+	if engine == "" {
+		engine = EnginePostgres
+	}
+	if engine != EnginePostgres && opts.Format != FormatURI && opts.Format != FormatEnv {
+		return nil, fmt.Errorf("format %s is only supported for %s databases", opts.Format, EnginePostgres)
+	}
+
+	secretName := name + "-secret"
+	if opts.User != "" {
+		if err := checkSQLName("user", opts.User); err != nil {
+			return nil, err
+		}
+		secretName = name + "-user-" + opts.User
+	}
+	secret, err := c.Clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get credentials: %v", err)
+	}
+	service, err := c.Clientset.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get service: %v", err)
+	}
+
+	target := connectionTarget{
+		engine:   engine,
+		host:     fmt.Sprintf("%s.%s.svc.%s", service.Name, namespace, clusterDomain),
+		port:     service.Spec.Ports[0].Port,
+		database: name,
+		username: string(secret.Data["username"]),
+		password: string(secret.Data["password"]),
+		sslMode:  opts.SSLMode,
+	}
+	if opts.Database != "" {
+		if err := checkSQLName("database", opts.Database); err != nil {
+			return nil, err
+		}
+		target.database = opts.Database
+	}
+
+	conn := &api.DBConnection{Format: opts.Format}
+	conn.Internal, err = target.render(opts.Format)
+	if err != nil {
+		return nil, err
+	}
+	if isExternal(service) {
+		target.host, target.port, err = c.externalAddress(ctx, service)
+		if err != nil {
+			return nil, err
+		}
+		// load balancers get their address after the database is created
+		if target.host != "" {
+			conn.External, err = target.render(opts.Format)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return conn, nil
+}
+
+func (t *connectionTarget) render(format string) (string, error) {
+	port := strconv.FormatInt(int64(t.port), 10)
+	switch format {
+	case FormatURI:
+		creds := &api.DBCredentials{DBName: t.database, Username: t.username, Password: t.password}
+		uri := engines[t.engine].URL(creds, t.host, t.port)
+		if t.sslMode != "" && t.engine == EnginePostgres {
+			uri += "?sslmode=" + t.sslMode
+		}
+		return uri, nil
+	case FormatJDBC:
+		query := url.Values{"user": {t.username}, "password": {t.password}}
+		if t.sslMode != "" {
+			query.Set("sslmode", t.sslMode)
+		}
+		return fmt.Sprintf("jdbc:postgresql://%s:%s/%s?%s", t.host, port, url.PathEscape(t.database), query.Encode()), nil
+	case FormatEnv:
+		lines := []string{
+			"DB_HOST=" + t.host,
+			"DB_PORT=" + port,
+			"DB_NAME=" + t.database,
+			"DB_USER=" + t.username,
+			"DB_PASSWORD=" + t.password,
+		}
+		if t.engine == EnginePostgres {
+			lines = append(lines,
+				"PGHOST="+t.host,
+				"PGPORT="+port,
+				"PGDATABASE="+t.database,
+				"PGUSER="+t.username,
+				"PGPASSWORD="+t.password,
+			)
+			if t.sslMode != "" {
+				lines = append(lines, "PGSSLMODE="+t.sslMode)
+			}
+		}
+		return strings.Join(lines, "\n") + "\n", nil
+	case FormatPgpass:
+		escape := strings.NewReplacer(`\`, `\\`, ":", `\:`)
+		return strings.Join([]string{t.host, port, escape.Replace(t.database), escape.Replace(t.username), escape.Replace(t.password)}, ":") + "\n", nil
+	case FormatDotnet:
+		parts := []string{
+			"Host=" + t.host,
+			"Port=" + port,
+			"Database=" + t.database,
+			"Username=" + t.username,
+			"Password=" + t.password,
+		}
+		if t.sslMode != "" {
+			parts = append(parts, "SSL Mode="+dotnetSSLMode(t.sslMode))
+		}
+		return strings.Join(parts, ";"), nil
+	default:
+		return "", fmt.Errorf("invalid format %q, expected %s, %s, %s, %s or %s", format, FormatURI, FormatJDBC, FormatEnv, FormatPgpass, FormatDotnet)
+	}
+}
+
+// dotnetSSLMode returns the Npgsql name of a libpq sslmode.
+func dotnetSSLMode(mode string) string {
+	parts := strings.Split(mode, "-")
+	for i, part := range parts {
+		if part == "ca" {
+			parts[i] = "CA"
+			continue
+		}
+		parts[i] = strings.ToUpper(part[:1]) + part[1:]
+	}
+	return strings.Join(parts, "")
+}
@@ -0,0 +1,117 @@
+package cluster
+
+import (
+	"context"
+	"sync"
+
+	"github.com/SepehrNoey/KaaS/pkg/audit"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+const redactedValue = "[REDACTED]"
+
+type dryRunKey struct{}
+
+// dryRunObjects collects the objects the Kubernetes API returned for a dry run.
+type dryRunObjects struct {
+	mu      sync.Mutex
+	objects []any
+}
+
+// WithDryRun makes the ClusterManager operations called with the returned
+// context validate and send their changes with server-side dry run only.
+func WithDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, &dryRunObjects{objects: []any{}})
+}
+
+// DryRunObjects returns the objects that would have been created or updated by
+// the operations called with a context of WithDryRun, with secret values redacted.
+func DryRunObjects(ctx context.Context) []any {
+	d, ok := ctx.Value(dryRunKey{}).(*dryRunObjects)
+	if !ok {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.objects
+}
+
+func isDryRun(ctx context.Context) bool {
+	_, ok := ctx.Value(dryRunKey{}).(*dryRunObjects)
+	return ok
+}
+
+func dryRunOption(ctx context.Context) []string {
+	if isDryRun(ctx) {
+		return []string{metav1.DryRunAll}
+	}
+	return nil
+}
+
+func createOptions(ctx context.Context) metav1.CreateOptions {
+	return metav1.CreateOptions{DryRun: dryRunOption(ctx)}
+}
+
+func updateOptions(ctx context.Context) metav1.UpdateOptions {
+	return metav1.UpdateOptions{DryRun: dryRunOption(ctx)}
+}
+
+func deleteOptions(ctx context.Context) metav1.DeleteOptions {
+	return metav1.DeleteOptions{DryRun: dryRunOption(ctx)}
+}
+
+// created records an object returned by a create call, in the audit log or,
+// on dry runs, in the result of the dry run.
+func created(ctx context.Context, obj runtime.Object) {
+	if !isDryRun(ctx) {
+		kind, name := objectKind(obj), obj.(metav1.Object).GetName()
+		audit.AddObject(ctx, kind, name)
+		return
+	}
+	updated(ctx, obj)
+}
+
+// updated records an object returned by an update call in the result of a dry run.
+func updated(ctx context.Context, obj runtime.Object) {
+	d, ok := ctx.Value(dryRunKey{}).(*dryRunObjects)
+	if !ok {
+		return
+	}
+
+	obj = obj.DeepCopyObject()
+	// typed clients drop the kind of returned objects
+	if gvks, _, err := scheme.Scheme.ObjectKinds(obj); err == nil && len(gvks) > 0 {
+		obj.GetObjectKind().SetGroupVersionKind(gvks[0])
+	}
+	if secret, ok := obj.(*corev1.Secret); ok {
+		redactSecret(secret)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.objects = append(d.objects, obj)
+}
+
+func objectKind(obj runtime.Object) string {
+	gvks, _, err := scheme.Scheme.ObjectKinds(obj)
+	if err != nil || len(gvks) == 0 {
+		return ""
+	}
+	return gvks[0].Kind
+}
+
+// redactSecret replaces the values of the secret, keeping its keys.
+func redactSecret(secret *corev1.Secret) {
+	stringData := map[string]string{}
+	for key := range secret.Data {
+		stringData[key] = redactedValue
+	}
+	for key := range secret.StringData {
+		stringData[key] = redactedValue
+	}
+	secret.Data = nil
+	secret.StringData = stringData
+}
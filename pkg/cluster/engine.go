@@ -0,0 +1,312 @@
+package cluster
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/SepehrNoey/KaaS/api"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	EnginePostgres = "postgres"
+	EngineMySQL    = "mysql"
+	EngineMariaDB  = "mariadb"
+	EngineRedis    = "redis"
+	EngineMongoDB  = "mongodb"
+
+	// engineLabel holds the engine of a database. Databases created before
+	// engines were supported don't have it and run postgres.
+	engineLabel = "kaas.io/engine"
+)
+
+// Engine is a database server KaaS can deploy. The image and port of every
+// engine are configured in db-request-config.
+type Engine interface {
+	// DefaultPort is the port of the server when db-request-config doesn't set one.
+	DefaultPort() int32
+	// DataPath is where the server keeps its data. The volume of the database is mounted there.
+	DataPath() string
+	// Env returns the variables that make the server create the database and its
+	// user with the credentials of the secret.
+	Env(dbName, secretName string) []corev1.EnvVar
+	// Args returns the arguments of the server, if it's configured through them.
+	Args() []string
+	// Probe returns the readiness probe of the server.
+	Probe(port int32) *corev1.Probe
+	// Credentials returns the data of the secret of a database. It has the
+	// username and password keys, which bindings pass to apps.
+	Credentials(username, password string) map[string]string
+	// URL returns the connection URL of a database reached at host and port.
+	URL(creds *api.DBCredentials, host string, port int32) string
+}
+
+var engines = map[string]Engine{
+	EnginePostgres: postgresEngine{},
+	EngineMySQL:    mysqlEngine{envPrefix: "MYSQL", admin: "mysqladmin"},
+	EngineMariaDB:  mysqlEngine{envPrefix: "MARIADB", admin: "mariadb-admin"},
+	EngineRedis:    redisEngine{},
+	EngineMongoDB:  mongoEngine{},
+}
+
+// EngineConf is how an engine is run, read from the engines.<engine>.* keys of
+// db-request-config. Postgres also reads the image.* and port keys.
+type EngineConf struct {
+	Image Image
+	Port  int32
+}
+
+// parseEngines returns the configuration of the engines that have an image.
+func parseEngines(data map[string]string) map[string]EngineConf {
+	confs := map[string]EngineConf{}
+	for name, engine := range engines {
+		key := "engines." + name + "."
+		conf := EngineConf{
+			Image: Image{
+				Repository: data[key+"image"],
+				PullPolicy: corev1.PullPolicy(data[key+"pullPolicy"]),
+			},
+			Port: parseInt32(data[key+"port"]),
+		}
+		if name == EnginePostgres && conf.Image.Repository == "" {
+			conf.Image = Image{
+				Repository: data["image.repository"],
+				PullPolicy: corev1.PullPolicy(data["image.pullPolicy"]),
+			}
+			conf.Port = parseInt32(data["port"])
+		}
+		if conf.Image.Repository == "" {
+			continue
+		}
+		if conf.Port == 0 {
+			conf.Port = engine.DefaultPort()
+		}
+		confs[name] = conf
+	}
+	return confs
+}
+
+// engine returns an engine configured in db-request-config, postgres if name is empty.
+func (c *ClusterManager) engine(name string) (Engine, EngineConf, error) {
+	if name == "" {
+		name = EnginePostgres
+	}
+	engine, ok := engines[name]
+	if !ok {
+		names := []string{}
+		for name := range engines {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, EngineConf{}, fmt.Errorf("unknown database engine %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+
+	conf, ok := c.DBConf.Engines[name]
+	// clusters configured before engines were supported only set the postgres keys
+	if !ok && name == EnginePostgres && c.DBConf.Image.Repository != "" {
+		conf, ok = EngineConf{Image: c.DBConf.Image, Port: c.DBConf.Port}, true
+	}
+	if !ok {
+		return nil, EngineConf{}, fmt.Errorf("database engine %s isn't configured in db-request-config", name)
+	}
+	return engine, conf, nil
+}
+
+func execProbe(command ...string) *corev1.Probe {
+	return &corev1.Probe{
+		ProbeHandler:        corev1.ProbeHandler{Exec: &corev1.ExecAction{Command: command}},
+		InitialDelaySeconds: 5,
+		PeriodSeconds:       10,
+		TimeoutSeconds:      5,
+	}
+}
+
+func connectionURL(scheme string, creds *api.DBCredentials, host string, port int32, path string) string {
+	u := url.URL{
+		Scheme: scheme,
+		User:   url.UserPassword(creds.Username, creds.Password),
+		Host:   host + ":" + strconv.FormatInt(int64(port), 10),
+		Path:   path,
+	}
+	return u.String()
+}
+
+// RedactCredentials replaces the password of the credentials and removes it
+// from their connection URLs.
+func RedactCredentials(creds *api.DBCredentials) {
+	creds.Password = redactedValue
+	for _, u := range []*string{&creds.URL, &creds.ExternalURL, &creds.RWURL, &creds.ROURL, &creds.PoolerURL} {
+		if *u == "" {
+			continue
+		}
+		parsed, err := url.Parse(*u)
+		if err != nil {
+			*u = ""
+			continue
+		}
+		if parsed.User != nil {
+			parsed.User = url.User(parsed.User.Username())
+		}
+		*u = parsed.String()
+	}
+}
+
+type postgresEngine struct{}
+
+func (postgresEngine) DefaultPort() int32 { return 5432 }
+
+func (postgresEngine) DataPath() string { return "/var/lib/postgresql/data" }
+
+func (postgresEngine) Env(dbName, secretName string) []corev1.EnvVar {
+	return []corev1.EnvVar{
+		{Name: "POSTGRES_DB", Value: dbName},
+		secretEnv("POSTGRES_USER", secretName, "username"),
+		secretEnv("POSTGRES_PASSWORD", secretName, "password"),
+	}
+}
+
+func (postgresEngine) Args() []string { return nil }
+
+func (postgresEngine) Probe(port int32) *corev1.Probe {
+	return execProbe("pg_isready", "-h", "127.0.0.1", "-p", strconv.FormatInt(int64(port), 10))
+}
+
+func (postgresEngine) Credentials(username, password string) map[string]string {
+	return map[string]string{"username": username, "password": password}
+}
+
+func (postgresEngine) URL(creds *api.DBCredentials, host string, port int32) string {
+	return connectionURL("postgres", creds, host, port, "/"+creds.DBName)
+}
+
+// mysqlEngine runs MySQL, or MariaDB with the MARIADB variables of its image.
+type mysqlEngine struct {
+	envPrefix string
+	admin     string // client that pings the server
+}
+
+func (mysqlEngine) DefaultPort() int32 { return 3306 }
+
+func (mysqlEngine) DataPath() string { return "/var/lib/mysql" }
+
+func (e mysqlEngine) Env(dbName, secretName string) []corev1.EnvVar {
+	return []corev1.EnvVar{
+		{Name: e.envPrefix + "_DATABASE", Value: dbName},
+		secretEnv(e.envPrefix+"_USER", secretName, "username"),
+		secretEnv(e.envPrefix+"_PASSWORD", secretName, "password"),
+		secretEnv(e.envPrefix+"_ROOT_PASSWORD", secretName, "root-password"),
+	}
+}
+
+func (mysqlEngine) Args() []string { return nil }
+
+// Probe pings the server, which answers even to clients it doesn't let in.
+func (e mysqlEngine) Probe(port int32) *corev1.Probe {
+	return execProbe(e.admin, "ping", "-h", "127.0.0.1", "-P", strconv.FormatInt(int64(port), 10))
+}
+
+func (mysqlEngine) Credentials(username, password string) map[string]string {
+	return map[string]string{
+		"username":      username,
+		"password":      password,
+		"root-password": randomPassword(),
+	}
+}
+
+func (mysqlEngine) URL(creds *api.DBCredentials, host string, port int32) string {
+	return connectionURL("mysql", creds, host, port, "/"+creds.DBName)
+}
+
+// redisEngine runs Redis with append-only persistence. Clients authenticate as
+// the default user.
+type redisEngine struct{}
+
+func (redisEngine) DefaultPort() int32 { return 6379 }
+
+func (redisEngine) DataPath() string { return "/data" }
+
+func (redisEngine) Env(dbName, secretName string) []corev1.EnvVar {
+	return []corev1.EnvVar{secretEnv("REDIS_PASSWORD", secretName, "password")}
+}
+
+func (redisEngine) Args() []string {
+	return []string{"--appendonly", "yes", "--requirepass", "$(REDIS_PASSWORD)"}
+}
+
+func (redisEngine) Probe(port int32) *corev1.Probe {
+	return execProbe("sh", "-c", fmt.Sprintf(`redis-cli -p %d -a "$REDIS_PASSWORD" --no-auth-warning ping | grep -q PONG`, port))
+}
+
+func (redisEngine) Credentials(username, password string) map[string]string {
+	return map[string]string{"username": "default", "password": password}
+}
+
+func (redisEngine) URL(creds *api.DBCredentials, host string, port int32) string {
+	return connectionURL("redis", creds, host, port, "/0")
+}
+
+// mongoEngine runs MongoDB. The user is created in the admin database, so
+// clients authenticate against it.
+type mongoEngine struct{}
+
+func (mongoEngine) DefaultPort() int32 { return 27017 }
+
+func (mongoEngine) DataPath() string { return "/data/db" }
+
+func (mongoEngine) Env(dbName, secretName string) []corev1.EnvVar {
+	return []corev1.EnvVar{
+		{Name: "MONGO_INITDB_DATABASE", Value: dbName},
+		secretEnv("MONGO_INITDB_ROOT_USERNAME", secretName, "username"),
+		secretEnv("MONGO_INITDB_ROOT_PASSWORD", secretName, "password"),
+	}
+}
+
+func (mongoEngine) Args() []string { return nil }
+
+func (mongoEngine) Probe(port int32) *corev1.Probe {
+	return execProbe("mongosh", "--quiet", "--port", strconv.FormatInt(int64(port), 10), "--eval", "db.adminCommand('ping')")
+}
+
+func (mongoEngine) Credentials(username, password string) map[string]string {
+	return map[string]string{"username": username, "password": password}
+}
+
+func (mongoEngine) URL(creds *api.DBCredentials, host string, port int32) string {
+	return connectionURL("mongodb", creds, host, port, "/"+creds.DBName) + "?authSource=admin"
+}
+
+// randomPassword returns 32 bytes of crypto/rand, base64url encoded so the
+// password is safe in connection URLs and SQL string literals.
+func randomPassword() string {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		panic(fmt.Sprintf("failed to read random bytes: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// randomUsername returns a user name with 8 bytes of crypto/rand, hex encoded
+// so the name stays lowercase for engines that fold unquoted identifiers.
+func randomUsername() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		panic(fmt.Sprintf("failed to read random bytes: %v", err))
+	}
+	return "user-" + hex.EncodeToString(buf)
+}
+
+// livenessProbe restarts servers that stop accepting connections.
+func livenessProbe(port int32) *corev1.Probe {
+	return &corev1.Probe{
+		ProbeHandler:        corev1.ProbeHandler{TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt32(port)}},
+		InitialDelaySeconds: 30,
+		PeriodSeconds:       10,
+	}
+}
@@ -0,0 +1,630 @@
+package cluster
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	ExportYAML = "yaml" // multi-document Kubernetes YAML
+	ExportHelm = "helm" // chart tarball with the values extracted
+
+	chartVersion = "0.1.0"
+)
+
+// Export is a rendered export of an app or database.
+type Export struct {
+	Data        []byte
+	ContentType string
+	FileName    string
+}
+
+// exportObject is an exported object with the fields that are turned into chart values.
+type exportObject struct {
+	name   string // file name of the template
+	object map[string]any
+	values []chartValue
+}
+
+type chartValue struct {
+	path  []string // path of the field in the object
+	key   []string // path of the value in values.yaml
+	value any
+	quote bool
+}
+
+// ExportApp exports the objects KaaS manages for an app, with server-managed fields stripped.
+// Secrets are exported with their keys only.
+func (c *ClusterManager) ExportApp(ctx context.Context, name, format string) (*Export, error) {
+	namespace := c.namespace(ctx)
+	deployment, err := c.Clientset.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deployment: %v", err)
+	}
+	if len(deployment.Spec.Template.Spec.Containers) != 1 {
+		return nil, fmt.Errorf("deployment %s isn't an app of KaaS", name)
+	}
+	service, err := c.Clientset.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get service: %v", err)
+	}
+
+	objects := []exportObject{}
+	secret, err := c.exportSecret(ctx, name+"-secret")
+	if err != nil {
+		return nil, err
+	}
+	if secret != nil {
+		obj, err := exportedObject("secret", secret)
+		if err != nil {
+			return nil, err
+		}
+		obj.values = secretValues(secret)
+		objects = append(objects, *obj)
+	}
+
+	deployment.Status = appsv1.DeploymentStatus{}
+	obj, err := exportedObject("deployment", deployment)
+	if err != nil {
+		return nil, err
+	}
+	obj.values = workloadValues(deployment.Spec.Replicas, deployment.Spec.Template.Spec.Containers[0], []string{"spec", "template", "spec", "containers"})
+	objects = append(objects, *obj)
+
+	clearServiceFields(service)
+	obj, err = exportedObject("service", service)
+	if err != nil {
+		return nil, err
+	}
+	obj.values = []chartValue{{path: []string{"spec", "type"}, key: []string{"service", "type"}, value: string(service.Spec.Type)}}
+	objects = append(objects, *obj)
+
+	ingress, err := c.exportIngress(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if ingress != nil {
+		obj, err := exportedObject("ingress", ingress)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, *obj)
+	}
+
+	return renderExport(name, format, objects)
+}
+
+// ExportDB exports the objects KaaS manages for a database, with server-managed
+// fields stripped. The credentials are exported with their keys only.
+func (c *ClusterManager) ExportDB(ctx context.Context, name, format string) (*Export, error) {
+	namespace := c.namespace(ctx)
+	statefulSet, err := c.Clientset.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get statefulset: %v", err)
+	}
+	if len(statefulSet.Spec.Template.Spec.Containers) != 1 {
+		return nil, fmt.Errorf("statefulset %s isn't a database of KaaS", name)
+	}
+	service, err := c.Clientset.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get service: %v", err)
+	}
+
+	objects := []exportObject{}
+	secret, err := c.exportSecret(ctx, name+"-secret")
+	if err != nil {
+		return nil, err
+	}
+	if secret != nil {
+		obj, err := exportedObject("secret", secret)
+		if err != nil {
+			return nil, err
+		}
+		obj.values = secretValues(secret)
+		objects = append(objects, *obj)
+	}
+
+	statefulSet.Status = appsv1.StatefulSetStatus{}
+	for i := range statefulSet.Spec.VolumeClaimTemplates {
+		statefulSet.Spec.VolumeClaimTemplates[i].Status = corev1.PersistentVolumeClaimStatus{}
+	}
+	storage := volumeStorage(statefulSet)
+	if len(statefulSet.Spec.VolumeClaimTemplates) > 0 {
+		// databases whose volumes were grown are recreated with the grown size
+		statefulSet.Spec.VolumeClaimTemplates[0].Spec.Resources.Requests[corev1.ResourceStorage] = storage
+	}
+	obj, err := exportedObject("statefulset", statefulSet)
+	if err != nil {
+		return nil, err
+	}
+	obj.values = workloadValues(statefulSet.Spec.Replicas, statefulSet.Spec.Template.Spec.Containers[0], []string{"spec", "template", "spec", "containers"})
+	if len(statefulSet.Spec.VolumeClaimTemplates) > 0 {
+		obj.values = append(obj.values, chartValue{
+			path:  []string{"spec", "volumeClaimTemplates", "0", "spec", "resources", "requests", "storage"},
+			key:   []string{"storage"},
+			value: storage.String(),
+			quote: true,
+		})
+	}
+	objects = append(objects, *obj)
+
+	clearServiceFields(service)
+	obj, err = exportedObject("service", service)
+	if err != nil {
+		return nil, err
+	}
+	obj.values = []chartValue{{path: []string{"spec", "type"}, key: []string{"service", "type"}, value: string(service.Spec.Type)}}
+	objects = append(objects, *obj)
+
+	if statefulSet.Labels[haLabel] == "true" {
+		haObjects, err := c.exportHA(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, haObjects...)
+	}
+
+	configMap, err := c.Clientset.CoreV1().ConfigMaps(namespace).Get(ctx, name+"-config", metav1.GetOptions{})
+	if err == nil {
+		obj, err := exportedObject("configmap", configMap)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, *obj)
+	} else if !apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to get config map: %v", err)
+	}
+
+	poolerObjects, err := c.exportPooler(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	objects = append(objects, poolerObjects...)
+
+	return renderExport(name, format, objects)
+}
+
+// exportPooler exports the pooler deployment and service of a database, if it has them.
+func (c *ClusterManager) exportPooler(ctx context.Context, name string) ([]exportObject, error) {
+	namespace := c.namespace(ctx)
+	deployment, err := c.Clientset.AppsV1().Deployments(namespace).Get(ctx, name+"-pooler", metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pooler deployment: %v", err)
+	}
+	deployment.Status = appsv1.DeploymentStatus{}
+	obj, err := exportedObject("pooler-deployment", deployment)
+	if err != nil {
+		return nil, err
+	}
+	objects := []exportObject{*obj}
+
+	service, err := c.Clientset.CoreV1().Services(namespace).Get(ctx, name+"-pooler", metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pooler service: %v", err)
+	}
+	clearServiceFields(service)
+	obj, err = exportedObject("pooler-service", service)
+	if err != nil {
+		return nil, err
+	}
+	return append(objects, *obj), nil
+}
+
+// exportHA exports the HA config map and the -rw and -ro services of a database.
+func (c *ClusterManager) exportHA(ctx context.Context, name string) ([]exportObject, error) {
+	namespace := c.namespace(ctx)
+	configMap, err := c.Clientset.CoreV1().ConfigMaps(namespace).Get(ctx, name+"-ha", metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get HA config map: %v", err)
+	}
+	obj, err := exportedObject("ha-configmap", configMap)
+	if err != nil {
+		return nil, err
+	}
+	objects := []exportObject{*obj}
+
+	for _, suffix := range []string{"rw", "ro"} {
+		service, err := c.Clientset.CoreV1().Services(namespace).Get(ctx, name+"-"+suffix, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get service: %v", err)
+		}
+		clearServiceFields(service)
+		obj, err := exportedObject("service-"+suffix, service)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, *obj)
+	}
+	return objects, nil
+}
+
+// exportSecret returns the secret with its values blanked, or nil if it doesn't exist.
+func (c *ClusterManager) exportSecret(ctx context.Context, name string) (*corev1.Secret, error) {
+	secret, err := c.Clientset.CoreV1().Secrets(c.namespace(ctx)).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret: %v", err)
+	}
+
+	stringData := map[string]string{}
+	for key := range secret.Data {
+		stringData[key] = ""
+	}
+	for key := range secret.StringData {
+		stringData[key] = ""
+	}
+	secret.Data = nil
+	secret.StringData = stringData
+	return secret, nil
+}
+
+// exportIngress returns the dedicated ingress of the app, or an ingress with the
+// paths the shared ingress routes to the app. Apps without routes have no ingress.
+func (c *ClusterManager) exportIngress(ctx context.Context, app string) (*netv1.Ingress, error) {
+	ingresses, err := c.managedIngresses(ctx, c.namespace(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range ingresses {
+		ingress := &ingresses[i]
+		if ingress.Name == c.AppConf.IngressName {
+			continue
+		}
+		if ingress.Name == app && ingress.Labels["app"] == app {
+			return ingress, nil
+		}
+	}
+
+	for i := range ingresses {
+		shared := &ingresses[i]
+		if shared.Name != c.AppConf.IngressName {
+			continue
+		}
+		rules, _ := withoutPaths(shared.Spec.Rules, func(name string) bool { return name != app })
+		if len(rules) == 0 {
+			return nil, nil
+		}
+		routing := &appRouting{
+			rules:       rules,
+			tls:         hostsTLS(shared.Spec.TLS, rules),
+			annotations: shared.Annotations,
+		}
+		className := ""
+		if shared.Spec.IngressClassName != nil {
+			className = *shared.Spec.IngressClassName
+		}
+		return sharedIngress(app, shared.Namespace, className, routing), nil
+	}
+
+	return nil, nil
+}
+
+func clearServiceFields(service *corev1.Service) {
+	service.Spec.ClusterIP = ""
+	service.Spec.ClusterIPs = nil
+	service.Spec.IPFamilies = nil
+	service.Spec.IPFamilyPolicy = nil
+	for i := range service.Spec.Ports {
+		service.Spec.Ports[i].NodePort = 0
+	}
+	service.Status = corev1.ServiceStatus{}
+}
+
+// exportedObject strips the fields set by the server and by KaaS from the object
+// and converts it to the form it's rendered from.
+func exportedObject(name string, obj runtime.Object) (*exportObject, error) {
+	obj = obj.DeepCopyObject()
+	if gvks, _, err := scheme.Scheme.ObjectKinds(obj); err == nil && len(gvks) > 0 {
+		obj.GetObjectKind().SetGroupVersionKind(gvks[0])
+	}
+
+	meta := obj.(metav1.Object)
+	meta.SetNamespace("")
+	meta.SetUID("")
+	meta.SetResourceVersion("")
+	meta.SetGeneration(0)
+	meta.SetCreationTimestamp(metav1.Time{})
+	meta.SetManagedFields(nil)
+	meta.SetOwnerReferences(nil)
+	meta.SetSelfLink("")
+	meta.SetLabels(withoutKeys(meta.GetLabels(), managedByLabel, environmentLabel, engineLabel, databaseLabel))
+	meta.SetAnnotations(withoutKeys(meta.GetAnnotations(), specAnnotation, tlsSecretAnnotation, tlsAppsAnnotation, storageAnnotation, extensionsAnnotation,
+		corev1.LastAppliedConfigAnnotation, "deployment.kubernetes.io/revision"))
+
+	object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert %s: %v", name, err)
+	}
+	delete(object, "status")
+	pruneEmpty(object)
+
+	return &exportObject{name: name, object: object}, nil
+}
+
+func withoutKeys(m map[string]string, keys ...string) map[string]string {
+	for _, key := range keys {
+		delete(m, key)
+	}
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
+
+// pruneEmpty removes the null and empty fields left by the conversion, such as
+// the creation timestamps of templates.
+func pruneEmpty(v any) {
+	switch value := v.(type) {
+	case map[string]any:
+		for key, item := range value {
+			pruneEmpty(item)
+			switch item := item.(type) {
+			case nil:
+				delete(value, key)
+			case map[string]any:
+				if len(item) == 0 {
+					delete(value, key)
+				}
+			}
+		}
+	case []any:
+		for _, item := range value {
+			pruneEmpty(item)
+		}
+	}
+}
+
+// workloadValues returns the chart values of the replicas, image, resources and
+// plain environment variables of the container of a workload.
+func workloadValues(replicas *int32, container corev1.Container, containersPath []string) []chartValue {
+	containerPath := append(append([]string{}, containersPath...), "0")
+	field := func(path ...string) []string {
+		return append(append([]string{}, containerPath...), path...)
+	}
+
+	values := []chartValue{}
+	if replicas != nil {
+		values = append(values, chartValue{path: []string{"spec", "replicas"}, key: []string{"replicas"}, value: int64(*replicas)})
+	}
+	values = append(values, chartValue{path: field("image"), key: []string{"image"}, value: container.Image, quote: true})
+
+	resourceKeys := map[corev1.ResourceName]string{
+		corev1.ResourceCPU:              "cpu",
+		corev1.ResourceMemory:           "memory",
+		corev1.ResourceEphemeralStorage: "disk",
+	}
+	for _, kind := range []string{"requests", "limits"} {
+		list := container.Resources.Requests
+		if kind == "limits" {
+			list = container.Resources.Limits
+		}
+		for name, key := range resourceKeys {
+			if q, ok := list[name]; ok {
+				values = append(values, chartValue{
+					path:  field("resources", kind, string(name)),
+					key:   []string{"resources", kind, key},
+					value: q.String(),
+					quote: true,
+				})
+			}
+		}
+	}
+
+	for i, env := range container.Env {
+		if env.ValueFrom != nil {
+			continue
+		}
+		values = append(values, chartValue{
+			path:  field("env", fmt.Sprint(i), "value"),
+			key:   []string{"env", env.Name},
+			value: env.Value,
+			quote: true,
+		})
+	}
+
+	return values
+}
+
+func secretValues(secret *corev1.Secret) []chartValue {
+	values := []chartValue{}
+	for key := range secret.StringData {
+		values = append(values, chartValue{
+			path:  []string{"stringData", key},
+			key:   []string{"secrets", key},
+			value: "",
+			quote: true,
+		})
+	}
+	return values
+}
+
+func renderExport(name, format string, objects []exportObject) (*Export, error) {
+	switch format {
+	case "", ExportYAML:
+		docs := []string{}
+		for _, obj := range objects {
+			data, err := yaml.Marshal(obj.object)
+			if err != nil {
+				return nil, fmt.Errorf("failed to encode %s: %v", obj.name, err)
+			}
+			docs = append(docs, string(data))
+		}
+		return &Export{
+			Data:        []byte(strings.Join(docs, "---\n")),
+			ContentType: "application/yaml",
+			FileName:    name + ".yaml",
+		}, nil
+
+	case ExportHelm:
+		data, err := helmChart(name, objects)
+		if err != nil {
+			return nil, err
+		}
+		return &Export{
+			Data:        data,
+			ContentType: "application/gzip",
+			FileName:    fmt.Sprintf("%s-%s.tgz", name, chartVersion),
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported export format %q, expected %s or %s", format, ExportYAML, ExportHelm)
+	}
+}
+
+// helmChart packages the objects as a chart, with the chart values replacing the
+// fields they were extracted from.
+func helmChart(name string, objects []exportObject) ([]byte, error) {
+	values := map[string]any{}
+	files := map[string][]byte{}
+
+	for _, obj := range objects {
+		// the fields are replaced by placeholders, which are swapped for the
+		// template expressions once the object is encoded
+		placeholders := map[string]string{}
+		for i, v := range obj.values {
+			placeholder := fmt.Sprintf("__kaas_value_%s_%d__", obj.name, i)
+			if !setField(obj.object, v.path, placeholder) {
+				continue
+			}
+			expr := valueExpr(v.key)
+			if v.quote {
+				expr += " | quote"
+			}
+			placeholders[placeholder] = "{{ " + expr + " }}"
+			if err := unstructured.SetNestedField(values, v.value, v.key...); err != nil {
+				return nil, fmt.Errorf("failed to set chart value %s: %v", strings.Join(v.key, "."), err)
+			}
+		}
+
+		data, err := yaml.Marshal(obj.object)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %s: %v", obj.name, err)
+		}
+		template := string(data)
+		for placeholder, expr := range placeholders {
+			template = strings.ReplaceAll(template, placeholder, expr)
+		}
+		files["templates/"+obj.name+".yaml"] = []byte(template)
+	}
+
+	valuesData, err := yaml.Marshal(values)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode chart values: %v", err)
+	}
+	files["values.yaml"] = valuesData
+	files["Chart.yaml"] = []byte(fmt.Sprintf(
+		"apiVersion: v2\nname: %s\ndescription: %s exported from KaaS\ntype: application\nversion: %s\n",
+		name, name, chartVersion))
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	paths := []string{}
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	now := time.Now()
+	for _, path := range paths {
+		header := &tar.Header{
+			Name:    name + "/" + path,
+			Mode:    0644,
+			Size:    int64(len(files[path])),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return nil, fmt.Errorf("failed to write chart: %v", err)
+		}
+		if _, err := tw.Write(files[path]); err != nil {
+			return nil, fmt.Errorf("failed to write chart: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write chart: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write chart: %v", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// setField sets the field at path, where list items are addressed by their
+// index. It returns false if the path doesn't exist.
+func setField(object map[string]any, path []string, value any) bool {
+	var current any = object
+	for i, key := range path {
+		last := i == len(path)-1
+		switch node := current.(type) {
+		case map[string]any:
+			if _, ok := node[key]; !ok {
+				return false
+			}
+			if last {
+				node[key] = value
+				return true
+			}
+			current = node[key]
+		case []any:
+			var index int
+			if _, err := fmt.Sscan(key, &index); err != nil || index < 0 || index >= len(node) {
+				return false
+			}
+			if last {
+				node[index] = value
+				return true
+			}
+			current = node[index]
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// valueExpr returns the template expression of a value key. Keys that aren't
+// identifiers, such as environment variable names with dashes, are looked up with index.
+func valueExpr(key []string) string {
+	for _, k := range key {
+		if !isIdentifier(k) {
+			quoted := []string{}
+			for _, k := range key {
+				quoted = append(quoted, strconv.Quote(k))
+			}
+			return "index .Values " + strings.Join(quoted, " ")
+		}
+	}
+	return ".Values." + strings.Join(key, ".")
+}
+
+func isIdentifier(s string) bool {
+	for i, r := range s {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || i > 0 && r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,119 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// ExternalAccessConf is how databases with external access are reached, read
+// from the external.* keys of db-request-config.
+type ExternalAccessConf struct {
+	// ServiceType is NodePort or LoadBalancer, defaults to NodePort
+	ServiceType corev1.ServiceType
+	// AddressTypes are the node addresses tried in order, defaults to ExternalIP then InternalIP
+	AddressTypes []corev1.NodeAddressType
+	// NodeSelector is a label selector of the nodes whose address is returned, all nodes if empty
+	NodeSelector string
+}
+
+func parseExternalAccess(data map[string]string) ExternalAccessConf {
+	conf := ExternalAccessConf{
+		ServiceType:  corev1.ServiceType(data["external.serviceType"]),
+		NodeSelector: data["external.nodeSelector"],
+	}
+	if conf.ServiceType != corev1.ServiceTypeLoadBalancer {
+		conf.ServiceType = corev1.ServiceTypeNodePort
+	}
+	for _, t := range strings.Split(data["external.addressTypes"], ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			conf.AddressTypes = append(conf.AddressTypes, corev1.NodeAddressType(t))
+		}
+	}
+	if len(conf.AddressTypes) == 0 {
+		conf.AddressTypes = []corev1.NodeAddressType{corev1.NodeExternalIP, corev1.NodeInternalIP}
+	}
+	return conf
+}
+
+func isExternal(service *corev1.Service) bool {
+	return service.Spec.Type == corev1.ServiceTypeNodePort || service.Spec.Type == corev1.ServiceTypeLoadBalancer
+}
+
+// externalAddress returns the host and port clients outside the cluster reach
+// the service at. The address of a load balancer that isn't provisioned yet is empty.
+func (c *ClusterManager) externalAddress(ctx context.Context, service *corev1.Service) (string, int32, error) {
+	if service.Spec.Type == corev1.ServiceTypeLoadBalancer {
+		for _, ingress := range service.Status.LoadBalancer.Ingress {
+			if ingress.IP != "" {
+				return ingress.IP, service.Spec.Ports[0].Port, nil
+			}
+			if ingress.Hostname != "" {
+				return ingress.Hostname, service.Spec.Ports[0].Port, nil
+			}
+		}
+		return "", 0, nil
+	}
+
+	ip, err := c.nodeAddress(ctx)
+	if err != nil {
+		return "", 0, err
+	}
+	return ip, service.Spec.Ports[0].NodePort, nil
+}
+
+// nodeAddress returns the first address of the preferred type among the ready
+// nodes matching the node selector, in the order of their names.
+func (c *ClusterManager) nodeAddress(ctx context.Context) (string, error) {
+	conf := c.DBConf.External
+	if _, err := labels.Parse(conf.NodeSelector); err != nil {
+		return "", fmt.Errorf("invalid node selector %q: %v", conf.NodeSelector, err)
+	}
+	nodes, err := c.Clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{LabelSelector: conf.NodeSelector})
+	if err != nil {
+		return "", fmt.Errorf("failed to list nodes: %v", err)
+	}
+	sort.Slice(nodes.Items, func(i, j int) bool { return nodes.Items[i].Name < nodes.Items[j].Name })
+
+	addressTypes := conf.AddressTypes
+	if len(addressTypes) == 0 {
+		addressTypes = []corev1.NodeAddressType{corev1.NodeExternalIP, corev1.NodeInternalIP}
+	}
+	for _, addressType := range addressTypes {
+		for _, node := range nodes.Items {
+			if !nodeReady(&node) {
+				continue
+			}
+			for _, address := range node.Status.Addresses {
+				if address.Type == addressType {
+					return address.Address, nil
+				}
+			}
+		}
+	}
+
+	types := []string{}
+	for _, t := range addressTypes {
+		types = append(types, string(t))
+	}
+	if conf.NodeSelector != "" {
+		return "", fmt.Errorf("no ready node matching %q has an address of type %s", conf.NodeSelector, strings.Join(types, " or "))
+	}
+	return "", fmt.Errorf("no ready node has an address of type %s", strings.Join(types, " or "))
+}
+
+// nodeReady reports whether the node is ready. Nodes that don't report their
+// conditions are taken as ready.
+func nodeReady(node *corev1.Node) bool {
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == corev1.NodeReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return true
+}
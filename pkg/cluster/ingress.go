@@ -0,0 +1,942 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/SepehrNoey/KaaS/api"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	IngressModeShared    = "shared"    // rules of every app are added to AppConf.IngressName
+	IngressModeDedicated = "dedicated" // every app gets an ingress of its own, owned by its deployment
+
+	rewriteTargetAnnotation = "nginx.ingress.kubernetes.io/rewrite-target"
+	sslRedirectAnnotation   = "nginx.ingress.kubernetes.io/ssl-redirect"
+
+	// tlsAppsAnnotation holds the TLS entries each app added to the shared
+	// ingress, so they are removed together with the paths of the app.
+	tlsAppsAnnotation = "kaas.io/tls-apps"
+)
+
+// appRouting is what an app adds to an ingress.
+type appRouting struct {
+	rules       []netv1.IngressRule
+	tls         []netv1.IngressTLS
+	annotations map[string]string
+}
+
+// ConflictError is returned when a route of an app is already claimed by another app.
+type ConflictError struct {
+	Host string
+	Path string
+	App  string // empty if the route belongs to another tenant
+}
+
+func (e *ConflictError) Error() string {
+	if e.App == "" {
+		return fmt.Sprintf("route %s%s is already owned by another tenant", e.Host, e.Path)
+	}
+	return fmt.Sprintf("route %s%s is already owned by app %s", e.Host, e.Path, e.App)
+}
+
+// TLSConflictError is returned when a host of an app is already served with
+// the certificate of another secret in the shared ingress.
+type TLSConflictError struct {
+	Host       string
+	SecretName string
+	App        string
+}
+
+func (e *TLSConflictError) Error() string {
+	return fmt.Sprintf("host %s is already served with TLS secret %s of app %s", e.Host, e.SecretName, e.App)
+}
+
+// buildRouting builds the routing of the app. If the app brings its own
+// certificate, the TLS secret that has to be created is returned too.
+// Annotations, including ssl-redirect, apply to every path of an ingress, so
+// they're only allowed on dedicated ingresses.
+func (c *ClusterManager) buildRouting(ctx context.Context, appreq *api.AppRequest, ports []api.AppPort, mode string) (*appRouting, *corev1.Secret, error) {
+	if mode == IngressModeShared && appreq.Ingress != nil && (appreq.Ingress.Rewrite != "" || len(appreq.Ingress.Annotations) > 0) {
+		return nil, nil, fmt.Errorf("path rewrites and ingress annotations require the %s ingress mode", IngressModeDedicated)
+	}
+
+	ingPort, err := ingressPort(ports)
+	if err != nil {
+		return nil, nil, err
+	}
+	rules, err := ingressRules(appreq, ports, ingPort)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	routing := &appRouting{
+		rules:       rules,
+		annotations: ingressAnnotations(appreq),
+	}
+	if appreq.TLS == nil {
+		return routing, nil, nil
+	}
+
+	tls, secret, err := c.appTLS(ctx, appreq, rules)
+	if err != nil {
+		return nil, nil, err
+	}
+	routing.tls = tls
+	if appreq.TLS.SSLRedirect != nil {
+		if mode == IngressModeShared {
+			return nil, nil, fmt.Errorf("ssl_redirect requires the %s ingress mode", IngressModeDedicated)
+		}
+		routing.annotations[sslRedirectAnnotation] = strconv.FormatBool(*appreq.TLS.SSLRedirect)
+	}
+
+	return routing, secret, nil
+}
+
+// ingressRules builds the ingress rules of the app. Without an ingress section,
+// DomainAddress/ is routed to defPort, which is also used by paths that don't name a port.
+func ingressRules(appreq *api.AppRequest, ports []api.AppPort, defPort api.AppPort) ([]netv1.IngressRule, error) {
+	reqRules := []api.IngressRule{{}}
+	if appreq.Ingress != nil && len(appreq.Ingress.Rules) > 0 {
+		reqRules = appreq.Ingress.Rules
+	}
+
+	rules := []netv1.IngressRule{}
+	seen := map[string]bool{}
+	for _, r := range reqRules {
+		host := r.Host
+		if host == "" {
+			host = appreq.DomainAddress
+		}
+		if host == "" {
+			return nil, fmt.Errorf("ingress host is required, set domain_address or the rule host")
+		}
+
+		reqPaths := r.Paths
+		if len(reqPaths) == 0 {
+			reqPaths = []api.IngressPath{{}}
+		}
+
+		paths := []netv1.HTTPIngressPath{}
+		for _, p := range reqPaths {
+			path := p.Path
+			if path == "" {
+				path = "/"
+			}
+			if !strings.HasPrefix(path, "/") {
+				return nil, fmt.Errorf("ingress path %q must start with /", path)
+			}
+
+			var pathType netv1.PathType
+			switch strings.ToLower(p.PathType) {
+			case "", "prefix":
+				pathType = netv1.PathTypePrefix
+			case "exact":
+				pathType = netv1.PathTypeExact
+			default:
+				return nil, fmt.Errorf("unsupported path type %q for path %s", p.PathType, path)
+			}
+
+			if seen[host+path] {
+				return nil, fmt.Errorf("duplicate ingress path %s%s", host, path)
+			}
+			seen[host+path] = true
+
+			port := defPort
+			if p.Port != "" {
+				var err error
+				port, err = findPort(ports, p.Port)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			paths = append(paths, netv1.HTTPIngressPath{
+				Path:     path,
+				PathType: &pathType,
+				Backend: netv1.IngressBackend{
+					Service: &netv1.IngressServiceBackend{
+						Name: appreq.Name,
+						Port: serviceBackendPort(port),
+					},
+				},
+			})
+		}
+
+		rules = append(rules, netv1.IngressRule{
+			Host: host,
+			IngressRuleValue: netv1.IngressRuleValue{
+				HTTP: &netv1.HTTPIngressRuleValue{Paths: paths},
+			},
+		})
+	}
+
+	return rules, nil
+}
+
+// findPort resolves a port reference, which is either a port name or a service port number.
+func findPort(ports []api.AppPort, ref string) (api.AppPort, error) {
+	number, numErr := strconv.ParseInt(ref, 10, 32)
+	for _, p := range ports {
+		if p.Name == ref || (numErr == nil && p.ServicePort == int32(number)) {
+			return p, nil
+		}
+	}
+	return api.AppPort{}, fmt.Errorf("ingress port %q is not a port of the app", ref)
+}
+
+func ingressAnnotations(appreq *api.AppRequest) map[string]string {
+	annotations := map[string]string{}
+	if appreq.Ingress == nil {
+		return annotations
+	}
+	for key, value := range appreq.Ingress.Annotations {
+		annotations[key] = value
+	}
+	if appreq.Ingress.Rewrite != "" {
+		annotations[rewriteTargetAnnotation] = appreq.Ingress.Rewrite
+	}
+	return annotations
+}
+
+// checkRoutes returns a ConflictError if one of the paths of rules is routed to
+// anything but the service of app in namespace by one of the ingresses.
+func checkRoutes(ingresses []netv1.Ingress, namespace, app string, rules []netv1.IngressRule) error {
+	for _, rule := range rules {
+		for _, path := range rule.HTTP.Paths {
+			for i := range ingresses {
+				owner, ok := routeOwner(&ingresses[i], rule.Host, path.Path)
+				if !ok {
+					continue
+				}
+				if ingresses[i].Namespace != namespace {
+					return &ConflictError{Host: rule.Host, Path: path.Path}
+				}
+				if owner != app {
+					return &ConflictError{Host: rule.Host, Path: path.Path, App: owner}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func routeOwner(ingress *netv1.Ingress, host, path string) (string, bool) {
+	for _, rule := range ingress.Spec.Rules {
+		if rule.Host != host || rule.HTTP == nil {
+			continue
+		}
+		for _, p := range rule.HTTP.Paths {
+			if p.Path == path && p.Backend.Service != nil {
+				return p.Backend.Service.Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// mergeRules adds the paths of the new rules to the existing rules of the same host,
+// so several apps can share one domain. Paths already present are skipped, which
+// keeps retried deployments from adding duplicates.
+func mergeRules(ingress *netv1.Ingress, rules []netv1.IngressRule) {
+	for _, rule := range rules {
+		paths := []netv1.HTTPIngressPath{}
+		for _, path := range rule.HTTP.Paths {
+			if _, ok := routeOwner(ingress, rule.Host, path.Path); !ok {
+				paths = append(paths, path)
+			}
+		}
+		if len(paths) == 0 {
+			continue
+		}
+
+		merged := false
+		for i := range ingress.Spec.Rules {
+			existing := &ingress.Spec.Rules[i]
+			if existing.Host == rule.Host && existing.HTTP != nil {
+				existing.HTTP.Paths = append(existing.HTTP.Paths, paths...)
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			rule.HTTP.Paths = paths
+			ingress.Spec.Rules = append(ingress.Spec.Rules, rule)
+		}
+	}
+}
+
+// ingressRoutes lists the host/path to app mappings of the ingress.
+func ingressRoutes(ingress *netv1.Ingress) []api.Route {
+	routes := []api.Route{}
+	for _, rule := range ingress.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, p := range rule.HTTP.Paths {
+			if p.Backend.Service == nil {
+				continue
+			}
+			route := api.Route{
+				Host:    rule.Host,
+				Path:    p.Path,
+				App:     p.Backend.Service.Name,
+				Port:    p.Backend.Service.Port.Name,
+				Ingress: ingress.Name,
+			}
+			if p.PathType != nil {
+				route.PathType = string(*p.PathType)
+			}
+			if route.Port == "" {
+				route.Port = strconv.FormatInt(int64(p.Backend.Service.Port.Number), 10)
+			}
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+func (c *ClusterManager) getIngress(ctx context.Context) (*netv1.Ingress, error) {
+	namespace := c.namespace(ctx)
+	ingress, err := c.Clientset.NetworkingV1().Ingresses(namespace).Get(ctx, c.AppConf.IngressName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Ingress resource: %v", err)
+	}
+	return ingress, nil
+}
+
+// ingressMode returns the ingress mode of the app, falling back to the one in kaas-config.
+func (c *ClusterManager) ingressMode(appreq *api.AppRequest) (string, error) {
+	mode := c.AppConf.IngressMode
+	if appreq.Ingress != nil && appreq.Ingress.Mode != "" {
+		mode = appreq.Ingress.Mode
+	}
+
+	switch mode {
+	case "", IngressModeShared:
+		return IngressModeShared, nil
+	case IngressModeDedicated:
+		return IngressModeDedicated, nil
+	default:
+		return "", fmt.Errorf("unsupported ingress mode %q", mode)
+	}
+}
+
+// managedIngresses returns the shared ingress of the namespace, if it exists,
+// and the dedicated ingresses of apps.
+func (c *ClusterManager) managedIngresses(ctx context.Context, namespace string) ([]netv1.Ingress, error) {
+	ingClient := c.Clientset.NetworkingV1().Ingresses(namespace)
+
+	ingresses := []netv1.Ingress{}
+	shared, err := ingClient.Get(ctx, c.AppConf.IngressName, metav1.GetOptions{})
+	if err == nil {
+		ingresses = append(ingresses, *shared)
+	} else if !apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to get Ingress resource: %v", err)
+	}
+
+	dedicated, err := ingClient.List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", managedByLabel, managedByValue),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Ingress resources: %v", err)
+	}
+	for _, ingress := range dedicated.Items {
+		if ingress.Name != c.AppConf.IngressName {
+			ingresses = append(ingresses, ingress)
+		}
+	}
+
+	return ingresses, nil
+}
+
+// routedIngresses returns the ingresses managed by KaaS in every namespace. Ingress
+// controllers merge the rules of all of them, so routes are checked against all.
+func (c *ClusterManager) routedIngresses(ctx context.Context) ([]netv1.Ingress, error) {
+	// the shared ingress of kaas-config isn't created by KaaS, so it has no label
+	ingresses, err := c.managedIngresses(ctx, c.AppConf.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	labeled, err := c.Clientset.NetworkingV1().Ingresses(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", managedByLabel, managedByValue),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Ingress resources: %v", err)
+	}
+	for _, ingress := range labeled.Items {
+		if ingress.Namespace != c.AppConf.Namespace {
+			ingresses = append(ingresses, ingress)
+		}
+	}
+
+	return ingresses, nil
+}
+
+// checkIngress verifies that the routes of an app aren't claimed by another
+// app, so conflicts are reported before anything is created.
+func (c *ClusterManager) checkIngress(ctx context.Context, app string, routing *appRouting) error {
+	namespace := c.namespace(ctx)
+	ingresses, err := c.routedIngresses(ctx)
+	if err != nil {
+		return err
+	}
+	return checkRoutes(ingresses, namespace, app, routing.rules)
+}
+
+func (c *ClusterManager) GetRoutes(ctx context.Context) ([]api.Route, error) {
+	ingresses, err := c.managedIngresses(ctx, c.namespace(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	routes := []api.Route{}
+	for i := range ingresses {
+		routes = append(routes, ingressRoutes(&ingresses[i])...)
+	}
+	return routes, nil
+}
+
+// updateIngress sets the routing of the app in the shared ingress, replacing the
+// paths the app had before, and creates the ingress if the namespace doesn't
+// have one yet. The ingress is re-read and the change re-applied whenever the
+// update hits a conflict, so concurrent deployments don't overwrite each
+// other's rules.
+func (c *ClusterManager) updateIngress(ctx context.Context, app string, routing *appRouting) error {
+	c.ingressMu.Lock()
+	defer c.ingressMu.Unlock()
+
+	namespace := c.namespace(ctx)
+	ingClient := c.Clientset.NetworkingV1().Ingresses(namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		ingresses, err := c.routedIngresses(ctx)
+		if err != nil {
+			return err
+		}
+		if err := checkRoutes(ingresses, namespace, app, routing.rules); err != nil {
+			return err
+		}
+
+		ingress, err := ingClient.Get(ctx, c.AppConf.IngressName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			ingress = sharedIngress(c.AppConf.IngressName, namespace, c.AppConf.IngressClassName, routing)
+			setSharedTLS(ingress, app, routing.tls)
+			createdIngress, err := ingClient.Create(ctx, ingress, createOptions(ctx))
+			if apierrors.IsAlreadyExists(err) {
+				// created by another replica in the meantime, retried as a conflict
+				return apierrors.NewConflict(netv1.Resource("ingresses"), ingress.Name, err)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to create Ingress resource: %v", err)
+			}
+			created(ctx, createdIngress)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get Ingress resource: %v", err)
+		}
+
+		// updating rules
+		ingress.Spec.Rules, _ = withoutPaths(ingress.Spec.Rules, func(name string) bool { return name == app })
+		mergeRules(ingress, routing.rules)
+		if err := checkSharedTLS(ingress, app, routing.tls); err != nil {
+			return err
+		}
+		setSharedTLS(ingress, app, routing.tls)
+
+		ingress, err = ingClient.Update(ctx, ingress, updateOptions(ctx))
+		if err != nil {
+			if apierrors.IsConflict(err) {
+				return err
+			}
+			return fmt.Errorf("failed to update Ingress resource: %v", err)
+		}
+		updated(ctx, ingress)
+
+		return nil
+	})
+}
+
+func sharedIngress(name, namespace, className string, routing *appRouting) *netv1.Ingress {
+	ingress := &netv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels: map[string]string{
+				managedByLabel: managedByValue,
+			},
+		},
+		Spec: netv1.IngressSpec{
+			Rules: routing.rules,
+			TLS:   routing.tls,
+		},
+	}
+	if className != "" {
+		ingress.Spec.IngressClassName = &className
+	}
+	return ingress
+}
+
+// createAppIngress creates the dedicated ingress of an app. The deployment owns
+// the ingress, so it's garbage collected together with the app.
+func (c *ClusterManager) createAppIngress(ctx context.Context, appreq *api.AppRequest, owner *appsv1.Deployment, routing *appRouting) error {
+	c.ingressMu.Lock()
+	defer c.ingressMu.Unlock()
+
+	// routes are checked again, another app may have claimed them in the meantime
+	namespace := c.namespace(ctx)
+	ingresses, err := c.routedIngresses(ctx)
+	if err != nil {
+		return err
+	}
+	if err := checkRoutes(ingresses, namespace, appreq.Name, routing.rules); err != nil {
+		return err
+	}
+
+	className := c.AppConf.IngressClassName
+	if appreq.Ingress != nil && appreq.Ingress.ClassName != "" {
+		className = appreq.Ingress.ClassName
+	}
+
+	ingress := appIngress(appreq.Name, namespace, className, routing, owner)
+	ingress, err = c.Clientset.NetworkingV1().Ingresses(namespace).Create(ctx, ingress, createOptions(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to create Ingress resource: %v", err)
+	}
+	created(ctx, ingress)
+
+	return nil
+}
+
+func appIngress(name, namespace, className string, routing *appRouting, owner *appsv1.Deployment) *netv1.Ingress {
+	ingress := &netv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels: map[string]string{
+				"app":          name,
+				managedByLabel: managedByValue,
+			},
+			Annotations: routing.annotations,
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(owner, appsv1.SchemeGroupVersion.WithKind("Deployment")),
+			},
+		},
+		Spec: netv1.IngressSpec{
+			Rules: routing.rules,
+			TLS:   routing.tls,
+		},
+	}
+	if className != "" {
+		ingress.Spec.IngressClassName = &className
+	}
+	return ingress
+}
+
+// MigrateIngress moves the rules of every app out of the shared ingress into a
+// dedicated ingress of its own. The annotations and class of the shared ingress
+// are copied, so routing of the migrated apps stays the same.
+func (c *ClusterManager) MigrateIngress(ctx context.Context) (*api.IngressMigration, error) {
+	c.ingressMu.Lock()
+	defer c.ingressMu.Unlock()
+
+	namespace := c.namespace(ctx)
+	ingClient := c.Clientset.NetworkingV1().Ingresses(namespace)
+	shared, err := c.getIngress(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// grouping the paths of the shared ingress by the app they route to
+	apps := []string{}
+	appRules := map[string][]netv1.IngressRule{}
+	for _, rule := range shared.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			if path.Backend.Service == nil {
+				continue
+			}
+			app := path.Backend.Service.Name
+			if _, ok := appRules[app]; !ok {
+				apps = append(apps, app)
+			}
+			appRules[app] = mergedRule(appRules[app], rule.Host, path)
+		}
+	}
+
+	annotations := map[string]string{}
+	for key, value := range shared.Annotations {
+		if key != corev1.LastAppliedConfigAnnotation && key != tlsAppsAnnotation {
+			annotations[key] = value
+		}
+	}
+	appsTLS := sharedTLSApps(shared)
+	className := c.AppConf.IngressClassName
+	if shared.Spec.IngressClassName != nil {
+		className = *shared.Spec.IngressClassName
+	}
+
+	result := &api.IngressMigration{Migrated: []string{}, Skipped: []string{}}
+	migrated := map[string]bool{}
+	for _, app := range apps {
+		if app == c.AppConf.IngressName {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("%s: app has the name of the shared ingress", app))
+			continue
+		}
+
+		deployment, err := c.Clientset.AppsV1().Deployments(namespace).Get(ctx, app, metav1.GetOptions{})
+		if err != nil {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("%s: failed to get deployment: %v", app, err))
+			continue
+		}
+
+		tls, ok := appsTLS[app]
+		if !ok {
+			// added before the TLS entries of apps were tracked
+			tls = hostsTLS(shared.Spec.TLS, appRules[app])
+		}
+		routing := &appRouting{
+			rules:       appRules[app],
+			tls:         tls,
+			annotations: annotations,
+		}
+		ingress := appIngress(app, namespace, className, routing, deployment)
+		ingress, err = ingClient.Create(ctx, ingress, createOptions(ctx))
+		if err != nil {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("%s: failed to create Ingress resource: %v", app, err))
+			continue
+		}
+
+		created(ctx, ingress)
+		migrated[app] = true
+		result.Migrated = append(result.Migrated, app)
+	}
+
+	if len(migrated) == 0 {
+		return result, nil
+	}
+
+	// removing the migrated paths from the shared ingress
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		ingress, err := c.getIngress(ctx)
+		if err != nil {
+			return err
+		}
+
+		ingress.Spec.Rules, _ = withoutPaths(ingress.Spec.Rules, func(app string) bool { return migrated[app] })
+		for app := range migrated {
+			setSharedTLS(ingress, app, nil)
+		}
+		return c.saveSharedIngress(ctx, ingress)
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to remove migrated rules from Ingress resource: %v", err)
+	}
+
+	return result, nil
+}
+
+// withoutPaths returns the rules without the paths routed to the apps matched by
+// drop, and whether any path was removed. Rules left without paths are dropped.
+func withoutPaths(rules []netv1.IngressRule, drop func(app string) bool) ([]netv1.IngressRule, bool) {
+	result := []netv1.IngressRule{}
+	removed := false
+	for _, rule := range rules {
+		if rule.HTTP != nil {
+			paths := []netv1.HTTPIngressPath{}
+			for _, path := range rule.HTTP.Paths {
+				if path.Backend.Service != nil && drop(path.Backend.Service.Name) {
+					removed = true
+					continue
+				}
+				paths = append(paths, path)
+			}
+			if len(paths) == 0 {
+				continue
+			}
+			rule.HTTP = &netv1.HTTPIngressRuleValue{Paths: paths}
+		}
+		result = append(result, rule)
+	}
+	return result, removed
+}
+
+// saveSharedIngress updates the shared ingress, or deletes it if it's left
+// without rules, since an ingress needs either rules or a default backend.
+func (c *ClusterManager) saveSharedIngress(ctx context.Context, ingress *netv1.Ingress) error {
+	ingClient := c.Clientset.NetworkingV1().Ingresses(ingress.Namespace)
+	if len(ingress.Spec.Rules) == 0 && ingress.Spec.DefaultBackend == nil {
+		options := deleteOptions(ctx)
+		options.Preconditions = &metav1.Preconditions{ResourceVersion: &ingress.ResourceVersion}
+		return ingClient.Delete(ctx, ingress.Name, options)
+	}
+
+	ingress, err := ingClient.Update(ctx, ingress, updateOptions(ctx))
+	if err != nil {
+		return err
+	}
+	updated(ctx, ingress)
+	return nil
+}
+
+// removeSharedRoutes removes the paths of the app from the shared ingress.
+func (c *ClusterManager) removeSharedRoutes(ctx context.Context, app string) error {
+	c.ingressMu.Lock()
+	defer c.ingressMu.Unlock()
+
+	namespace := c.namespace(ctx)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		ingress, err := c.Clientset.NetworkingV1().Ingresses(namespace).Get(ctx, c.AppConf.IngressName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var removed bool
+		ingress.Spec.Rules, removed = withoutPaths(ingress.Spec.Rules, func(name string) bool { return name == app })
+		if _, ok := sharedTLSApps(ingress)[app]; !removed && !ok {
+			return nil
+		}
+		setSharedTLS(ingress, app, nil)
+		return c.saveSharedIngress(ctx, ingress)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove routes of app %s from Ingress resource: %v", app, err)
+	}
+	return nil
+}
+
+// updateAppIngress creates or updates the dedicated ingress of an app.
+func (c *ClusterManager) updateAppIngress(ctx context.Context, appreq *api.AppRequest, owner *appsv1.Deployment, routing *appRouting) error {
+	c.ingressMu.Lock()
+	defer c.ingressMu.Unlock()
+
+	namespace := c.namespace(ctx)
+	ingClient := c.Clientset.NetworkingV1().Ingresses(namespace)
+	className := c.AppConf.IngressClassName
+	if appreq.Ingress != nil && appreq.Ingress.ClassName != "" {
+		className = appreq.Ingress.ClassName
+	}
+	desired := appIngress(appreq.Name, namespace, className, routing, owner)
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		ingresses, err := c.routedIngresses(ctx)
+		if err != nil {
+			return err
+		}
+		if err := checkRoutes(ingresses, namespace, appreq.Name, routing.rules); err != nil {
+			return err
+		}
+
+		ingress, err := ingClient.Get(ctx, appreq.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			ingress, err := ingClient.Create(ctx, desired, createOptions(ctx))
+			if err != nil {
+				return fmt.Errorf("failed to create Ingress resource: %v", err)
+			}
+			created(ctx, ingress)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get Ingress resource: %v", err)
+		}
+		if ingress.Labels["app"] != appreq.Name || ingress.Labels[managedByLabel] != managedByValue {
+			return fmt.Errorf("ingress %s isn't the ingress of app %s", ingress.Name, appreq.Name)
+		}
+
+		ingress.Labels = desired.Labels
+		ingress.Annotations = desired.Annotations
+		ingress.OwnerReferences = desired.OwnerReferences
+		ingress.Spec = desired.Spec
+		ingress, err = ingClient.Update(ctx, ingress, updateOptions(ctx))
+		if err != nil {
+			return err
+		}
+		updated(ctx, ingress)
+		return nil
+	})
+}
+
+// deleteAppIngress deletes the dedicated ingress of an app, if it has one.
+func (c *ClusterManager) deleteAppIngress(ctx context.Context, app string) error {
+	ingClient := c.Clientset.NetworkingV1().Ingresses(c.namespace(ctx))
+	ingress, err := ingClient.Get(ctx, app, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get Ingress resource: %v", err)
+	}
+	// the shared ingress may have the name of an app
+	if ingress.Labels["app"] != app || ingress.Labels[managedByLabel] != managedByValue {
+		return nil
+	}
+
+	err = ingClient.Delete(ctx, app, deleteOptions(ctx))
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete Ingress resource: %v", err)
+	}
+	return nil
+}
+
+// mergedRule adds the path to the rule of host, creating the rule if needed.
+func mergedRule(rules []netv1.IngressRule, host string, path netv1.HTTPIngressPath) []netv1.IngressRule {
+	for i := range rules {
+		if rules[i].Host == host {
+			rules[i].HTTP.Paths = append(rules[i].HTTP.Paths, path)
+			return rules
+		}
+	}
+	return append(rules, netv1.IngressRule{
+		Host: host,
+		IngressRuleValue: netv1.IngressRuleValue{
+			HTTP: &netv1.HTTPIngressRuleValue{Paths: []netv1.HTTPIngressPath{path}},
+		},
+	})
+}
+
+// mergeTLS adds the TLS entries that aren't in the ingress yet.
+func mergeTLS(ingress *netv1.Ingress, entries []netv1.IngressTLS) {
+	for _, entry := range entries {
+		if !slices.ContainsFunc(ingress.Spec.TLS, func(existing netv1.IngressTLS) bool {
+			return equalTLS(existing, entry)
+		}) {
+			ingress.Spec.TLS = append(ingress.Spec.TLS, entry)
+		}
+	}
+}
+
+func equalTLS(a, b netv1.IngressTLS) bool {
+	return a.SecretName == b.SecretName && slices.Equal(a.Hosts, b.Hosts)
+}
+
+// sharedTLSApps returns the TLS entries each app added to the shared ingress.
+func sharedTLSApps(ingress *netv1.Ingress) map[string][]netv1.IngressTLS {
+	apps := map[string][]netv1.IngressTLS{}
+	data, ok := ingress.Annotations[tlsAppsAnnotation]
+	if !ok {
+		return apps
+	}
+	if err := json.Unmarshal([]byte(data), &apps); err != nil {
+		log.Printf("ingress %s: ignoring invalid %s annotation: %v", ingress.Name, tlsAppsAnnotation, err)
+		return map[string][]netv1.IngressTLS{}
+	}
+	return apps
+}
+
+// checkSharedTLS returns a TLSConflictError if a host of the entries is
+// already served by another app of the shared ingress with another secret.
+func checkSharedTLS(ingress *netv1.Ingress, app string, entries []netv1.IngressTLS) error {
+	for other, otherEntries := range sharedTLSApps(ingress) {
+		if other == app {
+			continue
+		}
+		for _, entry := range entries {
+			for _, existing := range otherEntries {
+				if existing.SecretName == entry.SecretName {
+					continue
+				}
+				for _, host := range entry.Hosts {
+					if slices.Contains(existing.Hosts, host) {
+						return &TLSConflictError{Host: host, SecretName: existing.SecretName, App: other}
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// setSharedTLS replaces the TLS entries the app added to the shared ingress
+// with entries. Entries another app added too are kept. Entries that weren't
+// added by an app are dropped once the ingress no longer routes their hosts,
+// or when the app takes over one of their hosts.
+func setSharedTLS(ingress *netv1.Ingress, app string, entries []netv1.IngressTLS) {
+	apps := sharedTLSApps(ingress)
+	tracked := func(entry netv1.IngressTLS) bool {
+		for _, appEntries := range apps {
+			if slices.ContainsFunc(appEntries, func(e netv1.IngressTLS) bool { return equalTLS(e, entry) }) {
+				return true
+			}
+		}
+		return false
+	}
+	routed := func(host string) bool {
+		return slices.ContainsFunc(ingress.Spec.Rules, func(rule netv1.IngressRule) bool { return rule.Host == host })
+	}
+	takenOver := func(host string) bool {
+		return slices.ContainsFunc(entries, func(e netv1.IngressTLS) bool { return slices.Contains(e.Hosts, host) })
+	}
+
+	tls := []netv1.IngressTLS{}
+	for _, entry := range ingress.Spec.TLS {
+		if tracked(entry) {
+			continue
+		}
+		if len(entry.Hosts) > 0 && (!slices.ContainsFunc(entry.Hosts, routed) || slices.ContainsFunc(entry.Hosts, takenOver)) {
+			continue
+		}
+		tls = append(tls, entry)
+	}
+	ingress.Spec.TLS = tls
+
+	delete(apps, app)
+	if len(entries) > 0 {
+		apps[app] = entries
+	}
+	names := []string{}
+	for name := range apps {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		mergeTLS(ingress, apps[name])
+	}
+	if len(ingress.Spec.TLS) == 0 {
+		ingress.Spec.TLS = nil
+	}
+
+	if len(apps) == 0 {
+		delete(ingress.Annotations, tlsAppsAnnotation)
+		return
+	}
+	data, err := json.Marshal(apps)
+	if err != nil {
+		log.Printf("ingress %s: failed to encode %s annotation: %v", ingress.Name, tlsAppsAnnotation, err)
+		return
+	}
+	if ingress.Annotations == nil {
+		ingress.Annotations = map[string]string{}
+	}
+	ingress.Annotations[tlsAppsAnnotation] = string(data)
+}
+
+// hostsTLS returns the TLS entries that cover a host of the rules.
+func hostsTLS(entries []netv1.IngressTLS, rules []netv1.IngressRule) []netv1.IngressTLS {
+	result := []netv1.IngressTLS{}
+	for _, entry := range entries {
+		for _, rule := range rules {
+			if slices.Contains(entry.Hosts, rule.Host) {
+				result = append(result, entry)
+				break
+			}
+		}
+	}
+	return result
+}
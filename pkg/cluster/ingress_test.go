@@ -0,0 +1,313 @@
+package cluster
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SepehrNoey/KaaS/api"
+	netv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// ingressConflicts counts the conflicts the fake API server returned for ingress updates.
+type ingressConflicts struct {
+	mu       sync.Mutex
+	stale    int // updates with a stale resource version
+	injected int // updates rejected although they were up to date
+}
+
+// withIngressVersions makes the fake clientset reject updates of ingresses
+// with a stale resource version, like the API server does, and every
+// injectEvery-th update that would have succeeded, so clients have to retry
+// even when they don't race each other.
+func withIngressVersions(clientset *fake.Clientset, injectEvery int) *ingressConflicts {
+	conflicts := &ingressConflicts{}
+	version := 0
+	updates := 0
+	clientset.PrependReactor("*", "ingresses", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		conflicts.mu.Lock()
+		defer conflicts.mu.Unlock()
+
+		if action.GetVerb() != "create" && action.GetVerb() != "update" {
+			return false, nil, nil
+		}
+		ingress := action.(k8stesting.CreateAction).GetObject().(*netv1.Ingress).DeepCopy()
+		current, err := clientset.Tracker().Get(action.GetResource(), ingress.Namespace, ingress.Name)
+		if action.GetVerb() == "create" && err == nil {
+			return true, nil, apierrors.NewAlreadyExists(action.GetResource().GroupResource(), ingress.Name)
+		}
+		if action.GetVerb() == "update" {
+			if err != nil {
+				return true, nil, err
+			}
+			if current.(*netv1.Ingress).ResourceVersion != ingress.ResourceVersion {
+				conflicts.stale++
+				return true, nil, apierrors.NewConflict(action.GetResource().GroupResource(), ingress.Name, fmt.Errorf("stale resource version"))
+			}
+			updates++
+			if updates%injectEvery == 0 {
+				conflicts.injected++
+				return true, nil, apierrors.NewConflict(action.GetResource().GroupResource(), ingress.Name, fmt.Errorf("injected conflict"))
+			}
+		}
+
+		version++
+		ingress.ResourceVersion = strconv.Itoa(version)
+		if action.GetVerb() == "create" {
+			err = clientset.Tracker().Create(action.GetResource(), ingress, ingress.Namespace)
+		} else {
+			err = clientset.Tracker().Update(action.GetResource(), ingress, ingress.Namespace)
+		}
+		return true, ingress, err
+	})
+	return conflicts
+}
+
+// TestDeployAppConcurrentSharedIngress deploys apps through several cluster
+// managers over one API server, like replicas of KaaS, so their updates of the
+// shared ingress race each other and have to be retried on conflicts.
+func TestDeployAppConcurrentSharedIngress(t *testing.T) {
+	const apps, replicas = 50, 5
+	clientset := fake.NewSimpleClientset()
+	conflicts := withIngressVersions(clientset, 3)
+	managers := make([]*ClusterManager, replicas)
+	for i := range managers {
+		managers[i] = &ClusterManager{
+			Clientset: clientset,
+			AppConf:   AppCnfMap{IngressName: "kaas-ingress", IngressMode: IngressModeShared},
+		}
+	}
+	ctx := WithTenant(context.Background(), "team")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, apps)
+	for i := 0; i < apps; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- managers[i%replicas].DeployApp(ctx, &api.AppRequest{
+				Name:           fmt.Sprintf("app-%d", i),
+				Replicas:       1,
+				Image:          "nginx",
+				ImageTag:       "latest",
+				DomainAddress:  fmt.Sprintf("app-%d.example.com", i),
+				Port:           80,
+				Resources:      "100m,64Mi,100Mi",
+				ExternalAccess: true,
+			})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("DeployApp failed: %v", err)
+		}
+	}
+
+	if conflicts.injected == 0 {
+		t.Fatalf("no conflicts were injected, the updates weren't retried")
+	}
+	t.Logf("retried %d stale and %d injected conflicts", conflicts.stale, conflicts.injected)
+
+	ingress, err := clientset.NetworkingV1().Ingresses(managers[0].namespace(ctx)).Get(ctx, "kaas-ingress", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get shared ingress: %v", err)
+	}
+	if len(ingress.Spec.Rules) != apps {
+		t.Fatalf("shared ingress has %d rules, want %d", len(ingress.Spec.Rules), apps)
+	}
+	routed := map[string]bool{}
+	for _, route := range ingressRoutes(ingress) {
+		routed[route.App] = true
+	}
+	for i := 0; i < apps; i++ {
+		if name := fmt.Sprintf("app-%d", i); !routed[name] {
+			t.Errorf("app %s isn't routed by the shared ingress", name)
+		}
+	}
+}
+
+// testCertificate returns a self-signed PEM certificate and key for the hosts.
+func testCertificate(t *testing.T, hosts ...string) *api.AppTLS {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	return &api.AppTLS{
+		Cert: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		Key:  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+	}
+}
+
+func TestSharedIngressTLS(t *testing.T) {
+	c := &ClusterManager{
+		Clientset: fake.NewSimpleClientset(),
+		AppConf:   AppCnfMap{IngressName: "kaas-ingress", IngressMode: IngressModeShared},
+	}
+	ctx := WithTenant(context.Background(), "team")
+	app := func(name, host, path string, tls *api.AppTLS) *api.AppRequest {
+		return &api.AppRequest{
+			Name:           name,
+			Replicas:       1,
+			Image:          "nginx",
+			ImageTag:       "latest",
+			DomainAddress:  host,
+			Port:           80,
+			Resources:      "100m,64Mi,100Mi",
+			ExternalAccess: true,
+			Ingress:        &api.AppIngress{Rules: []api.IngressRule{{Paths: []api.IngressPath{{Path: path}}}}},
+			TLS:            tls,
+		}
+	}
+	secrets := func() []string {
+		t.Helper()
+		ingress, err := c.Clientset.NetworkingV1().Ingresses(c.namespace(ctx)).Get(ctx, "kaas-ingress", metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			t.Fatalf("failed to get shared ingress: %v", err)
+		}
+		hosts := map[string]bool{}
+		result := []string{}
+		for _, entry := range ingress.Spec.TLS {
+			for _, host := range entry.Hosts {
+				if hosts[host] {
+					t.Errorf("host %s has more than one TLS entry", host)
+				}
+				hosts[host] = true
+			}
+			result = append(result, entry.SecretName)
+		}
+		return result
+	}
+	apply := func(apps ...*api.AppRequest) {
+		t.Helper()
+		manifest := &api.Manifest{Environment: "test"}
+		for _, appreq := range apps {
+			manifest.Apps = append(manifest.Apps, *appreq)
+		}
+		result, err := c.Apply(ctx, manifest, false, false)
+		if err != nil {
+			t.Fatalf("Apply failed: %v", err)
+		}
+		if result.Error != "" {
+			t.Fatalf("Apply failed: %s", result.Error)
+		}
+	}
+
+	apply(app("a", "a.example.com", "/", testCertificate(t, "a.example.com")),
+		app("b", "b.example.com", "/", testCertificate(t, "b.example.com")))
+	if got := secrets(); !slices.Equal(got, []string{"a-tls", "b-tls"}) {
+		t.Fatalf("TLS secrets are %v, want [a-tls b-tls]", got)
+	}
+
+	// dropping tls
+	apply(app("a", "a.example.com", "/", nil), app("b", "b.example.com", "/", testCertificate(t, "b.example.com")))
+	if got := secrets(); !slices.Equal(got, []string{"b-tls"}) {
+		t.Fatalf("TLS secrets are %v after a dropped tls, want [b-tls]", got)
+	}
+
+	// moving b to another host
+	apply(app("a", "a.example.com", "/", nil), app("b", "www.example.com", "/", testCertificate(t, "www.example.com")))
+	ingress, err := c.Clientset.NetworkingV1().Ingresses(c.namespace(ctx)).Get(ctx, "kaas-ingress", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get shared ingress: %v", err)
+	}
+	if len(ingress.Spec.TLS) != 1 || !slices.Equal(ingress.Spec.TLS[0].Hosts, []string{"www.example.com"}) {
+		t.Fatalf("TLS entries are %v after a host change, want one for www.example.com", ingress.Spec.TLS)
+	}
+
+	// another certificate for a host already served by b
+	var conflict *TLSConflictError
+	err = c.DeployApp(ctx, app("c", "www.example.com", "/c", testCertificate(t, "www.example.com")))
+	if !errors.As(err, &conflict) || conflict.App != "b" {
+		t.Fatalf("DeployApp c returned %v, want a TLS conflict with app b", err)
+	}
+
+	if err := c.deleteApp(ctx, "b"); err != nil {
+		t.Fatalf("deleteApp failed: %v", err)
+	}
+	if got := secrets(); len(got) != 0 {
+		t.Fatalf("TLS secrets are %v after b was deleted, want none", got)
+	}
+}
+
+func TestMigrateIngressTLS(t *testing.T) {
+	c := &ClusterManager{
+		Clientset: fake.NewSimpleClientset(),
+		AppConf:   AppCnfMap{IngressName: "kaas-ingress", IngressMode: IngressModeShared},
+	}
+	ctx := WithTenant(context.Background(), "team")
+	err := c.DeployApp(ctx, &api.AppRequest{
+		Name:           "a",
+		Replicas:       1,
+		Image:          "nginx",
+		ImageTag:       "latest",
+		DomainAddress:  "a.example.com",
+		Port:           80,
+		Resources:      "100m,64Mi,100Mi",
+		ExternalAccess: true,
+		TLS:            testCertificate(t, "a.example.com"),
+	})
+	if err != nil {
+		t.Fatalf("DeployApp failed: %v", err)
+	}
+
+	result, err := c.MigrateIngress(ctx)
+	if err != nil {
+		t.Fatalf("MigrateIngress failed: %v", err)
+	}
+	if !slices.Equal(result.Migrated, []string{"a"}) {
+		t.Fatalf("migrated %v, want [a]", result.Migrated)
+	}
+
+	ingClient := c.Clientset.NetworkingV1().Ingresses(c.namespace(ctx))
+	if _, err := ingClient.Get(ctx, "kaas-ingress", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Fatalf("shared ingress wasn't deleted with its last app: %v", err)
+	}
+	ingress, err := ingClient.Get(ctx, "a", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get dedicated ingress: %v", err)
+	}
+	if len(ingress.Spec.TLS) != 1 || ingress.Spec.TLS[0].SecretName != "a-tls" {
+		t.Fatalf("dedicated ingress TLS is %v, want a-tls", ingress.Spec.TLS)
+	}
+	if _, ok := ingress.Annotations[tlsAppsAnnotation]; ok {
+		t.Fatalf("dedicated ingress got the %s annotation of the shared ingress", tlsAppsAnnotation)
+	}
+}
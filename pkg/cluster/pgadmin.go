@@ -0,0 +1,271 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/SepehrNoey/KaaS/api"
+	"github.com/jackc/pgx/v5"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// dbUserLabel holds the database server of the secrets of its additional users
+	dbUserLabel = "kaas.io/db-user"
+
+	AccessRead  = "read"
+	AccessWrite = "write"
+	AccessAll   = "all"
+)
+
+// grantStatements are run in the granted database, on its public schema. The
+// default privileges cover the tables the owner of the database creates later.
+var grantStatements = map[string][]string{
+	AccessRead: {
+		"GRANT USAGE ON SCHEMA public TO %[1]s",
+		"GRANT SELECT ON ALL TABLES IN SCHEMA public TO %[1]s",
+		"GRANT SELECT ON ALL SEQUENCES IN SCHEMA public TO %[1]s",
+		"ALTER DEFAULT PRIVILEGES FOR ROLE %[2]s IN SCHEMA public GRANT SELECT ON TABLES TO %[1]s",
+		"ALTER DEFAULT PRIVILEGES FOR ROLE %[2]s IN SCHEMA public GRANT SELECT ON SEQUENCES TO %[1]s",
+	},
+	AccessWrite: {
+		"GRANT USAGE ON SCHEMA public TO %[1]s",
+		"GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO %[1]s",
+		"GRANT USAGE, SELECT, UPDATE ON ALL SEQUENCES IN SCHEMA public TO %[1]s",
+		"ALTER DEFAULT PRIVILEGES FOR ROLE %[2]s IN SCHEMA public GRANT SELECT, INSERT, UPDATE, DELETE ON TABLES TO %[1]s",
+		"ALTER DEFAULT PRIVILEGES FOR ROLE %[2]s IN SCHEMA public GRANT USAGE, SELECT, UPDATE ON SEQUENCES TO %[1]s",
+	},
+	AccessAll: {
+		"GRANT ALL ON SCHEMA public TO %[1]s",
+		"GRANT ALL ON ALL TABLES IN SCHEMA public TO %[1]s",
+		"GRANT ALL ON ALL SEQUENCES IN SCHEMA public TO %[1]s",
+		"ALTER DEFAULT PRIVILEGES FOR ROLE %[2]s IN SCHEMA public GRANT ALL ON TABLES TO %[1]s",
+		"ALTER DEFAULT PRIVILEGES FOR ROLE %[2]s IN SCHEMA public GRANT ALL ON SEQUENCES TO %[1]s",
+	},
+}
+
+// connectPostgres connects to the database of a postgres server at host, with
+// the credentials of the server.
+func (c *ClusterManager) connectPostgres(ctx context.Context, name, host, database string) (*pgx.Conn, error) {
+	secret, err := c.Clientset.CoreV1().Secrets(c.namespace(ctx)).Get(ctx, name+"-secret", metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get credentials of database %s: %v", name, err)
+	}
+	_, pg, err := c.engine(EnginePostgres)
+	if err != nil {
+		return nil, err
+	}
+
+	creds := &api.DBCredentials{
+		DBName:   database,
+		Username: string(secret.Data["username"]),
+		Password: string(secret.Data["password"]),
+	}
+	conn, err := pgx.Connect(ctx, postgresEngine{}.URL(creds, host, pg.Port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database %s: %v", name, err)
+	}
+	return conn, nil
+}
+
+// checkServer checks that the database server exists and is a postgres one.
+func (c *ClusterManager) checkServer(ctx context.Context, name string) error {
+	statefulSet, err := c.Clientset.AppsV1().StatefulSets(c.namespace(ctx)).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get database: %v", err)
+	}
+	if engine := statefulSet.Labels[engineLabel]; engine != "" && engine != EnginePostgres {
+		return fmt.Errorf("databases, users and grants are only managed for %s databases", EnginePostgres)
+	}
+	return nil
+}
+
+// connectServer checks that the database server is a postgres one and connects
+// to database through its service, which reaches the primary of HA servers.
+func (c *ClusterManager) connectServer(ctx context.Context, name, database string) (*pgx.Conn, error) {
+	if err := c.checkServer(ctx, name); err != nil {
+		return nil, err
+	}
+	return c.connectPostgres(ctx, name, fmt.Sprintf("%s.%s.svc", name, c.namespace(ctx)), database)
+}
+
+func checkSQLName(kind, name string) error {
+	if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+		return fmt.Errorf("invalid %s name %q: %s", kind, name, strings.Join(errs, ", "))
+	}
+	if name == replicationUser {
+		return fmt.Errorf("%s name %q is reserved", kind, name)
+	}
+	return nil
+}
+
+// CreateDatabase creates a database inside a postgres server. Only its owner
+// and the users granted access can connect to it. Dry runs only validate the request.
+func (c *ClusterManager) CreateDatabase(ctx context.Context, name string, req *api.DatabaseRequest) (*api.DatabaseRequest, error) {
+	if err := checkSQLName("database", req.Name); err != nil {
+		return nil, err
+	}
+	if req.Owner != "" {
+		if err := checkSQLName("user", req.Owner); err != nil {
+			return nil, err
+		}
+	}
+	if isDryRun(ctx) {
+		if err := c.checkServer(ctx, name); err != nil {
+			return nil, err
+		}
+		return req, nil
+	}
+
+	conn, err := c.connectServer(ctx, name, name)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(ctx)
+
+	database := pgx.Identifier{req.Name}.Sanitize()
+	statement := "CREATE DATABASE " + database
+	if req.Owner != "" {
+		statement += " OWNER " + pgx.Identifier{req.Owner}.Sanitize()
+	}
+	if _, err := conn.Exec(ctx, statement); err != nil {
+		return nil, fmt.Errorf("failed to create database %s: %v", req.Name, err)
+	}
+	if _, err := conn.Exec(ctx, "REVOKE ALL ON DATABASE "+database+" FROM PUBLIC"); err != nil {
+		return nil, fmt.Errorf("failed to restrict database %s: %v", req.Name, err)
+	}
+
+	result := *req
+	if result.Owner == "" {
+		result.Owner = conn.Config().User
+	}
+	return &result, nil
+}
+
+// CreateDBUser creates a login role inside a postgres server, with a secret of
+// its own holding its username and password. The user can't connect to any
+// database until it's granted access. Dry runs only create the secret.
+func (c *ClusterManager) CreateDBUser(ctx context.Context, name string, req *api.DBUserRequest) (*api.DBUser, error) {
+	if err := checkSQLName("user", req.Name); err != nil {
+		return nil, err
+	}
+
+	var conn *pgx.Conn
+	var err error
+	if isDryRun(ctx) {
+		err = c.checkServer(ctx, name)
+	} else {
+		conn, err = c.connectServer(ctx, name, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if conn != nil {
+		defer conn.Close(ctx)
+	}
+
+	namespace := c.namespace(ctx)
+	user := &api.DBUser{
+		Name:       req.Name,
+		Password:   randomPassword(),
+		SecretName: name + "-user-" + req.Name,
+	}
+
+	// the secret is created first, so a user that already exists is rejected before any change
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      user.SecretName,
+			Namespace: namespace,
+			Labels:    map[string]string{dbUserLabel: name, managedByLabel: managedByValue},
+		},
+		StringData: map[string]string{"username": user.Name, "password": user.Password},
+	}
+	secret, err = c.Clientset.CoreV1().Secrets(namespace).Create(ctx, secret, createOptions(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create secret: %v", err)
+	}
+	created(ctx, secret)
+	if isDryRun(ctx) {
+		return user, nil
+	}
+
+	// the password is base64url made by KaaS, with no quotes to escape, so it's
+	// safe to put in the statement
+	_, err = conn.Exec(ctx, fmt.Sprintf("CREATE ROLE %s LOGIN PASSWORD '%s'", pgx.Identifier{user.Name}.Sanitize(), user.Password))
+	if err != nil {
+		if err := c.deleteSecret(ctx, user.SecretName); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to create user %s: %v", user.Name, err)
+	}
+
+	return user, nil
+}
+
+// RedactDBUser replaces the password of the user, which stays in its secret.
+func RedactDBUser(user *api.DBUser) {
+	user.Password = redactedValue
+}
+
+// GrantDB grants a user of a postgres server access to a database: read to
+// select, write to also change rows, all to also change the schema. Dry runs
+// only validate the request.
+func (c *ClusterManager) GrantDB(ctx context.Context, name string, req *api.GrantRequest) (*api.GrantRequest, error) {
+	if err := checkSQLName("user", req.User); err != nil {
+		return nil, err
+	}
+	database := req.Database
+	if database == "" {
+		database = name
+	}
+	statements, ok := grantStatements[req.Access]
+	if !ok {
+		return nil, fmt.Errorf("invalid access %q, expected %s, %s or %s", req.Access, AccessRead, AccessWrite, AccessAll)
+	}
+	granted := *req
+	granted.Database = database
+	if isDryRun(ctx) {
+		if err := c.checkServer(ctx, name); err != nil {
+			return nil, err
+		}
+		return &granted, nil
+	}
+
+	conn, err := c.connectServer(ctx, name, database)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(ctx)
+
+	var owner string
+	err = conn.QueryRow(ctx, "SELECT pg_get_userbyid(datdba) FROM pg_database WHERE datname = current_database()").Scan(&owner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get owner of database %s: %v", database, err)
+	}
+
+	user := pgx.Identifier{req.User}.Sanitize()
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	privilege := "CONNECT"
+	if req.Access == AccessAll {
+		privilege = "ALL"
+	}
+	statements = append([]string{"GRANT " + privilege + " ON DATABASE " + pgx.Identifier{database}.Sanitize() + " TO %[1]s"}, statements...)
+	for _, statement := range statements {
+		if _, err := tx.Exec(ctx, fmt.Sprintf(statement, user, pgx.Identifier{owner}.Sanitize())); err != nil {
+			return nil, fmt.Errorf("failed to grant %s access on %s to %s: %v", req.Access, database, req.User, err)
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to grant %s access on %s to %s: %v", req.Access, database, req.User, err)
+	}
+
+	return &granted, nil
+}
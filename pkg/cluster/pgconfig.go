@@ -0,0 +1,312 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SepehrNoey/KaaS/api"
+	"github.com/jackc/pgx/v5"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// configHashAnnotation holds the hash of the postgresql.conf of the pods of
+	// a database, so the servers are restarted when it changes.
+	configHashAnnotation = "kaas.io/config-hash"
+	// extensionsAnnotation holds the outcome of enabling the extensions of a database.
+	extensionsAnnotation = "kaas.io/extensions"
+
+	pgConfigMountPath = "/etc/kaas-postgres"
+	pgConfigKey       = "postgresql.conf"
+
+	ExtensionEnabled     = "enabled"
+	ExtensionUnavailable = "unavailable"
+	ExtensionFailed      = "failed"
+
+	extensionTimeout  = 10 * time.Minute
+	extensionInterval = 5 * time.Second
+)
+
+var (
+	parameterName = regexp.MustCompile(`^[a-z][a-z0-9_]*(\.[a-z][a-z0-9_]*)?$`)
+	extensionName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+)
+
+// reservedParameters are set by KaaS or by the image, and would break the
+// server or replication if overridden.
+var reservedParameters = map[string]bool{
+	"config_file": true, "data_directory": true, "hba_file": true, "ident_file": true,
+	"external_pid_file": true, "include": true, "include_dir": true, "include_if_exists": true,
+	"listen_addresses": true, "port": true, "unix_socket_directories": true,
+	"wal_level": true, "hot_standby": true, "primary_conninfo": true,
+}
+
+// postgresParameters returns the settings of a postgres server: memory
+// settings derived from the memory of the server, max_connections, and the
+// parameters of the request over them.
+func postgresParameters(memory resource.Quantity, maxConn int32, overrides map[string]string) (map[string]string, error) {
+	for name, value := range overrides {
+		if !parameterName.MatchString(name) {
+			return nil, fmt.Errorf("invalid parameter name %q", name)
+		}
+		if reservedParameters[name] {
+			return nil, fmt.Errorf("parameter %s is managed by KaaS", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("value of parameter %s can't span lines", name)
+		}
+	}
+	if value, ok := overrides["max_connections"]; ok {
+		n, err := strconv.ParseInt(value, 10, 32)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid max_connections %q", value)
+		}
+		maxConn = int32(n)
+	}
+
+	kb := memory.Value() / 1024
+	sharedBuffers := max(kb/4, 128)
+	params := map[string]string{
+		"max_connections":      strconv.FormatInt(int64(maxConn), 10),
+		"shared_buffers":       fmt.Sprintf("%dkB", sharedBuffers),
+		"effective_cache_size": fmt.Sprintf("%dkB", max(kb*3/4, 8)),
+		"maintenance_work_mem": fmt.Sprintf("%dkB", min(max(kb/16, 1024), 2*1024*1024)),
+		// every connection may run a few sorts or hashes at once
+		"work_mem": fmt.Sprintf("%dkB", max((kb-sharedBuffers)/(int64(maxConn)*3), 64)),
+	}
+	for name, value := range overrides {
+		params[name] = value
+	}
+	return params, nil
+}
+
+// maxConnectionsOf returns the max_connections of the settings of postgresParameters.
+func maxConnectionsOf(params map[string]string) int32 {
+	return parseInt32(params["max_connections"])
+}
+
+// renderPostgresConfig renders the settings into a postgresql.conf that
+// includes the one of the data directory first, so the settings override it.
+func renderPostgresConfig(params map[string]string, dataDir string) string {
+	names := []string{}
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "include_if_exists = '%s/postgresql.conf'\n\n", dataDir)
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s = '%s'\n", name, strings.ReplaceAll(params[name], "'", "''"))
+	}
+	return b.String()
+}
+
+// pgDataDir returns the data directory of the server container.
+func pgDataDir(container *corev1.Container) string {
+	for _, env := range container.Env {
+		if env.Name == "PGDATA" {
+			return env.Value
+		}
+	}
+	return postgresEngine{}.DataPath()
+}
+
+// buildPostgresConfig renders the settings of a postgres database into the
+// <name>-config config map, and runs the servers with it as their config
+// file. It returns the max_connections of the servers.
+func (c *ClusterManager) buildPostgresConfig(ctx context.Context, dbreq *api.DBRequest, objs *dbObjects, memory resource.Quantity) (int32, error) {
+	params, err := postgresParameters(memory, c.maxConnections(), dbreq.Parameters)
+	if err != nil {
+		return 0, err
+	}
+
+	podSpec := &objs.statefulSet.Spec.Template.Spec
+	container := &podSpec.Containers[0]
+	objs.pgConfig = c.postgresConfigMap(ctx, dbreq.DBName, renderPostgresConfig(params, pgDataDir(container)))
+
+	container.Args = append(container.Args, "-c", "config_file="+pgConfigMountPath+"/"+pgConfigKey)
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: "config", MountPath: pgConfigMountPath})
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name: "config",
+		VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: objs.pgConfig.Name},
+		}},
+	})
+	setConfigHash(objs.statefulSet, objs.pgConfig)
+	return maxConnectionsOf(params), nil
+}
+
+func (c *ClusterManager) postgresConfigMap(ctx context.Context, name, config string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name + "-config",
+			Namespace: c.namespace(ctx),
+			Labels:    map[string]string{"app": name, managedByLabel: managedByValue},
+		},
+		Data: map[string]string{pgConfigKey: config},
+	}
+}
+
+func setConfigHash(statefulSet *appsv1.StatefulSet, configMap *corev1.ConfigMap) {
+	template := &statefulSet.Spec.Template
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	template.Annotations[configHashAnnotation] = hashValue(configMap.Data[pgConfigKey])
+}
+
+// resizedConfig renders the config map of a resized database with the
+// settings derived from its new memory, or returns nil if KaaS doesn't manage
+// the config of the database.
+func (c *ClusterManager) resizedConfig(ctx context.Context, statefulSet *appsv1.StatefulSet) (*corev1.ConfigMap, error) {
+	if _, ok := statefulSet.Spec.Template.Annotations[configHashAnnotation]; !ok {
+		return nil, nil
+	}
+	var dbreq api.DBRequest
+	if err := json.Unmarshal([]byte(statefulSet.Annotations[specAnnotation]), &dbreq); err != nil {
+		return nil, fmt.Errorf("failed to decode database spec: %v", err)
+	}
+
+	container := &statefulSet.Spec.Template.Spec.Containers[0]
+	params, err := postgresParameters(container.Resources.Requests[corev1.ResourceMemory], c.maxConnections(), dbreq.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	return c.postgresConfigMap(ctx, statefulSet.Name, renderPostgresConfig(params, pgDataDir(container))), nil
+}
+
+func checkExtensions(extensions []string) error {
+	for _, name := range extensions {
+		if !extensionName.MatchString(name) {
+			return fmt.Errorf("invalid extension name %q", name)
+		}
+	}
+	return nil
+}
+
+// enableExtensions waits for a postgres database to accept connections and
+// creates its extensions in the database of the server and in template1, so
+// the databases created in the server later have them too. Extensions the
+// image doesn't ship are skipped. It runs after the request that created or
+// updated the database, so the outcome is kept in an annotation of the
+// statefulset and reported by GetDBStatus.
+func (c *ClusterManager) enableExtensions(ctx context.Context, name string, extensions []string) {
+	ctx, cancel := context.WithTimeout(ctx, extensionTimeout)
+	defer cancel()
+
+	results := []api.DBExtension{}
+	conn, err := c.waitForServer(ctx, name)
+	if err != nil {
+		for _, extension := range extensions {
+			results = append(results, api.DBExtension{Name: extension, Status: ExtensionFailed, Error: err.Error()})
+		}
+	} else {
+		results = createExtensions(ctx, conn, extensions)
+		conn.Close(ctx)
+
+		// databases created later are copied from template1
+		template, err := c.connectServer(ctx, name, "template1")
+		if err == nil {
+			for _, result := range createExtensions(ctx, template, extensions) {
+				if result.Status == ExtensionFailed {
+					log.Printf("database %s: failed to create extension %s in template1: %s", name, result.Name, result.Error)
+				}
+			}
+			template.Close(ctx)
+		} else {
+			log.Printf("database %s: %v", name, err)
+		}
+	}
+
+	for _, result := range results {
+		if result.Status != ExtensionEnabled {
+			log.Printf("database %s: extension %s is %s %s", name, result.Name, result.Status, result.Error)
+		}
+	}
+	if err := c.recordExtensions(ctx, name, results); err != nil {
+		log.Printf("database %s: %v", name, err)
+	}
+}
+
+// waitForServer connects to the database of a postgres server once it accepts connections.
+func (c *ClusterManager) waitForServer(ctx context.Context, name string) (*pgx.Conn, error) {
+	for {
+		conn, err := c.connectServer(ctx, name, name)
+		if err == nil {
+			return conn, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(extensionInterval):
+		}
+	}
+}
+
+func createExtensions(ctx context.Context, conn *pgx.Conn, extensions []string) []api.DBExtension {
+	results := []api.DBExtension{}
+	for _, name := range extensions {
+		result := api.DBExtension{Name: name, Status: ExtensionEnabled}
+		var available bool
+		err := conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_available_extensions WHERE name = $1)", name).Scan(&available)
+		if err == nil && !available {
+			result.Status = ExtensionUnavailable
+		} else if err == nil {
+			_, err = conn.Exec(ctx, "CREATE EXTENSION IF NOT EXISTS "+pgx.Identifier{name}.Sanitize())
+		}
+		if err != nil {
+			result.Status = ExtensionFailed
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// recordExtensions keeps the outcome of enabling the extensions of a database
+// in the annotation of its statefulset.
+func (c *ClusterManager) recordExtensions(ctx context.Context, name string, results []api.DBExtension) error {
+	data, err := json.Marshal(results)
+	if err != nil {
+		return fmt.Errorf("failed to encode extensions: %v", err)
+	}
+	stsClient := c.Clientset.AppsV1().StatefulSets(c.namespace(ctx))
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := stsClient.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if current.Annotations == nil {
+			current.Annotations = map[string]string{}
+		}
+		current.Annotations[extensionsAnnotation] = string(data)
+		_, err = stsClient.Update(ctx, current, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record extensions: %v", err)
+	}
+	return nil
+}
+
+// extensionsOf returns the outcome of enabling the extensions of a database,
+// nil if it has none.
+func extensionsOf(statefulSet *appsv1.StatefulSet) []api.DBExtension {
+	var results []api.DBExtension
+	if data, ok := statefulSet.Annotations[extensionsAnnotation]; ok {
+		_ = json.Unmarshal([]byte(data), &results)
+	}
+	return results
+}
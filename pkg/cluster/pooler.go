@@ -0,0 +1,249 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/SepehrNoey/KaaS/api"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// poolerLabel holds the database of pooler deployments and pods. Poolers
+	// don't get the managed-by label, so they aren't listed as apps.
+	poolerLabel = "kaas.io/pooler"
+
+	PoolModeSession     = "session"
+	PoolModeTransaction = "transaction"
+	PoolModeStatement   = "statement"
+
+	poolerPort              = 6432
+	poolerMountPath         = "/etc/kaas-pooler"
+	defaultPoolSize         = 20
+	defaultMaxClientConn    = 1000
+	defaultMaxConnections   = 100 // max_connections of postgres when db-request-config doesn't set one
+	maxPoolerReplicas       = 10
+	maxPoolerClientConn     = 100000
+	poolerCPU, poolerMemory = "100m", "64Mi"
+)
+
+// poolerScript configures PgBouncer from the environment and starts it. Only
+// the user of the server is in the auth file; the passwords of other users are
+// looked up in the server with it, so users created later can connect too.
+// Pools are per user and database, so max_db_connections caps the connections
+// of all users to a database at the pool size.
+const poolerScript = `set -e
+printf '"%s" "%s"\n' "$DB_USER" "$DB_PASSWORD" > "$POOLER_DIR/userlist.txt"
+cat > "$POOLER_DIR/pgbouncer.ini" <<EOF
+[databases]
+* = host=$DB_HOST port=$DB_PORT
+
+[pgbouncer]
+listen_addr = 0.0.0.0
+listen_port = $LISTEN_PORT
+auth_type = scram-sha-256
+auth_file = $POOLER_DIR/userlist.txt
+auth_user = $DB_USER
+pool_mode = $POOL_MODE
+default_pool_size = $POOL_SIZE
+max_db_connections = $POOL_SIZE
+max_client_conn = $MAX_CLIENT_CONN
+ignore_startup_parameters = extra_float_digits
+EOF
+exec pgbouncer "$POOLER_DIR/pgbouncer.ini"
+`
+
+// maxConnections returns the max_connections of postgres servers whose request doesn't set one.
+func (c *ClusterManager) maxConnections() int32 {
+	if c.DBConf.MaxConn > 0 {
+		return c.DBConf.MaxConn
+	}
+	return defaultMaxConnections
+}
+
+// buildPooler builds the PgBouncer deployment and the <name>-pooler service in
+// front of the service of a postgres database. The connections all poolers
+// open to a database must fit in the max_connections of the server.
+func (c *ClusterManager) buildPooler(ctx context.Context, dbreq *api.DBRequest, objs *dbObjects, port, maxConn int32) error {
+	if c.DBConf.PoolerImage == "" {
+		return fmt.Errorf("connection pooling requires pooler.image in db-request-config")
+	}
+
+	pooler := *dbreq.Pooler
+	if pooler.Mode == "" {
+		pooler.Mode = PoolModeTransaction
+	}
+	if pooler.Mode != PoolModeSession && pooler.Mode != PoolModeTransaction && pooler.Mode != PoolModeStatement {
+		return fmt.Errorf("invalid pool mode %q, expected %s, %s or %s", pooler.Mode, PoolModeSession, PoolModeTransaction, PoolModeStatement)
+	}
+	if pooler.PoolSize == 0 {
+		pooler.PoolSize = defaultPoolSize
+	}
+	if pooler.MaxClientConn == 0 {
+		pooler.MaxClientConn = defaultMaxClientConn
+	}
+	if pooler.Replicas == 0 {
+		pooler.Replicas = 1
+	}
+	if pooler.PoolSize < 0 || pooler.MaxClientConn < 0 || pooler.Replicas < 0 {
+		return fmt.Errorf("pool size, max client connections and replicas of the pooler can't be negative")
+	}
+	if pooler.Replicas > maxPoolerReplicas {
+		return fmt.Errorf("a pooler can have at most %d replicas, got %d", maxPoolerReplicas, pooler.Replicas)
+	}
+	if pooler.MaxClientConn > maxPoolerClientConn {
+		return fmt.Errorf("max client connections of the pooler can be at most %d, got %d", maxPoolerClientConn, pooler.MaxClientConn)
+	}
+	// computed in int64, so large sizes can't overflow past the check
+	if total := int64(pooler.PoolSize) * int64(pooler.Replicas); total > int64(maxConn) {
+		return fmt.Errorf("%d poolers with a pool size of %d open up to %d connections to a database, more than the %d max_connections of the server",
+			pooler.Replicas, pooler.PoolSize, total, maxConn)
+	}
+
+	namespace := c.namespace(ctx)
+	name := dbreq.DBName + "-pooler"
+	secretName := dbreq.DBName + "-secret"
+	labels := map[string]string{poolerLabel: dbreq.DBName}
+	podRequests := corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse(poolerCPU),
+		corev1.ResourceMemory: resource.MustParse(poolerMemory),
+	}
+
+	objs.pooler = &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &pooler.Replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:    "pgbouncer",
+							Image:   c.DBConf.PoolerImage,
+							Command: []string{"/bin/sh", "-c", poolerScript},
+							Ports:   []corev1.ContainerPort{{ContainerPort: poolerPort}},
+							Env: []corev1.EnvVar{
+								{Name: "POOLER_DIR", Value: poolerMountPath},
+								{Name: "LISTEN_PORT", Value: strconv.Itoa(poolerPort)},
+								{Name: "DB_HOST", Value: dbreq.DBName},
+								{Name: "DB_PORT", Value: strconv.FormatInt(int64(port), 10)},
+								secretEnv("DB_USER", secretName, "username"),
+								secretEnv("DB_PASSWORD", secretName, "password"),
+								{Name: "POOL_MODE", Value: pooler.Mode},
+								{Name: "POOL_SIZE", Value: strconv.FormatInt(int64(pooler.PoolSize), 10)},
+								{Name: "MAX_CLIENT_CONN", Value: strconv.FormatInt(int64(pooler.MaxClientConn), 10)},
+							},
+							ReadinessProbe: &corev1.Probe{
+								ProbeHandler:  corev1.ProbeHandler{TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt32(poolerPort)}},
+								PeriodSeconds: 10,
+							},
+							LivenessProbe: livenessProbe(poolerPort),
+							Resources: corev1.ResourceRequirements{
+								Requests: podRequests,
+								Limits:   podRequests,
+							},
+							VolumeMounts: []corev1.VolumeMount{{Name: "config", MountPath: poolerMountPath}},
+						},
+					},
+					// the config holds the password, so it's written to memory only
+					Volumes: []corev1.Volume{{
+						Name:         "config",
+						VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory}},
+					}},
+				},
+			},
+		},
+	}
+
+	objs.poolerService = &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: labels,
+			Ports:    []corev1.ServicePort{{Port: poolerPort}},
+			Type:     corev1.ServiceTypeClusterIP,
+		},
+	}
+
+	addResources(objs.usage, workloadUsage(pooler.Replicas, podRequests, resource.Quantity{}))
+	return nil
+}
+
+// applyPooler creates or updates the pooler deployment and service of a
+// database, or deletes them if the database isn't pooled anymore.
+func (c *ClusterManager) applyPooler(ctx context.Context, name string, objs *dbObjects) error {
+	if objs.pooler == nil {
+		return c.deletePooler(ctx, name)
+	}
+
+	depClient := c.Clientset.AppsV1().Deployments(objs.pooler.Namespace)
+	deployment, err := depClient.Create(ctx, objs.pooler, createOptions(ctx))
+	if err == nil {
+		created(ctx, deployment)
+	} else if !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create pooler deployment: %v", err)
+	} else {
+		err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			current, err := depClient.Get(ctx, objs.pooler.Name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			current.Labels = objs.pooler.Labels
+			current.Spec.Replicas = objs.pooler.Spec.Replicas
+			current.Spec.Template = objs.pooler.Spec.Template
+			deployment, err := depClient.Update(ctx, current, updateOptions(ctx))
+			if err != nil {
+				return err
+			}
+			updated(ctx, deployment)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update pooler deployment: %v", err)
+		}
+	}
+
+	return c.applyService(ctx, objs.poolerService)
+}
+
+// deletePooler deletes the pooler deployment and service of a database, if it has them.
+func (c *ClusterManager) deletePooler(ctx context.Context, name string) error {
+	namespace := c.namespace(ctx)
+	err := c.Clientset.AppsV1().Deployments(namespace).Delete(ctx, name+"-pooler", deleteOptions(ctx))
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete pooler deployment: %v", err)
+	}
+	err = c.Clientset.CoreV1().Services(namespace).Delete(ctx, name+"-pooler", deleteOptions(ctx))
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete pooler service: %v", err)
+	}
+	return nil
+}
+
+// poolerUsage returns what the pooler of a database counts against the quota,
+// nothing if it has none.
+func (c *ClusterManager) poolerUsage(ctx context.Context, name string) (corev1.ResourceList, error) {
+	deployment, err := c.Clientset.AppsV1().Deployments(c.namespace(ctx)).Get(ctx, name+"-pooler", metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return corev1.ResourceList{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pooler deployment: %v", err)
+	}
+	return deploymentUsage(deployment), nil
+}
@@ -0,0 +1,126 @@
+package cluster
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/SepehrNoey/KaaS/api"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// appPorts returns the ports of the app with defaults applied. The single Port
+// field is treated as one unnamed TCP port exposed through the ingress.
+func appPorts(appreq *api.AppRequest) ([]api.AppPort, error) {
+	if len(appreq.Ports) == 0 {
+		if appreq.Port == 0 {
+			return nil, fmt.Errorf("either port or ports must be provided")
+		}
+		return []api.AppPort{
+			{
+				ContainerPort: appreq.Port,
+				ServicePort:   appreq.Port,
+				Protocol:      string(corev1.ProtocolTCP),
+				Ingress:       true,
+			},
+		}, nil
+	}
+
+	ports := make([]api.AppPort, 0, len(appreq.Ports))
+	names := map[string]bool{}
+	ingressPorts := 0
+	for _, p := range appreq.Ports {
+		if p.ContainerPort <= 0 || p.ContainerPort > 65535 {
+			return nil, fmt.Errorf("invalid container port %d", p.ContainerPort)
+		}
+		if p.ServicePort == 0 {
+			p.ServicePort = p.ContainerPort
+		}
+		if p.ServicePort < 0 || p.ServicePort > 65535 {
+			return nil, fmt.Errorf("invalid service port %d", p.ServicePort)
+		}
+
+		switch strings.ToUpper(p.Protocol) {
+		case "", string(corev1.ProtocolTCP):
+			p.Protocol = string(corev1.ProtocolTCP)
+		case string(corev1.ProtocolUDP):
+			p.Protocol = string(corev1.ProtocolUDP)
+		default:
+			return nil, fmt.Errorf("unsupported protocol %q for port %d", p.Protocol, p.ContainerPort)
+		}
+
+		// kubernetes requires every port of a multi-port service to be named
+		if len(appreq.Ports) > 1 && p.Name == "" {
+			return nil, fmt.Errorf("port %d must be named when more than one port is given", p.ContainerPort)
+		}
+		if p.Name != "" {
+			if names[p.Name] {
+				return nil, fmt.Errorf("duplicate port name %q", p.Name)
+			}
+			names[p.Name] = true
+		}
+
+		if p.Ingress {
+			if p.Protocol != string(corev1.ProtocolTCP) {
+				return nil, fmt.Errorf("port %q can't be exposed through ingress over %s", p.Name, p.Protocol)
+			}
+			ingressPorts++
+		}
+		ports = append(ports, p)
+	}
+
+	if ingressPorts > 1 {
+		return nil, fmt.Errorf("at most one port can be exposed through ingress, got %d", ingressPorts)
+	}
+
+	return ports, nil
+}
+
+// ingressPort returns the port that the ingress routes to. If no port is marked,
+// the first TCP port is used.
+func ingressPort(ports []api.AppPort) (api.AppPort, error) {
+	for _, p := range ports {
+		if p.Ingress {
+			return p, nil
+		}
+	}
+	for _, p := range ports {
+		if p.Protocol == string(corev1.ProtocolTCP) {
+			return p, nil
+		}
+	}
+	return api.AppPort{}, fmt.Errorf("no TCP port to expose through ingress")
+}
+
+func containerPorts(ports []api.AppPort) []corev1.ContainerPort {
+	result := make([]corev1.ContainerPort, 0, len(ports))
+	for _, p := range ports {
+		result = append(result, corev1.ContainerPort{
+			Name:          p.Name,
+			ContainerPort: p.ContainerPort,
+			Protocol:      corev1.Protocol(p.Protocol),
+		})
+	}
+	return result
+}
+
+func servicePorts(ports []api.AppPort) []corev1.ServicePort {
+	result := make([]corev1.ServicePort, 0, len(ports))
+	for _, p := range ports {
+		result = append(result, corev1.ServicePort{
+			Name:       p.Name,
+			Port:       p.ServicePort,
+			TargetPort: intstr.FromInt32(p.ContainerPort),
+			Protocol:   corev1.Protocol(p.Protocol),
+		})
+	}
+	return result
+}
+
+func serviceBackendPort(p api.AppPort) netv1.ServiceBackendPort {
+	if p.Name != "" {
+		return netv1.ServiceBackendPort{Name: p.Name}
+	}
+	return netv1.ServiceBackendPort{Number: p.ServicePort}
+}
@@ -0,0 +1,278 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/SepehrNoey/KaaS/api"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// quotaResources maps the resource names of the API to the ones of the ResourceQuota.
+var quotaResources = []struct {
+	Name     string
+	Resource corev1.ResourceName
+}{
+	{"cpu", corev1.ResourceRequestsCPU},
+	{"memory", corev1.ResourceRequestsMemory},
+	{"ephemeral_storage", corev1.ResourceRequestsEphemeralStorage},
+	{"storage", corev1.ResourceRequestsStorage},
+	{"pods", corev1.ResourcePods},
+}
+
+// QuotaExceededError is returned when a request doesn't fit the quota of the tenant.
+type QuotaExceededError struct {
+	Tenant string
+	Usage  []api.QuotaUsage // only the exceeded resources
+}
+
+func (e *QuotaExceededError) Error() string {
+	msg := "request exceeds the quota"
+	for _, u := range e.Usage {
+		msg += fmt.Sprintf("; %s: used %s + requested %s > allowed %s", u.Resource, u.Used, u.Requested, u.Allowed)
+	}
+	return msg
+}
+
+// workloadUsage returns what replicas pods with the given requests, each with a
+// volume of storage, count against the quota.
+func workloadUsage(replicas int32, podRequests corev1.ResourceList, storage resource.Quantity) corev1.ResourceList {
+	usage := corev1.ResourceList{
+		corev1.ResourcePods: *resource.NewQuantity(int64(replicas), resource.DecimalSI),
+	}
+	requestNames := map[corev1.ResourceName]corev1.ResourceName{
+		corev1.ResourceCPU:              corev1.ResourceRequestsCPU,
+		corev1.ResourceMemory:           corev1.ResourceRequestsMemory,
+		corev1.ResourceEphemeralStorage: corev1.ResourceRequestsEphemeralStorage,
+	}
+	for name, quotaName := range requestNames {
+		if q, ok := podRequests[name]; ok {
+			usage[quotaName] = scaled(q, replicas)
+		}
+	}
+	if !storage.IsZero() {
+		usage[corev1.ResourceRequestsStorage] = scaled(storage, replicas)
+	}
+	return usage
+}
+
+// scaled returns q times times. Replicas are validated before, so times isn't negative.
+func scaled(q resource.Quantity, times int32) resource.Quantity {
+	return *resource.NewMilliQuantity(q.MilliValue()*int64(times), q.Format)
+}
+
+func podRequests(spec corev1.PodSpec) corev1.ResourceList {
+	requests := corev1.ResourceList{}
+	for _, container := range spec.Containers {
+		addResources(requests, container.Resources.Requests)
+	}
+	return requests
+}
+
+func addResources(total, add corev1.ResourceList) {
+	for name, q := range add {
+		sum := total[name]
+		sum.Add(q)
+		total[name] = sum
+	}
+}
+
+// subtractResources removes sub from total, resources may end up negative.
+func subtractResources(total, sub corev1.ResourceList) {
+	for name, q := range sub {
+		diff := total[name]
+		diff.Sub(q)
+		total[name] = diff
+	}
+}
+
+func deploymentUsage(d *appsv1.Deployment) corev1.ResourceList {
+	replicas := int32(1)
+	if d.Spec.Replicas != nil {
+		replicas = *d.Spec.Replicas
+	}
+	return workloadUsage(replicas, podRequests(d.Spec.Template.Spec), resource.Quantity{})
+}
+
+func statefulSetUsage(s *appsv1.StatefulSet) corev1.ResourceList {
+	replicas := int32(1)
+	if s.Spec.Replicas != nil {
+		replicas = *s.Spec.Replicas
+	}
+	return workloadUsage(replicas, podRequests(s.Spec.Template.Spec), volumeStorage(s))
+}
+
+// volumeStorage returns the storage requested by the volume claim templates of
+// a replica, or the size its volumes were grown to.
+func volumeStorage(s *appsv1.StatefulSet) resource.Quantity {
+	if q, err := resource.ParseQuantity(s.Annotations[storageAnnotation]); err == nil {
+		return q
+	}
+	storage := resource.Quantity{}
+	for _, pvc := range s.Spec.VolumeClaimTemplates {
+		storage.Add(pvc.Spec.Resources.Requests[corev1.ResourceStorage])
+	}
+	return storage
+}
+
+// namespaceUsage sums what the deployments and statefulsets of the namespace
+// count against the quota, based on their specs rather than their running pods.
+func (c *ClusterManager) namespaceUsage(ctx context.Context, namespace string) (corev1.ResourceList, error) {
+	usage := corev1.ResourceList{}
+
+	deployments, err := c.Clientset.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list deployments: %v", err)
+	}
+	for i := range deployments.Items {
+		addResources(usage, deploymentUsage(&deployments.Items[i]))
+	}
+
+	statefulSets, err := c.Clientset.AppsV1().StatefulSets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list statefulsets: %v", err)
+	}
+	for i := range statefulSets.Items {
+		addResources(usage, statefulSetUsage(&statefulSets.Items[i]))
+	}
+
+	return usage, nil
+}
+
+// checkQuota returns a QuotaExceededError if the requested resources don't fit
+// the quota of the namespace in ctx. Namespaces without a quota are not limited.
+func (c *ClusterManager) checkQuota(ctx context.Context, requested corev1.ResourceList) error {
+	namespace := c.namespace(ctx)
+	quota, err := c.Clientset.CoreV1().ResourceQuotas(namespace).Get(ctx, tenantQuotaName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get resource quota: %v", err)
+	}
+
+	used, err := c.namespaceUsage(ctx, namespace)
+	if err != nil {
+		return err
+	}
+
+	exceeded := []api.QuotaUsage{}
+	for _, r := range quotaResources {
+		allowed, ok := quota.Spec.Hard[r.Resource]
+		req, requesting := requested[r.Resource]
+		if !ok || !requesting {
+			continue
+		}
+		total := used[r.Resource]
+		total.Add(req)
+		if total.Cmp(allowed) > 0 {
+			exceeded = append(exceeded, quotaUsage(r.Name, used[r.Resource], req, allowed))
+		}
+	}
+	if len(exceeded) > 0 {
+		return &QuotaExceededError{Tenant: TenantFromContext(ctx), Usage: exceeded}
+	}
+
+	return nil
+}
+
+func quotaUsage(name string, used, requested, allowed resource.Quantity) api.QuotaUsage {
+	return api.QuotaUsage{
+		Resource:  name,
+		Used:      used.String(),
+		Requested: requested.String(),
+		Allowed:   allowed.String(),
+	}
+}
+
+func (c *ClusterManager) GetQuota(ctx context.Context, tenant string) (*api.Quota, error) {
+	namespace := c.TenantConf.NamespacePrefix + tenant
+	quota, err := c.Clientset.CoreV1().ResourceQuotas(namespace).Get(ctx, tenantQuotaName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get resource quota: %v", err)
+	}
+
+	used, err := c.namespaceUsage(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &api.Quota{
+		Tenant: tenant,
+		Hard:   map[string]string{},
+		Used:   map[string]string{},
+	}
+	for _, r := range quotaResources {
+		if hard, ok := quota.Spec.Hard[r.Resource]; ok {
+			result.Hard[r.Name] = hard.String()
+		}
+		u := used[r.Resource]
+		result.Used[r.Name] = u.String()
+	}
+	return result, nil
+}
+
+// SetQuota replaces the hard limits of the quota of the tenant. Lowering a limit
+// below the current usage is allowed, it only blocks new requests.
+func (c *ClusterManager) SetQuota(ctx context.Context, tenant string, req *api.QuotaRequest) (*api.Quota, error) {
+	hard := corev1.ResourceList{}
+	for name, value := range req.Hard {
+		found := false
+		for _, r := range quotaResources {
+			if r.Name == name {
+				q, err := resource.ParseQuantity(value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid quota %s: %v", name, err)
+				}
+				hard[r.Resource] = q
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unsupported quota resource %q", name)
+		}
+	}
+
+	if err := c.EnsureTenant(ctx, tenant); err != nil {
+		return nil, err
+	}
+
+	namespace := c.TenantConf.NamespacePrefix + tenant
+	quotaClient := c.Clientset.CoreV1().ResourceQuotas(namespace)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		quota, err := quotaClient.Get(ctx, tenantQuotaName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			quota = &corev1.ResourceQuota{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      tenantQuotaName,
+					Namespace: namespace,
+					Labels: map[string]string{
+						tenantLabel:    tenant,
+						managedByLabel: managedByValue,
+					},
+				},
+				Spec: corev1.ResourceQuotaSpec{Hard: hard},
+			}
+			_, err = quotaClient.Create(ctx, quota, metav1.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		quota.Spec.Hard = hard
+		_, err = quotaClient.Update(ctx, quota, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to update resource quota: %v", err)
+	}
+
+	return c.GetQuota(ctx, tenant)
+}
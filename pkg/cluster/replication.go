@@ -0,0 +1,403 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/SepehrNoey/KaaS/api"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// haLabel marks the statefulsets of HA databases. HA can't be turned on or
+	// off once a database is created.
+	haLabel = "kaas.io/ha"
+
+	replicationUser = "replicator"
+	haMountPath     = "/etc/kaas-ha"
+	haDataPath      = "/var/lib/postgresql/data/pgdata"
+)
+
+// haStartScript starts a server of an HA database as the primary or as a
+// streaming replica, depending on the primary of the config map. Replicas
+// clone the primary on their first start. A former primary moves its data to
+// $PGDATA.old and clones the new primary, as its data may have diverged. Only
+// the copy of the last failover is kept, so the volume doesn't fill up with
+// them. The arguments of the container are passed to the server.
+const haStartScript = `set -e
+primary=$(cat "$HA_DIR/primary")
+if [ "$POD_NAME" != "$primary" ]; then
+  if [ -s "$PGDATA/PG_VERSION" ] && [ ! -f "$PGDATA/standby.signal" ]; then
+    # copies of earlier failovers, older servers named them after the time
+    rm -rf "$PGDATA.old" "$PGDATA".[0-9]*
+    mv "$PGDATA" "$PGDATA.old"
+  fi
+  if [ ! -s "$PGDATA/PG_VERSION" ]; then
+    until pg_isready -q -h "$PRIMARY_HOST" -p "$PRIMARY_PORT"; do sleep 2; done
+    rm -rf "$PGDATA"
+    PGPASSWORD="$REPLICATION_PASSWORD" pg_basebackup -h "$PRIMARY_HOST" -p "$PRIMARY_PORT" -U ` + replicationUser + ` -D "$PGDATA" -X stream -R
+  fi
+fi
+exec docker-entrypoint.sh postgres -c wal_keep_size=512MB "$@"
+`
+
+// replicationScript runs once when the primary is initialized, and lets the
+// replicas in. Replicas copy the user and pg_hba.conf, so any of them can be promoted.
+const replicationScript = `psql -v ON_ERROR_STOP=1 --username "$POSTGRES_USER" --dbname "$POSTGRES_DB" --set password="$REPLICATION_PASSWORD" <<'EOSQL'
+CREATE ROLE ` + replicationUser + ` WITH REPLICATION LOGIN PASSWORD :'password';
+EOSQL
+echo "host replication ` + replicationUser + ` all scram-sha-256" >> "$PGDATA/pg_hba.conf"
+`
+
+// haReplicas returns the number of servers of an HA database.
+func (c *ClusterManager) haReplicas(dbreq *api.DBRequest) (int32, error) {
+	replicas := dbreq.Replicas
+	if replicas == 0 {
+		replicas = max(c.DBConf.Replica, 2)
+	}
+	if replicas < 2 {
+		return 0, fmt.Errorf("an HA database needs at least 2 servers, got %d", replicas)
+	}
+	return replicas, nil
+}
+
+// primaryOf returns the pod of the primary of an HA database. Pod 0 is the
+// primary until a failover.
+func (c *ClusterManager) primaryOf(ctx context.Context, name string) (string, error) {
+	configMap, err := c.Clientset.CoreV1().ConfigMaps(c.namespace(ctx)).Get(ctx, name+"-ha", metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return name + "-0", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get HA config of database %s: %v", name, err)
+	}
+	return configMap.Data["primary"], nil
+}
+
+// buildHA turns the statefulset of a postgres database into a primary with
+// streaming replicas, each on a volume of its own. The service of the database
+// and the -rw service select the primary; the -ro service selects all servers.
+func (c *ClusterManager) buildHA(ctx context.Context, dbreq *api.DBRequest, objs *dbObjects, port int32) error {
+	namespace := c.namespace(ctx)
+	secretName := dbreq.DBName + "-secret"
+
+	primary, err := c.primaryOf(ctx, dbreq.DBName)
+	if err != nil {
+		return err
+	}
+
+	objs.haConfig = &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      dbreq.DBName + "-ha",
+			Namespace: namespace,
+			Labels:    map[string]string{"app": dbreq.DBName, managedByLabel: managedByValue},
+		},
+		Data: map[string]string{
+			"primary":        primary,
+			"replication.sh": replicationScript,
+		},
+	}
+
+	statefulSet := objs.statefulSet
+	statefulSet.Labels[haLabel] = "true"
+	podSpec := &statefulSet.Spec.Template.Spec
+	podSpec.Volumes = append(podSpec.Volumes,
+		corev1.Volume{
+			Name: "ha",
+			VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: objs.haConfig.Name},
+				Items:                []corev1.KeyToPath{{Key: "primary", Path: "primary"}},
+			}},
+		},
+		corev1.Volume{
+			Name: "ha-init",
+			VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: objs.haConfig.Name},
+				Items:                []corev1.KeyToPath{{Key: "replication.sh", Path: "replication.sh"}},
+			}},
+		},
+	)
+
+	container := &podSpec.Containers[0]
+	container.Command = []string{"/bin/sh", "-c", haStartScript, "postgres"}
+	container.Env = append(container.Env,
+		// the data is kept in a directory of the volume, so it can be moved aside
+		corev1.EnvVar{Name: "PGDATA", Value: haDataPath},
+		corev1.EnvVar{Name: "HA_DIR", Value: haMountPath},
+		corev1.EnvVar{
+			Name:      "POD_NAME",
+			ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}},
+		},
+		corev1.EnvVar{Name: "PRIMARY_HOST", Value: dbreq.DBName + "-rw"},
+		corev1.EnvVar{Name: "PRIMARY_PORT", Value: strconv.FormatInt(int64(port), 10)},
+		secretEnv("REPLICATION_PASSWORD", secretName, "replication-password"),
+	)
+	container.VolumeMounts = append(container.VolumeMounts,
+		corev1.VolumeMount{Name: "ha", MountPath: haMountPath},
+		corev1.VolumeMount{Name: "ha-init", MountPath: "/docker-entrypoint-initdb.d"},
+	)
+	statefulSet.Spec.VolumeClaimTemplates[0].Spec.AccessModes = []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce}
+
+	objs.service.Spec.Selector = primarySelector(dbreq.DBName, primary)
+	objs.rwService = haService(objs.service, dbreq.DBName+"-rw", primarySelector(dbreq.DBName, primary))
+	objs.roService = haService(objs.service, dbreq.DBName+"-ro", map[string]string{"app": dbreq.DBName})
+	return nil
+}
+
+func primarySelector(name, primary string) map[string]string {
+	return map[string]string{"app": name, appsv1.StatefulSetPodNameLabel: primary}
+}
+
+// haService returns an in-cluster service with the port of the service of the database.
+func haService(service *corev1.Service, name string, selector map[string]string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: service.Namespace,
+			Labels:    map[string]string{"app": service.Name, managedByLabel: managedByValue},
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: selector,
+			Ports:    []corev1.ServicePort{{Port: service.Spec.Ports[0].Port}},
+			Type:     corev1.ServiceTypeClusterIP,
+		},
+	}
+}
+
+// applyHA creates or updates the HA config map and the -rw and -ro services of a database.
+func (c *ClusterManager) applyHA(ctx context.Context, objs *dbObjects) error {
+	if err := c.applyConfigMap(ctx, objs.haConfig); err != nil {
+		return err
+	}
+
+	for _, service := range []*corev1.Service{objs.rwService, objs.roService} {
+		if err := c.applyService(ctx, service); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyService creates the service, or updates the existing one like updateServiceSpec.
+func (c *ClusterManager) applyService(ctx context.Context, service *corev1.Service) error {
+	svcClient := c.Clientset.CoreV1().Services(service.Namespace)
+	createdService, err := svcClient.Create(ctx, service, createOptions(ctx))
+	if err == nil {
+		created(ctx, createdService)
+		return nil
+	}
+	if !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create service %s: %v", service.Name, err)
+	}
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := svcClient.Get(ctx, service.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		updateServiceSpec(current, service)
+		updatedService, err := svcClient.Update(ctx, current, updateOptions(ctx))
+		if err != nil {
+			return err
+		}
+		updated(ctx, updatedService)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update service %s: %v", service.Name, err)
+	}
+	return nil
+}
+
+// deleteHA deletes the HA config map and services of a database, if it has them.
+func (c *ClusterManager) deleteHA(ctx context.Context, name string) error {
+	namespace := c.namespace(ctx)
+	for _, service := range []string{name + "-rw", name + "-ro"} {
+		err := c.Clientset.CoreV1().Services(namespace).Delete(ctx, service, deleteOptions(ctx))
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete service %s: %v", service, err)
+		}
+	}
+	err := c.Clientset.CoreV1().ConfigMaps(namespace).Delete(ctx, name+"-ha", deleteOptions(ctx))
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete HA config map: %v", err)
+	}
+	return nil
+}
+
+// checkHAUpdate rejects turning HA on or off, and scaling an HA database down
+// past its primary.
+func checkHAUpdate(existing *appsv1.StatefulSet, objs *dbObjects) error {
+	if existing.Labels[haLabel] != objs.statefulSet.Labels[haLabel] {
+		return fmt.Errorf("high availability of database %s can't be changed", existing.Name)
+	}
+	if objs.haConfig == nil {
+		return nil
+	}
+
+	primary := objs.haConfig.Data["primary"]
+	ordinal, err := strconv.Atoi(strings.TrimPrefix(primary, existing.Name+"-"))
+	if err == nil && int32(ordinal) >= *objs.statefulSet.Spec.Replicas {
+		return fmt.Errorf("database %s can't be scaled down past its primary %s, fail over to another server first", existing.Name, primary)
+	}
+	return nil
+}
+
+// FailoverDB promotes a replica of an HA database to primary. The services and
+// config map are switched to it first, and the former primary is restarted, so
+// it stops taking writes and comes back as a replica of the new primary. The
+// other replicas follow the new primary through the -rw service.
+func (c *ClusterManager) FailoverDB(ctx context.Context, name, target string) (*api.DBStatus, error) {
+	namespace := c.namespace(ctx)
+	statefulSet, err := c.Clientset.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database: %v", err)
+	}
+	if statefulSet.Labels[haLabel] != "true" {
+		return nil, fmt.Errorf("database %s isn't highly available", name)
+	}
+
+	primary, err := c.primaryOf(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	pods, err := c.Clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("app=%s", name),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %v", err)
+	}
+	pod, err := failoverTarget(pods.Items, primary, target)
+	if err != nil {
+		return nil, err
+	}
+
+	if pod.Name != primary {
+		if err := c.switchPrimary(ctx, name, pod.Name); err != nil {
+			return nil, err
+		}
+		err = c.Clientset.CoreV1().Pods(namespace).Delete(ctx, primary, deleteOptions(ctx))
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("failed to restart former primary %s: %v", primary, err)
+		}
+	}
+
+	if !isDryRun(ctx) {
+		if err := c.promote(ctx, name, pod); err != nil {
+			return nil, err
+		}
+	}
+
+	return c.GetDBStatus(ctx, name)
+}
+
+// failoverTarget returns the pod to promote: the target, or the first ready
+// replica. A target that is already the primary is returned too, so a failover
+// whose promotion failed can be retried.
+func failoverTarget(pods []corev1.Pod, primary, target string) (*corev1.Pod, error) {
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Name < pods[j].Name })
+	for i := range pods {
+		pod := &pods[i]
+		if target == "" && (pod.Name == primary || !podReady(pod)) {
+			continue
+		}
+		if target != "" && pod.Name != target {
+			continue
+		}
+		if !podReady(pod) || pod.Status.PodIP == "" {
+			return nil, fmt.Errorf("server %s isn't ready", pod.Name)
+		}
+		return pod, nil
+	}
+	if target != "" {
+		return nil, fmt.Errorf("server %s not found", target)
+	}
+	return nil, fmt.Errorf("no ready replica to fail over to")
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// switchPrimary points the HA config map and the services of the primary to pod.
+func (c *ClusterManager) switchPrimary(ctx context.Context, name, pod string) error {
+	namespace := c.namespace(ctx)
+
+	cmClient := c.Clientset.CoreV1().ConfigMaps(namespace)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := cmClient.Get(ctx, name+"-ha", metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		current.Data["primary"] = pod
+		configMap, err := cmClient.Update(ctx, current, updateOptions(ctx))
+		if err != nil {
+			return err
+		}
+		updated(ctx, configMap)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update HA config map: %v", err)
+	}
+
+	svcClient := c.Clientset.CoreV1().Services(namespace)
+	for _, service := range []string{name, name + "-rw"} {
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			current, err := svcClient.Get(ctx, service, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			current.Spec.Selector = primarySelector(name, pod)
+			updatedService, err := svcClient.Update(ctx, current, updateOptions(ctx))
+			if err != nil {
+				return err
+			}
+			updated(ctx, updatedService)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update service %s: %v", service, err)
+		}
+	}
+	return nil
+}
+
+// promote connects to the server of pod with the credentials of the database
+// and promotes it, unless it's already out of recovery.
+func (c *ClusterManager) promote(ctx context.Context, name string, pod *corev1.Pod) error {
+	conn, err := c.connectPostgres(ctx, name, pod.Status.PodIP, name)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	var inRecovery bool
+	if err := conn.QueryRow(ctx, "SELECT pg_is_in_recovery()").Scan(&inRecovery); err != nil {
+		return fmt.Errorf("failed to check recovery of server %s: %v", pod.Name, err)
+	}
+	if !inRecovery {
+		return nil
+	}
+
+	var promoted bool
+	if err := conn.QueryRow(ctx, "SELECT pg_promote()").Scan(&promoted); err != nil {
+		return fmt.Errorf("failed to promote server %s: %v", pod.Name, err)
+	}
+	if !promoted {
+		return fmt.Errorf("server %s wasn't promoted in time", pod.Name)
+	}
+	return nil
+}
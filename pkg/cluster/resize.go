@@ -0,0 +1,184 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/SepehrNoey/KaaS/api"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// storageAnnotation holds the volume size of a replica of a database whose
+// volumes were grown. The volume claim template of a statefulset can't be
+// changed, so it keeps the size the database was created with.
+const storageAnnotation = "kaas.io/storage"
+
+// ResizeDB changes the CPU and memory of the servers of a database, which are
+// restarted one by one, and grows their volumes. Volumes are only grown if
+// their storage class allows expansion, and are never shrunk.
+func (c *ClusterManager) ResizeDB(ctx context.Context, name string, req *api.DBResizeRequest) (*api.DBStatus, error) {
+	namespace := c.namespace(ctx)
+	stsClient := c.Clientset.AppsV1().StatefulSets(namespace)
+	existing, err := stsClient.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database: %v", err)
+	}
+
+	resized := existing.DeepCopy()
+	if err := resizeStatefulSet(resized, req); err != nil {
+		return nil, err
+	}
+	current, desired := volumeStorage(existing), volumeStorage(resized)
+	if desired.Cmp(current) < 0 {
+		return nil, fmt.Errorf("volume size of database %s can't be shrunk from %s to %s", name, current.String(), desired.String())
+	}
+
+	requested := statefulSetUsage(resized)
+	subtractResources(requested, statefulSetUsage(existing))
+	if err := c.checkQuota(ctx, requested); err != nil {
+		return nil, err
+	}
+
+	// the memory settings of postgres follow the new memory
+	config, err := c.resizedConfig(ctx, resized)
+	if err != nil {
+		return nil, err
+	}
+
+	if desired.Cmp(current) > 0 {
+		volumes, err := c.expandableVolumes(ctx, existing)
+		if err != nil {
+			return nil, err
+		}
+		for _, volume := range volumes {
+			volume.Spec.Resources.Requests[corev1.ResourceStorage] = desired
+			updatedVolume, err := c.Clientset.CoreV1().PersistentVolumeClaims(namespace).Update(ctx, volume, updateOptions(ctx))
+			if err != nil {
+				return nil, fmt.Errorf("failed to grow volume %s: %v", volume.Name, err)
+			}
+			updated(ctx, updatedVolume)
+		}
+	}
+
+	if config != nil {
+		if err := c.applyConfigMap(ctx, config); err != nil {
+			return nil, err
+		}
+	}
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := stsClient.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if err := resizeStatefulSet(current, req); err != nil {
+			return err
+		}
+		if config != nil {
+			setConfigHash(current, config)
+		}
+		statefulSet, err := stsClient.Update(ctx, current, updateOptions(ctx))
+		if err != nil {
+			return err
+		}
+		updated(ctx, statefulSet)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to update statefulset: %v", err)
+	}
+
+	return c.GetDBStatus(ctx, name)
+}
+
+// resizeStatefulSet sets the resources of the request on the server container
+// and the volume size annotation, and updates the spec the database was built from.
+func resizeStatefulSet(statefulSet *appsv1.StatefulSet, req *api.DBResizeRequest) error {
+	container := &statefulSet.Spec.Template.Spec.Containers[0]
+	if container.Resources.Requests == nil {
+		container.Resources.Requests = corev1.ResourceList{}
+	}
+	if container.Resources.Limits == nil {
+		container.Resources.Limits = corev1.ResourceList{}
+	}
+
+	resources := map[corev1.ResourceName]string{
+		corev1.ResourceCPU:    req.CPU,
+		corev1.ResourceMemory: req.Memory,
+	}
+	for name, value := range resources {
+		if value == "" {
+			continue
+		}
+		q, err := resource.ParseQuantity(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %v", name, value, err)
+		}
+		container.Resources.Requests[name] = q
+		container.Resources.Limits[name] = q
+	}
+	if statefulSet.Annotations == nil {
+		statefulSet.Annotations = map[string]string{}
+	}
+	if req.Storage != "" {
+		q, err := resource.ParseQuantity(req.Storage)
+		if err != nil {
+			return fmt.Errorf("invalid storage %q: %v", req.Storage, err)
+		}
+		statefulSet.Annotations[storageAnnotation] = q.String()
+	}
+
+	// apply keeps seeing the database as up to date with its new size
+	if statefulSet.Annotations[specAnnotation] == "" {
+		return nil
+	}
+	var dbreq api.DBRequest
+	if err := json.Unmarshal([]byte(statefulSet.Annotations[specAnnotation]), &dbreq); err != nil {
+		return fmt.Errorf("failed to decode database spec: %v", err)
+	}
+	cpu := container.Resources.Requests[corev1.ResourceCPU]
+	memory := container.Resources.Requests[corev1.ResourceMemory]
+	storage := volumeStorage(statefulSet)
+	dbreq.Resources = fmt.Sprintf("%s,%s,%s", cpu.String(), memory.String(), storage.String())
+	spec, err := json.Marshal(dbreq)
+	if err != nil {
+		return fmt.Errorf("failed to encode database spec: %v", err)
+	}
+	statefulSet.Annotations[specAnnotation] = string(spec)
+	return nil
+}
+
+// expandableVolumes returns the data volumes of the replicas of a database, or
+// an error if the storage class of any of them doesn't allow expansion.
+func (c *ClusterManager) expandableVolumes(ctx context.Context, statefulSet *appsv1.StatefulSet) ([]*corev1.PersistentVolumeClaim, error) {
+	volumes := []*corev1.PersistentVolumeClaim{}
+	for i := int32(0); i < *statefulSet.Spec.Replicas; i++ {
+		name := fmt.Sprintf("data-%s-%d", statefulSet.Name, i)
+		volume, err := c.Clientset.CoreV1().PersistentVolumeClaims(statefulSet.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get volume %s: %v", name, err)
+		}
+
+		className := ""
+		if volume.Spec.StorageClassName != nil {
+			className = *volume.Spec.StorageClassName
+		}
+		if className == "" {
+			return nil, fmt.Errorf("volume %s has no storage class, so it can't be grown", name)
+		}
+		class, err := c.Clientset.StorageV1().StorageClasses().Get(ctx, className, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get storage class %s: %v", className, err)
+		}
+		if class.AllowVolumeExpansion == nil || !*class.AllowVolumeExpansion {
+			return nil, fmt.Errorf("storage class %s of volume %s doesn't allow volume expansion", className, name)
+		}
+		volumes = append(volumes, volume)
+	}
+	return volumes, nil
+}
@@ -0,0 +1,339 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/SepehrNoey/KaaS/api"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// restoreLabel holds the database a restore job loads data into.
+	restoreLabel = "kaas.io/restore"
+
+	fromBackupAnnotation = "kaas.io/from-backup"
+	cloneOfAnnotation    = "kaas.io/clone-of"
+
+	restoreMountPath = "/restore"
+	restoreDumpFile  = restoreMountPath + "/dump"
+)
+
+// restoreScript waits for the database to accept connections and loads the
+// dump into it, replacing the objects it already has.
+const restoreScript = `set -e
+until pg_isready -q; do sleep 2; done
+pg_restore --clean --if-exists --no-owner --no-privileges -d "$PGDATABASE" "$DUMP_FILE"
+`
+
+// downloadScript downloads a dump uploaded by the s3 backup target.
+const downloadScript = `set -e
+mc alias set backup "$S3_ENDPOINT" "$S3_ACCESS_KEY" "$S3_SECRET_KEY" > /dev/null
+mc cp "backup/${DUMP_LOCATION#s3://}" "$DUMP_FILE" > /dev/null
+`
+
+// cloneScript dumps the database that is cloned.
+const cloneScript = `pg_dump -Fc -f "$DUMP_FILE"`
+
+// restoreSource is where a restore job gets its dump from. Init containers
+// fetch the dump into the restore volume, unless it's on a mounted volume already.
+type restoreSource struct {
+	fromBackup     string
+	cloneOf        string
+	initContainers []corev1.Container
+	volumes        []corev1.Volume
+	mounts         []corev1.VolumeMount
+	dumpFile       string
+}
+
+// buildDBRestore builds the job that loads the data of the from_backup or
+// clone_of of a new database into it, or returns nil if it starts empty.
+func (c *ClusterManager) buildDBRestore(ctx context.Context, dbreq *api.DBRequest) (*batchv1.Job, error) {
+	if dbreq.FromBackup == "" && dbreq.CloneOf == "" {
+		return nil, nil
+	}
+	if dbreq.Engine != "" && dbreq.Engine != EnginePostgres {
+		return nil, fmt.Errorf("restores are only supported for %s databases", EnginePostgres)
+	}
+	_, pg, err := c.engine(EnginePostgres)
+	if err != nil {
+		return nil, err
+	}
+
+	var source *restoreSource
+	switch {
+	case dbreq.FromBackup != "" && dbreq.CloneOf != "":
+		return nil, fmt.Errorf("a database can't be restored from a backup and cloned at once")
+	case dbreq.FromBackup != "":
+		source, err = c.backupSource(ctx, dbreq.FromBackup)
+	case dbreq.CloneOf == dbreq.DBName:
+		return nil, fmt.Errorf("database %s can't be cloned into itself", dbreq.DBName)
+	default:
+		source, err = c.cloneSource(ctx, dbreq.CloneOf, pg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.buildRestore(ctx, dbreq.DBName, source, pg), nil
+}
+
+// backupSource returns the dump of a successful backup. The volume or S3
+// target of the backup is taken from its job, so it's found even if the
+// backup settings of the database changed since.
+func (c *ClusterManager) backupSource(ctx context.Context, id string) (*restoreSource, error) {
+	job, backup, err := c.getBackup(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if backup.Status != StatusSucceeded || backup.Location == "" {
+		return nil, fmt.Errorf("backup %s is %s, only succeeded backups can be restored", id, backup.Status)
+	}
+
+	source := &restoreSource{fromBackup: id, dumpFile: backup.Location}
+	podSpec := job.Spec.Template.Spec
+	for _, volume := range podSpec.Volumes {
+		if volume.Name == "backups" && volume.PersistentVolumeClaim != nil {
+			claim := *volume.PersistentVolumeClaim
+			claim.ReadOnly = true
+			source.volumes = []corev1.Volume{{
+				Name:         "backups",
+				VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &claim},
+			}}
+			source.mounts = []corev1.VolumeMount{{Name: "backups", MountPath: backupMountPath, ReadOnly: true}}
+			return source, nil
+		}
+	}
+
+	for _, container := range podSpec.Containers {
+		if container.Name != "upload" {
+			continue
+		}
+		env := []corev1.EnvVar{
+			{Name: "DUMP_LOCATION", Value: backup.Location},
+			{Name: "DUMP_FILE", Value: restoreDumpFile},
+		}
+		for _, e := range container.Env {
+			switch e.Name {
+			case "S3_ENDPOINT", "S3_ACCESS_KEY", "S3_SECRET_KEY", "MC_CONFIG_DIR":
+				env = append(env, e)
+			}
+		}
+		source.initContainers = []corev1.Container{{
+			Name:                     "download",
+			Image:                    container.Image,
+			Command:                  []string{"/bin/sh", "-c", downloadScript},
+			Env:                      env,
+			VolumeMounts:             []corev1.VolumeMount{{Name: "restore", MountPath: restoreMountPath}},
+			TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+		}}
+		source.dumpFile = restoreDumpFile
+		return source, nil
+	}
+
+	return nil, fmt.Errorf("backup %s has neither a backup volume nor an upload target", id)
+}
+
+// cloneSource returns a dump of another database, taken when the restore job runs.
+func (c *ClusterManager) cloneSource(ctx context.Context, name string, pg EngineConf) (*restoreSource, error) {
+	statefulSet, err := c.Clientset.AppsV1().StatefulSets(c.namespace(ctx)).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database %s: %v", name, err)
+	}
+	if engine := statefulSet.Labels[engineLabel]; engine != "" && engine != EnginePostgres {
+		return nil, fmt.Errorf("database %s runs %s, only %s databases can be cloned", name, engine, EnginePostgres)
+	}
+
+	return &restoreSource{
+		cloneOf: name,
+		initContainers: []corev1.Container{{
+			Name:                     "pg-dump",
+			Image:                    pg.Image.Repository,
+			ImagePullPolicy:          pg.Image.PullPolicy,
+			Command:                  []string{"/bin/sh", "-c", cloneScript},
+			Env:                      append(pgEnv(name, pg.Port), corev1.EnvVar{Name: "DUMP_FILE", Value: restoreDumpFile}),
+			VolumeMounts:             []corev1.VolumeMount{{Name: "restore", MountPath: restoreMountPath}},
+			TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+		}},
+		dumpFile: restoreDumpFile,
+	}, nil
+}
+
+// buildRestore builds the job that loads the dump of source into the database.
+func (c *ClusterManager) buildRestore(ctx context.Context, name string, source *restoreSource, pg EngineConf) *batchv1.Job {
+	labels := map[string]string{restoreLabel: name, managedByLabel: managedByValue}
+	annotations := map[string]string{}
+	if source.fromBackup != "" {
+		annotations[fromBackupAnnotation] = source.fromBackup
+	}
+	if source.cloneOf != "" {
+		annotations[cloneOfAnnotation] = source.cloneOf
+	}
+
+	backoffLimit := int32(2)
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name + "-restore-" + strconv.FormatInt(time.Now().Unix(), 10),
+			Namespace:   c.namespace(ctx),
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					RestartPolicy:  corev1.RestartPolicyNever,
+					InitContainers: source.initContainers,
+					Containers: []corev1.Container{{
+						Name:                     "pg-restore",
+						Image:                    pg.Image.Repository,
+						ImagePullPolicy:          pg.Image.PullPolicy,
+						Command:                  []string{"/bin/sh", "-c", restoreScript},
+						Env:                      append(pgEnv(name, pg.Port), corev1.EnvVar{Name: "DUMP_FILE", Value: source.dumpFile}),
+						VolumeMounts:             append([]corev1.VolumeMount{{Name: "restore", MountPath: restoreMountPath}}, source.mounts...),
+						TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+					}},
+					Volumes: append([]corev1.Volume{{
+						Name:         "restore",
+						VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+					}}, source.volumes...),
+				},
+			},
+		},
+	}
+}
+
+// RestoreDB loads a backup into an existing database, replacing the objects
+// the backup has. The restore runs in a job, its progress is reported by GetDBStatus.
+func (c *ClusterManager) RestoreDB(ctx context.Context, name string, req *api.RestoreRequest) (*api.RestoreStatus, error) {
+	namespace := c.namespace(ctx)
+	statefulSet, err := c.Clientset.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database: %v", err)
+	}
+	if engine := statefulSet.Labels[engineLabel]; engine != "" && engine != EnginePostgres {
+		return nil, fmt.Errorf("database %s runs %s, only %s databases can be restored", name, engine, EnginePostgres)
+	}
+	_, pg, err := c.engine(EnginePostgres)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs, err := c.restoreJobs(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range jobs {
+		if progressOf(&job, nil).status == StatusRunning {
+			return nil, fmt.Errorf("database %s is being restored by %s", name, job.Name)
+		}
+	}
+
+	source, err := c.backupSource(ctx, req.Backup)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the last restore is reported, so the finished ones are removed
+	options := deleteOptions(ctx)
+	propagation := metav1.DeletePropagationBackground
+	options.PropagationPolicy = &propagation
+	for _, job := range jobs {
+		if err := c.Clientset.BatchV1().Jobs(namespace).Delete(ctx, job.Name, options); err != nil {
+			return nil, fmt.Errorf("failed to delete restore job %s: %v", job.Name, err)
+		}
+	}
+
+	job, err := c.Clientset.BatchV1().Jobs(namespace).Create(ctx, c.buildRestore(ctx, name, source, pg), createOptions(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create restore job: %v", err)
+	}
+	created(ctx, job)
+
+	return restoreStatusOf(job, nil), nil
+}
+
+// GetDBStatus returns the replicas of a database and the progress of the last
+// restore into it.
+func (c *ClusterManager) GetDBStatus(ctx context.Context, name string) (*api.DBStatus, error) {
+	namespace := c.namespace(ctx)
+	statefulSet, err := c.Clientset.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database: %v", err)
+	}
+
+	status := &api.DBStatus{
+		Name:          statefulSet.Name,
+		Engine:        EnginePostgres,
+		Namespace:     statefulSet.Namespace,
+		Replicas:      *statefulSet.Spec.Replicas,
+		ReadyReplicas: statefulSet.Status.ReadyReplicas,
+	}
+	if engine := statefulSet.Labels[engineLabel]; engine != "" {
+		status.Engine = engine
+	}
+	if containers := statefulSet.Spec.Template.Spec.Containers; len(containers) > 0 {
+		cpu := containers[0].Resources.Requests[corev1.ResourceCPU]
+		memory := containers[0].Resources.Requests[corev1.ResourceMemory]
+		storage := volumeStorage(statefulSet)
+		status.Resources = fmt.Sprintf("%s,%s,%s", cpu.String(), memory.String(), storage.String())
+	}
+	status.Extensions = extensionsOf(statefulSet)
+	if statefulSet.Labels[haLabel] == "true" {
+		status.Primary, err = c.primaryOf(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	jobs, err := c.restoreJobs(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return status, nil
+	}
+	last := &jobs[len(jobs)-1]
+
+	pods, err := c.Clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", batchv1.JobNameLabel, last.Name),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list restore pods: %v", err)
+	}
+	status.Restore = restoreStatusOf(last, lastJobPods(pods.Items)[last.Name])
+
+	return status, nil
+}
+
+// restoreJobs returns the restore jobs of a database, oldest first.
+func (c *ClusterManager) restoreJobs(ctx context.Context, name string) ([]batchv1.Job, error) {
+	jobs, err := c.Clientset.BatchV1().Jobs(c.namespace(ctx)).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", restoreLabel, name),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list restore jobs: %v", err)
+	}
+	sort.Slice(jobs.Items, func(i, j int) bool {
+		return jobs.Items[i].CreationTimestamp.Before(&jobs.Items[j].CreationTimestamp)
+	})
+	return jobs.Items, nil
+}
+
+func restoreStatusOf(job *batchv1.Job, pod *corev1.Pod) *api.RestoreStatus {
+	progress := progressOf(job, pod)
+	return &api.RestoreStatus{
+		Name:           job.Name,
+		FromBackup:     job.Annotations[fromBackupAnnotation],
+		CloneOf:        job.Annotations[cloneOfAnnotation],
+		Status:         progress.status,
+		StartTime:      progress.start,
+		CompletionTime: progress.completion,
+		Message:        progress.message,
+	}
+}
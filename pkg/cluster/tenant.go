@@ -0,0 +1,250 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	tenantLabel = "kaas.io/tenant"
+
+	tenantQuotaName      = "kaas-quota"
+	tenantLimitRangeName = "kaas-limits"
+	tenantNetPolicyName  = "kaas-default-deny"
+
+	// apiPodLabel marks the pods of KaaS, which the network policy lets in
+	apiPodLabel = "app.kubernetes.io/name"
+	apiPodValue = "kaas-api"
+)
+
+type TenantCnf struct {
+	NamespacePrefix  string
+	IngressNamespace string              // namespace of the ingress controller, allowed through the network policy
+	Quota            corev1.ResourceList // hard limits of the ResourceQuota of every tenant
+	LimitDefaults    corev1.ResourceList // default requests and limits of containers that don't set them
+}
+
+func parseTenantConf(data map[string]string) TenantCnf {
+	conf := TenantCnf{
+		NamespacePrefix:  data["tenant.namespacePrefix"],
+		IngressNamespace: data["tenant.ingressNamespace"],
+		Quota:            corev1.ResourceList{},
+		LimitDefaults:    corev1.ResourceList{},
+	}
+	if conf.NamespacePrefix == "" {
+		conf.NamespacePrefix = "kaas-"
+	}
+
+	quotaKeys := map[string]corev1.ResourceName{
+		"tenant.quota.cpu":              corev1.ResourceRequestsCPU,
+		"tenant.quota.memory":           corev1.ResourceRequestsMemory,
+		"tenant.quota.ephemeralStorage": corev1.ResourceRequestsEphemeralStorage,
+		"tenant.quota.storage":          corev1.ResourceRequestsStorage,
+		"tenant.quota.pods":             corev1.ResourcePods,
+	}
+	for key, name := range quotaKeys {
+		if q, err := resource.ParseQuantity(data[key]); err == nil {
+			conf.Quota[name] = q
+		}
+	}
+
+	limitKeys := map[string]corev1.ResourceName{
+		"tenant.limit.cpu":              corev1.ResourceCPU,
+		"tenant.limit.memory":           corev1.ResourceMemory,
+		"tenant.limit.ephemeralStorage": corev1.ResourceEphemeralStorage,
+	}
+	for key, name := range limitKeys {
+		if q, err := resource.ParseQuantity(data[key]); err == nil {
+			conf.LimitDefaults[name] = q
+		}
+	}
+
+	return conf
+}
+
+type tenantKey struct{}
+
+// WithTenant scopes the ClusterManager operations called with the returned context to the tenant.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// namespace returns the namespace of the tenant in ctx. Callers without a
+// tenant, which TenantMiddleware only lets through with global roles, work in
+// the namespace of kaas-config.
+func (c *ClusterManager) namespace(ctx context.Context) string {
+	tenant := TenantFromContext(ctx)
+	if tenant == "" {
+		return c.AppConf.Namespace
+	}
+	return c.TenantConf.NamespacePrefix + tenant
+}
+
+// EnsureTenant creates the namespace of the tenant with its quota, default limits
+// and a network policy that only lets in traffic from the namespace itself, the
+// ingress controller and KaaS. Existing objects are left untouched, except the
+// network policy, which is brought up to date once per process so namespaces
+// created by older versions let KaaS in too.
+func (c *ClusterManager) EnsureTenant(ctx context.Context, tenant string) error {
+	if _, ok := c.tenants.Load(tenant); ok {
+		return nil
+	}
+
+	namespace := c.TenantConf.NamespacePrefix + tenant
+	if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+		return fmt.Errorf("invalid tenant %q: %s", tenant, strings.Join(errs, ", "))
+	}
+
+	labels := map[string]string{
+		tenantLabel:    tenant,
+		managedByLabel: managedByValue,
+	}
+
+	ns := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   namespace,
+			Labels: labels,
+		},
+	}
+	_, err := c.Clientset.CoreV1().Namespaces().Create(ctx, ns, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create namespace: %v", err)
+	}
+
+	if len(c.TenantConf.Quota) > 0 {
+		quota := &corev1.ResourceQuota{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      tenantQuotaName,
+				Namespace: namespace,
+				Labels:    labels,
+			},
+			Spec: corev1.ResourceQuotaSpec{
+				Hard: c.TenantConf.Quota,
+			},
+		}
+		_, err = c.Clientset.CoreV1().ResourceQuotas(namespace).Create(ctx, quota, metav1.CreateOptions{})
+		if err != nil && !apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("failed to create resource quota: %v", err)
+		}
+	}
+
+	if len(c.TenantConf.LimitDefaults) > 0 {
+		limitRange := &corev1.LimitRange{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      tenantLimitRangeName,
+				Namespace: namespace,
+				Labels:    labels,
+			},
+			Spec: corev1.LimitRangeSpec{
+				Limits: []corev1.LimitRangeItem{
+					{
+						Type:           corev1.LimitTypeContainer,
+						Default:        c.TenantConf.LimitDefaults,
+						DefaultRequest: c.TenantConf.LimitDefaults,
+					},
+				},
+			},
+		}
+		_, err = c.Clientset.CoreV1().LimitRanges(namespace).Create(ctx, limitRange, metav1.CreateOptions{})
+		if err != nil && !apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("failed to create limit range: %v", err)
+		}
+	}
+
+	if err := c.applyTenantNetworkPolicy(ctx, c.tenantNetworkPolicy(namespace, labels)); err != nil {
+		return err
+	}
+
+	c.tenants.Store(tenant, true)
+	return nil
+}
+
+// applyTenantNetworkPolicy creates the network policy of a tenant, or updates
+// the rules of the existing one if they differ.
+func (c *ClusterManager) applyTenantNetworkPolicy(ctx context.Context, policy *netv1.NetworkPolicy) error {
+	npClient := c.Clientset.NetworkingV1().NetworkPolicies(policy.Namespace)
+	_, err := npClient.Create(ctx, policy, metav1.CreateOptions{})
+	if err == nil {
+		return nil
+	}
+	if !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create network policy: %v", err)
+	}
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := npClient.Get(ctx, policy.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if apiequality.Semantic.DeepEqual(current.Spec, policy.Spec) {
+			return nil
+		}
+		current.Spec = policy.Spec
+		_, err = npClient.Update(ctx, current, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update network policy: %v", err)
+	}
+	return nil
+}
+
+// tenantNetworkPolicy denies all ingress traffic to the pods of the namespace,
+// except from the namespace itself, from the ingress controller and from KaaS,
+// which connects to databases to manage them.
+func (c *ClusterManager) tenantNetworkPolicy(namespace string, labels map[string]string) *netv1.NetworkPolicy {
+	from := []netv1.NetworkPolicyPeer{
+		{PodSelector: &metav1.LabelSelector{}},
+	}
+	if c.AppConf.Namespace != "" {
+		from = append(from, netv1.NetworkPolicyPeer{
+			NamespaceSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					corev1.LabelMetadataName: c.AppConf.Namespace,
+				},
+			},
+			PodSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{apiPodLabel: apiPodValue},
+			},
+		})
+	}
+	if c.TenantConf.IngressNamespace != "" {
+		from = append(from, netv1.NetworkPolicyPeer{
+			NamespaceSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					corev1.LabelMetadataName: c.TenantConf.IngressNamespace,
+				},
+			},
+		})
+	}
+
+	return &netv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      tenantNetPolicyName,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Spec: netv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{},
+			PolicyTypes: []netv1.PolicyType{netv1.PolicyTypeIngress},
+			Ingress: []netv1.NetworkPolicyIngressRule{
+				{From: from},
+			},
+		},
+	}
+}
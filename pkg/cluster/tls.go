@@ -0,0 +1,134 @@
+package cluster
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/SepehrNoey/KaaS/api"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	tlsSecretAnnotation = "kaas.io/tls-secret" // set on the deployment of apps served over TLS
+
+	// certificates expiring within this window are reported by GetAppStatus
+	certExpiryWarning = 30 * 24 * time.Hour
+)
+
+// appTLS validates the certificate of the app against the hosts of its rules and
+// returns the ingress TLS section. If the certificate is uploaded as PEM, the
+// secret that has to be created for it is returned too.
+func (c *ClusterManager) appTLS(ctx context.Context, appreq *api.AppRequest, rules []netv1.IngressRule) ([]netv1.IngressTLS, *corev1.Secret, error) {
+	namespace := c.namespace(ctx)
+
+	var certPEM, keyPEM []byte
+	var secret *corev1.Secret
+	secretName := appreq.TLS.SecretName
+	switch {
+	case secretName != "":
+		existing, err := c.Clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get TLS secret: %v", err)
+		}
+		if existing.Type != corev1.SecretTypeTLS {
+			return nil, nil, fmt.Errorf("secret %s is of type %s, expected %s", secretName, existing.Type, corev1.SecretTypeTLS)
+		}
+		certPEM = existing.Data[corev1.TLSCertKey]
+		keyPEM = existing.Data[corev1.TLSPrivateKeyKey]
+
+	case appreq.TLS.Cert != "" && appreq.TLS.Key != "":
+		secretName = appreq.Name + "-tls"
+		certPEM = []byte(appreq.TLS.Cert)
+		keyPEM = []byte(appreq.TLS.Key)
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      secretName,
+				Namespace: namespace,
+				Labels: map[string]string{
+					"app":          appreq.Name,
+					managedByLabel: managedByValue,
+				},
+			},
+			Type: corev1.SecretTypeTLS,
+			Data: map[string][]byte{
+				corev1.TLSCertKey:       certPEM,
+				corev1.TLSPrivateKeyKey: keyPEM,
+			},
+		}
+
+	default:
+		return nil, nil, fmt.Errorf("tls requires either secret_name or both cert and key")
+	}
+
+	cert, err := parseCertificate(certPEM, keyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	if now.After(cert.NotAfter) {
+		return nil, nil, fmt.Errorf("certificate expired at %s", cert.NotAfter.Format(time.RFC3339))
+	}
+	if now.Before(cert.NotBefore) {
+		return nil, nil, fmt.Errorf("certificate is not valid before %s", cert.NotBefore.Format(time.RFC3339))
+	}
+	if warning := expiryWarning(cert, now); warning != "" {
+		log.Printf("app %s: %s", appreq.Name, warning)
+	}
+
+	hosts := []string{}
+	for _, rule := range rules {
+		if err := cert.VerifyHostname(rule.Host); err != nil {
+			return nil, nil, fmt.Errorf("certificate doesn't cover host %s: %v", rule.Host, err)
+		}
+		hosts = append(hosts, rule.Host)
+	}
+
+	return []netv1.IngressTLS{{Hosts: hosts, SecretName: secretName}}, secret, nil
+}
+
+// parseCertificate checks that the key matches the certificate and returns the leaf certificate.
+func parseCertificate(certPEM, keyPEM []byte) (*x509.Certificate, error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate or key: %v", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %v", err)
+	}
+	return cert, nil
+}
+
+func expiryWarning(cert *x509.Certificate, now time.Time) string {
+	if cert.NotAfter.Sub(now) > certExpiryWarning {
+		return ""
+	}
+	return fmt.Sprintf("certificate expires at %s", cert.NotAfter.Format(time.RFC3339))
+}
+
+// tlsStatus reports the certificate in the TLS secret of an app.
+func (c *ClusterManager) tlsStatus(ctx context.Context, secretName string) *api.TLSStatus {
+	status := &api.TLSStatus{SecretName: secretName}
+
+	secret, err := c.Clientset.CoreV1().Secrets(c.namespace(ctx)).Get(ctx, secretName, metav1.GetOptions{})
+	if err != nil {
+		status.Warning = fmt.Sprintf("failed to get TLS secret: %v", err)
+		return status
+	}
+	cert, err := parseCertificate(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		status.Warning = err.Error()
+		return status
+	}
+
+	status.NotAfter = cert.NotAfter
+	status.Warning = expiryWarning(cert, time.Now())
+	return status
+}
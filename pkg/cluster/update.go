@@ -0,0 +1,393 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/SepehrNoey/KaaS/api"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// updateApp brings the objects of an existing app to the ones built from its
+// new request. The selector of a deployment can't change, so the pod labels
+// keep the values the deployment was created with.
+func (c *ClusterManager) updateApp(ctx context.Context, appreq *api.AppRequest, objs *appObjects) error {
+	namespace := c.namespace(ctx)
+
+	if objs.secret != nil {
+		if err := c.applySecret(ctx, objs.secret); err != nil {
+			return err
+		}
+	} else if err := c.deleteSecret(ctx, appreq.Name+"-secret"); err != nil {
+		return err
+	}
+
+	depClient := c.Clientset.AppsV1().Deployments(namespace)
+	var deployment *appsv1.Deployment
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := depClient.Get(ctx, appreq.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		template := *objs.deployment.Spec.Template.DeepCopy()
+		for key, value := range current.Spec.Selector.MatchLabels {
+			template.Labels[key] = value
+		}
+		if current.Labels == nil {
+			current.Labels = map[string]string{}
+		}
+		for key, value := range objs.deployment.Labels {
+			current.Labels[key] = value
+		}
+		if current.Annotations == nil {
+			current.Annotations = map[string]string{}
+		}
+		delete(current.Annotations, tlsSecretAnnotation)
+		for key, value := range objs.deployment.Annotations {
+			current.Annotations[key] = value
+		}
+		current.Spec.Replicas = objs.deployment.Spec.Replicas
+		current.Spec.Template = template
+
+		deployment, err = depClient.Update(ctx, current, updateOptions(ctx))
+		if err != nil {
+			return err
+		}
+		updated(ctx, deployment)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update deployment: %v", err)
+	}
+
+	svcClient := c.Clientset.CoreV1().Services(namespace)
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := svcClient.Get(ctx, appreq.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		updateServiceSpec(current, objs.service)
+		service, err := svcClient.Update(ctx, current, updateOptions(ctx))
+		if err != nil {
+			return err
+		}
+		updated(ctx, service)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update service: %v", err)
+	}
+
+	if objs.tlsSecret != nil {
+		if err := c.applySecret(ctx, objs.tlsSecret); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case !appreq.ExternalAccess:
+		if err := c.removeSharedRoutes(ctx, appreq.Name); err != nil {
+			return err
+		}
+		return c.deleteAppIngress(ctx, appreq.Name)
+	case objs.ingMode == IngressModeDedicated:
+		if err := c.removeSharedRoutes(ctx, appreq.Name); err != nil {
+			return err
+		}
+		return c.updateAppIngress(ctx, appreq, deployment, objs.routing)
+	default:
+		if err := c.deleteAppIngress(ctx, appreq.Name); err != nil {
+			return err
+		}
+		return c.updateIngress(ctx, appreq.Name, objs.routing)
+	}
+}
+
+// updateServiceSpec copies the labels, selector, type and ports of desired to
+// current. Node ports of ports that are kept are kept too, so clients outside
+// the cluster don't lose the app.
+func updateServiceSpec(current, desired *corev1.Service) {
+	nodePorts := map[int32]int32{}
+	for _, p := range current.Spec.Ports {
+		nodePorts[p.Port] = p.NodePort
+	}
+
+	ports := []corev1.ServicePort{}
+	for _, p := range desired.Spec.Ports {
+		if !isExternal(desired) {
+			p.NodePort = 0
+		} else if p.NodePort == 0 {
+			p.NodePort = nodePorts[p.Port]
+		}
+		ports = append(ports, p)
+	}
+
+	current.Labels = desired.Labels
+	current.Spec.Selector = desired.Spec.Selector
+	current.Spec.Type = desired.Spec.Type
+	current.Spec.Ports = ports
+}
+
+// deleteApp deletes the objects of an app. Its dedicated ingress is owned by
+// the deployment, so it's garbage collected with it.
+func (c *ClusterManager) deleteApp(ctx context.Context, name string) error {
+	namespace := c.namespace(ctx)
+
+	if err := c.removeSharedRoutes(ctx, name); err != nil {
+		return err
+	}
+
+	err := c.Clientset.AppsV1().Deployments(namespace).Delete(ctx, name, deleteOptions(ctx))
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete deployment: %v", err)
+	}
+
+	err = c.Clientset.CoreV1().Services(namespace).Delete(ctx, name, deleteOptions(ctx))
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete service: %v", err)
+	}
+
+	if err := c.deleteSecret(ctx, name+"-secret"); err != nil {
+		return err
+	}
+
+	// TLS secrets given by name belong to the user, only uploaded certificates are deleted
+	tlsSecret, err := c.Clientset.CoreV1().Secrets(namespace).Get(ctx, name+"-tls", metav1.GetOptions{})
+	if err == nil && tlsSecret.Labels["app"] == name && tlsSecret.Labels[managedByLabel] == managedByValue {
+		return c.deleteSecret(ctx, tlsSecret.Name)
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to get TLS secret: %v", err)
+	}
+
+	return nil
+}
+
+// checkDBUpdate rejects the changes of a database that can't be made in place.
+func checkDBUpdate(existing *appsv1.StatefulSet, objs *dbObjects) error {
+	currentEngine, desiredEngine := existing.Labels[engineLabel], objs.statefulSet.Labels[engineLabel]
+	if currentEngine == "" {
+		currentEngine = EnginePostgres
+	}
+	if currentEngine != desiredEngine {
+		return fmt.Errorf("engine of database %s can't be changed from %s to %s", existing.Name, currentEngine, desiredEngine)
+	}
+
+	if err := checkHAUpdate(existing, objs); err != nil {
+		return err
+	}
+
+	current := volumeStorage(existing)
+	desired := volumeStorage(objs.statefulSet)
+	if current.Cmp(desired) != 0 {
+		return fmt.Errorf("volume size of database %s can't be changed from %s to %s",
+			existing.Name, current.String(), desired.String())
+	}
+	return nil
+}
+
+// updateDB brings the statefulset and service of an existing database to the
+// ones built from its new request. The credentials and volumes are kept.
+func (c *ClusterManager) updateDB(ctx context.Context, dbreq *api.DBRequest, objs *dbObjects) error {
+	namespace := c.namespace(ctx)
+
+	// the config is in place before the servers restart with it
+	if objs.pgConfig != nil {
+		if err := c.applyConfigMap(ctx, objs.pgConfig); err != nil {
+			return err
+		}
+	}
+
+	stsClient := c.Clientset.AppsV1().StatefulSets(namespace)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := stsClient.Get(ctx, dbreq.DBName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if err := checkDBUpdate(current, objs); err != nil {
+			return err
+		}
+
+		if current.Labels == nil {
+			current.Labels = map[string]string{}
+		}
+		for key, value := range objs.statefulSet.Labels {
+			current.Labels[key] = value
+		}
+		if current.Annotations == nil {
+			current.Annotations = map[string]string{}
+		}
+		for key, value := range objs.statefulSet.Annotations {
+			current.Annotations[key] = value
+		}
+		current.Spec.Replicas = objs.statefulSet.Spec.Replicas
+		current.Spec.Template = objs.statefulSet.Spec.Template
+		statefulSet, err := stsClient.Update(ctx, current, updateOptions(ctx))
+		if err != nil {
+			return err
+		}
+		updated(ctx, statefulSet)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update statefulset: %v", err)
+	}
+
+	svcClient := c.Clientset.CoreV1().Services(namespace)
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := svcClient.Get(ctx, dbreq.DBName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		// a database that keeps external access keeps its node port
+		if current.Spec.Type == objs.service.Spec.Type {
+			return nil
+		}
+
+		updateServiceSpec(current, objs.service)
+		service, err := svcClient.Update(ctx, current, updateOptions(ctx))
+		if err != nil {
+			return err
+		}
+		updated(ctx, service)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update service: %v", err)
+	}
+
+	if objs.haConfig != nil {
+		if err := c.applyHA(ctx, objs); err != nil {
+			return err
+		}
+	}
+
+	if err := c.applyPooler(ctx, dbreq.DBName, objs); err != nil {
+		return err
+	}
+
+	if len(dbreq.Extensions) > 0 && !isDryRun(ctx) {
+		go c.enableExtensions(context.WithoutCancel(ctx), dbreq.DBName, dbreq.Extensions)
+	}
+
+	return c.applyBackup(ctx, dbreq.DBName, objs)
+}
+
+// deleteDB deletes the statefulset, services, pooler, config and backup cronjob
+// of a database. The volumes of the statefulset and the backups are kept, so
+// the data can still be recovered, and so are the credentials of the database
+// and of its additional users, which the data on the volumes needs.
+func (c *ClusterManager) deleteDB(ctx context.Context, name string) error {
+	namespace := c.namespace(ctx)
+
+	if err := c.deleteBackup(ctx, name); err != nil {
+		return err
+	}
+
+	err := c.Clientset.AppsV1().StatefulSets(namespace).Delete(ctx, name, deleteOptions(ctx))
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete statefulset: %v", err)
+	}
+
+	err = c.Clientset.CoreV1().Services(namespace).Delete(ctx, name, deleteOptions(ctx))
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete service: %v", err)
+	}
+
+	if err := c.deleteHA(ctx, name); err != nil {
+		return err
+	}
+
+	if err := c.deletePooler(ctx, name); err != nil {
+		return err
+	}
+
+	err = c.Clientset.CoreV1().ConfigMaps(namespace).Delete(ctx, name+"-config", deleteOptions(ctx))
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete config map: %v", err)
+	}
+
+	return nil
+}
+
+// applySecret creates the secret, or replaces the data of the existing one.
+func (c *ClusterManager) applySecret(ctx context.Context, secret *corev1.Secret) error {
+	secretClient := c.Clientset.CoreV1().Secrets(secret.Namespace)
+	createdSecret, err := secretClient.Create(ctx, secret, createOptions(ctx))
+	if err == nil {
+		created(ctx, createdSecret)
+		return nil
+	}
+	if !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create secret: %v", err)
+	}
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := secretClient.Get(ctx, secret.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if current.Type != secret.Type && secret.Type != "" {
+			return fmt.Errorf("secret is of type %s, expected %s", current.Type, secret.Type)
+		}
+		current.Labels = secret.Labels
+		current.Data = secret.Data
+		current.StringData = secret.StringData
+		updatedSecret, err := secretClient.Update(ctx, current, updateOptions(ctx))
+		if err != nil {
+			return err
+		}
+		updated(ctx, updatedSecret)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update secret %s: %v", secret.Name, err)
+	}
+	return nil
+}
+
+// applyConfigMap creates the config map, or replaces the data of the existing one.
+func (c *ClusterManager) applyConfigMap(ctx context.Context, configMap *corev1.ConfigMap) error {
+	cmClient := c.Clientset.CoreV1().ConfigMaps(configMap.Namespace)
+	createdConfigMap, err := cmClient.Create(ctx, configMap, createOptions(ctx))
+	if err == nil {
+		created(ctx, createdConfigMap)
+		return nil
+	}
+	if !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create config map %s: %v", configMap.Name, err)
+	}
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := cmClient.Get(ctx, configMap.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		current.Labels = configMap.Labels
+		current.Data = configMap.Data
+		updatedConfigMap, err := cmClient.Update(ctx, current, updateOptions(ctx))
+		if err != nil {
+			return err
+		}
+		updated(ctx, updatedConfigMap)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update config map %s: %v", configMap.Name, err)
+	}
+	return nil
+}
+
+func (c *ClusterManager) deleteSecret(ctx context.Context, name string) error {
+	err := c.Clientset.CoreV1().Secrets(c.namespace(ctx)).Delete(ctx, name, deleteOptions(ctx))
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete secret %s: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// URL returns the url of the KaaS postgres master, configured through the environment.
+func URL() string {
+	masterHost := os.Getenv("POSTGRESQL_MASTER_HOST")
+	pass := os.Getenv("POSTGRESQL_PASSWORD")
+	return fmt.Sprintf("postgres://postgres:%s@%s:5432/postgres?sslmode=disable", pass, masterHost)
+}
+
+// Connect opens a connection pool to the KaaS postgres master.
+func Connect(ctx context.Context) (*pgxpool.Pool, error) {
+	pool, err := pgxpool.New(ctx, URL())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %v", err)
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to connect to database: %v", err)
+	}
+	return pool, nil
+}
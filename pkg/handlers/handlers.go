@@ -1,21 +1,65 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"slices"
+	"strconv"
+	"time"
 
 	"github.com/SepehrNoey/KaaS/api"
+	"github.com/SepehrNoey/KaaS/pkg/audit"
+	"github.com/SepehrNoey/KaaS/pkg/auth"
 	"github.com/SepehrNoey/KaaS/pkg/cluster"
 	"github.com/gorilla/mux"
+	"sigs.k8s.io/yaml"
 )
 
 type Handler struct {
 	ClusterManager *cluster.ClusterManager
+	Keys           *auth.KeyStore
+	Authorizer     *auth.Authorizer
+	Audit          *audit.Store
 }
 
-func NewHandler(cm *cluster.ClusterManager) *Handler {
-	return &Handler{ClusterManager: cm}
+func NewHandler(cm *cluster.ClusterManager, keys *auth.KeyStore, authorizer *auth.Authorizer, auditStore *audit.Store) *Handler {
+	return &Handler{ClusterManager: cm, Keys: keys, Authorizer: authorizer, Audit: auditStore}
+}
+
+// TenantMiddleware scopes the request to the tenant of the caller, creating the
+// namespace of the tenant on its first request. Only callers with roles bound in
+// every tenant may work without a tenant, in the global namespace.
+func (h *Handler) TenantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := auth.IdentityFromContext(r.Context())
+		if identity == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if identity.Tenant == "" {
+			permissions, err := h.Authorizer.Permissions(r.Context(), identity, "", true)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if len(permissions) == 0 {
+				http.Error(w, "callers without a tenant need a role bound in every tenant", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if err := h.ClusterManager.EnsureTenant(r.Context(), identity.Tenant); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(cluster.WithTenant(r.Context(), identity.Tenant)))
+	})
 }
 
 func (h *Handler) AddApp(w http.ResponseWriter, r *http.Request) {
@@ -24,17 +68,53 @@ func (h *Handler) AddApp(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	ctx := r.Context()
-	err := h.ClusterManager.DeployApp(ctx, &req)
+	if dryRun {
+		ctx = cluster.WithDryRun(ctx)
+	}
+	err = h.ClusterManager.DeployApp(ctx, &req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeClusterError(w, err, http.StatusInternalServerError)
 		return
 	}
 
+	if dryRun {
+		writeDryRun(ctx, w)
+		return
+	}
 	w.WriteHeader(http.StatusCreated)
 }
 
+func (h *Handler) AdoptApp(w http.ResponseWriter, r *http.Request) {
+	var req api.AdoptRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	appreq, err := h.ClusterManager.AdoptApp(r.Context(), &req)
+	if err != nil {
+		writeClusterError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	prettyJSON, err := json.MarshalIndent(appreq, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(prettyJSON)
+}
+
 func (h *Handler) GetAppStatus(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	name := vars["name"]
@@ -79,30 +159,808 @@ func (h *Handler) GetAllAppsStatus(w http.ResponseWriter, r *http.Request) {
 	w.Write(prettyJSON)
 }
 
-func (h *Handler) AddDB(w http.ResponseWriter, r *http.Request) {
-	var req api.DBRequest
+func (h *Handler) GetDBStatus(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	status, err := h.ClusterManager.GetDBStatus(r.Context(), name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	prettyJSON, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(prettyJSON)
+}
+
+func (h *Handler) ResizeDB(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	var req api.DBResizeRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	fmt.Println("before deploying db server")
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	ctx := r.Context()
-	creds, err := h.ClusterManager.DeployDBServer(ctx, &req)
+	if dryRun {
+		ctx = cluster.WithDryRun(ctx)
+	}
+	status, err := h.ClusterManager.ResizeDB(ctx, name, &req)
+	if err != nil {
+		writeClusterError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if dryRun {
+		writeDryRun(ctx, w)
+		return
+	}
+
+	prettyJSON, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(prettyJSON)
+}
+
+func (h *Handler) RestoreDB(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	var req api.RestoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dryRun, err := dryRunParam(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	fmt.Println("after deploying db server")
 
-	credsPretty, err := json.MarshalIndent(creds, "", "  ")
+	ctx := r.Context()
+	if dryRun {
+		ctx = cluster.WithDryRun(ctx)
+	}
+	status, err := h.ClusterManager.RestoreDB(ctx, name, &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if dryRun {
+		writeDryRun(ctx, w)
+		return
+	}
+
+	prettyJSON, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(prettyJSON)
+}
+
+// FailoverDB promotes a replica of an HA database. The body is optional, without
+// a target the first ready replica is promoted.
+func (h *Handler) FailoverDB(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	var req api.FailoverRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	if dryRun {
+		ctx = cluster.WithDryRun(ctx)
+	}
+	status, err := h.ClusterManager.FailoverDB(ctx, name, req.Target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if dryRun {
+		writeDryRun(ctx, w)
+		return
+	}
+
+	prettyJSON, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(prettyJSON)
+}
+
+func (h *Handler) CreateDatabase(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	var req api.DatabaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	if dryRun {
+		ctx = cluster.WithDryRun(ctx)
+	}
+	database, err := h.ClusterManager.CreateDatabase(ctx, name, &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if dryRun {
+		writeDryRun(ctx, w)
+		return
+	}
+
+	prettyJSON, err := json.MarshalIndent(database, "", "  ")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	fmt.Println("credsPretty are created:", string(credsPretty))
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	w.Write(credsPretty)
+	w.Write(prettyJSON)
+}
+
+func (h *Handler) CreateDBUser(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	var req api.DBUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	if dryRun {
+		ctx = cluster.WithDryRun(ctx)
+	}
+	user, err := h.ClusterManager.CreateDBUser(ctx, name, &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if dryRun {
+		writeDryRun(ctx, w)
+		return
+	}
+
+	// the password is only returned to callers that may read secrets, it stays in the secret of the user
+	readSecrets, err := h.Authorizer.Allowed(ctx, auth.IdentityFromContext(ctx), auth.PermReadSecrets)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !readSecrets {
+		cluster.RedactDBUser(user)
+	}
+
+	prettyJSON, err := json.MarshalIndent(user, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(prettyJSON)
+}
+
+func (h *Handler) GrantDB(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	var req api.GrantRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	if dryRun {
+		ctx = cluster.WithDryRun(ctx)
+	}
+	grant, err := h.ClusterManager.GrantDB(ctx, name, &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if dryRun {
+		writeDryRun(ctx, w)
+		return
+	}
+
+	prettyJSON, err := json.MarshalIndent(grant, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(prettyJSON)
+}
+
+func (h *Handler) GetBackups(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	backups, err := h.ClusterManager.ListBackups(r.Context(), name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	prettyJSON, err := json.MarshalIndent(api.AllBackups{Backups: backups}, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(prettyJSON)
+}
+
+func (h *Handler) GetRoutes(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	routes, err := h.ClusterManager.GetRoutes(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := api.AllRoutes{Routes: routes}
+
+	prettyJSON, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(prettyJSON)
+}
+
+func (h *Handler) MigrateIngress(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	migration, err := h.ClusterManager.MigrateIngress(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	prettyJSON, err := json.MarshalIndent(migration, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(prettyJSON)
+}
+
+func (h *Handler) AddDB(w http.ResponseWriter, r *http.Request) {
+	var req api.DBRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	if req.ExternalAccess && !h.allowExternalDB(w, r) {
+		return
+	}
+	if dryRun {
+		ctx = cluster.WithDryRun(ctx)
+	}
+
+	creds, err := h.ClusterManager.DeployDBServer(ctx, &req)
+	if err != nil {
+		writeClusterError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	// the credentials of a dry run are never stored
+	if dryRun {
+		writeDryRun(ctx, w)
+		return
+	}
+
+	// the password is only returned to callers that may read it from GET /api/db/{name}/connection
+	readSecrets, err := h.Authorizer.Allowed(ctx, auth.IdentityFromContext(ctx), auth.PermReadSecrets)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !readSecrets {
+		cluster.RedactCredentials(creds)
+	}
+
+	credsPretty, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(credsPretty)
+}
+
+func (h *Handler) ExportApp(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	ctx := r.Context()
+	export, err := h.ClusterManager.ExportApp(ctx, name, r.URL.Query().Get("format"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeExport(w, export)
+}
+
+func (h *Handler) ExportDB(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	ctx := r.Context()
+	export, err := h.ClusterManager.ExportDB(ctx, name, r.URL.Query().Get("format"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeExport(w, export)
+}
+
+// GetDBConnection returns the connection string of a database in the format
+// and with the sslmode, user and database of the query.
+func (h *Handler) GetDBConnection(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	query := r.URL.Query()
+
+	conn, err := h.ClusterManager.GetDBConnection(r.Context(), name, cluster.ConnectionOptions{
+		Format:   query.Get("format"),
+		SSLMode:  query.Get("sslmode"),
+		User:     query.Get("user"),
+		Database: query.Get("database"),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	prettyJSON, err := json.MarshalIndent(conn, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(prettyJSON)
+}
+
+func writeExport(w http.ResponseWriter, export *cluster.Export) {
+	w.Header().Set("Content-Type", export.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", export.FileName))
+	w.WriteHeader(http.StatusOK)
+	w.Write(export.Data)
+}
+
+// allowExternalDB checks that the caller may create databases with external
+// access, writing the error response if not.
+func (h *Handler) allowExternalDB(w http.ResponseWriter, r *http.Request) bool {
+	ctx := r.Context()
+	allowed, err := h.Authorizer.Allowed(ctx, auth.IdentityFromContext(ctx), auth.PermExternalDB)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if !allowed {
+		http.Error(w, fmt.Sprintf("permission %s is required for external access", auth.PermExternalDB), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// Apply accepts a manifest in YAML or JSON and applies it, or only plans it with
+// ?dry_run=true. Databases missing from the manifest are only deleted with ?prune=true.
+func (h *Handler) Apply(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var manifest api.Manifest
+	if err := yaml.Unmarshal(body, &manifest); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	prune, err := boolParam(r, "prune")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, db := range manifest.Databases {
+		if db.ExternalAccess {
+			if !h.allowExternalDB(w, r) {
+				return
+			}
+			break
+		}
+	}
+
+	ctx := r.Context()
+	result, err := h.ClusterManager.Apply(ctx, &manifest, dryRun, prune)
+	if err != nil {
+		writeClusterError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	prettyJSON, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if result.Error != "" {
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(prettyJSON)
+}
+
+func (h *Handler) AddAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req api.APIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Subject == "" {
+		http.Error(w, "subject is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	identity := auth.IdentityFromContext(ctx)
+	if req.Tenant == "" {
+		req.Tenant = identity.Tenant
+	}
+	// callers of a tenant can only create keys for their own tenant
+	if identity.Tenant != "" && req.Tenant != identity.Tenant {
+		http.Error(w, "can't create api keys for another tenant", http.StatusForbidden)
+		return
+	}
+	if auth.IsReservedSubject(req.Subject) {
+		http.Error(w, fmt.Sprintf("subject %s is reserved", req.Subject), http.StatusForbidden)
+		return
+	}
+	// callers of a tenant can only create keys for themselves or for subjects
+	// whose keys and roles all belong to their tenant
+	if identity.Tenant != "" && req.Subject != identity.Subject {
+		keyTenants, err := h.Keys.SubjectTenants(ctx, req.Subject)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		bindingTenants, err := h.Authorizer.BindingTenants(ctx, req.Subject)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		otherTenant := func(tenant string) bool { return tenant != identity.Tenant }
+		if slices.ContainsFunc(keyTenants, otherTenant) || slices.ContainsFunc(bindingTenants, otherTenant) {
+			http.Error(w, fmt.Sprintf("subject %s belongs to another tenant", req.Subject), http.StatusForbidden)
+			return
+		}
+	}
+
+	key, err := h.Keys.CreateAPIKey(ctx, req.Subject, req.Tenant, identity.Subject)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	prettyJSON, err := json.MarshalIndent(api.APIKey{Subject: req.Subject, Tenant: req.Tenant, Key: key}, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(prettyJSON)
+}
+
+func (h *Handler) GetQuota(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+
+	ctx := r.Context()
+	identity := auth.IdentityFromContext(ctx)
+	if identity.Tenant != "" && identity.Tenant != tenant {
+		http.Error(w, "can't read the quota of another tenant", http.StatusForbidden)
+		return
+	}
+
+	quota, err := h.ClusterManager.GetQuota(ctx, tenant)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	prettyJSON, err := json.MarshalIndent(quota, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(prettyJSON)
+}
+
+func (h *Handler) SetQuota(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+
+	var req api.QuotaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	quota, err := h.ClusterManager.SetQuota(ctx, tenant, &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	prettyJSON, err := json.MarshalIndent(quota, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(prettyJSON)
+}
+
+func (h *Handler) WhoAmI(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	identity := auth.IdentityFromContext(ctx)
+
+	roles, err := h.Authorizer.Roles(ctx, identity, identity.Tenant)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	permissions, err := h.Authorizer.Permissions(ctx, identity, identity.Tenant, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := api.WhoAmI{
+		Subject:     identity.Subject,
+		Tenant:      identity.Tenant,
+		Method:      identity.Method,
+		Roles:       roles,
+		Permissions: []string{},
+	}
+	for _, p := range permissions {
+		response.Permissions = append(response.Permissions, string(p))
+	}
+
+	prettyJSON, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(prettyJSON)
+}
+
+func (h *Handler) AddRoleBinding(w http.ResponseWriter, r *http.Request) {
+	var req api.RoleBindingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Subject == "" || req.Role == "" {
+		http.Error(w, "subject and role are required", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	if err := h.Authorizer.Bind(ctx, req.Subject, req.Tenant, req.Role); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *Handler) GetAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := audit.Filter{
+		Subject: query.Get("user"),
+		App:     query.Get("app"),
+	}
+
+	var err error
+	for param, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := query.Get(param); value != "" {
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s: %v", param, err), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil {
+			http.Error(w, fmt.Sprintf("invalid limit: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	// callers of a tenant only see the records of their tenant
+	filter.Tenant = auth.IdentityFromContext(ctx).Tenant
+
+	records, err := h.Audit.List(ctx, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	prettyJSON, err := json.MarshalIndent(api.AllAuditRecords{Records: records}, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(prettyJSON)
+}
+
+func dryRunParam(r *http.Request) (bool, error) {
+	return boolParam(r, "dry_run")
+}
+
+// boolParam parses an optional boolean query parameter, false if it's missing.
+func boolParam(r *http.Request, name string) (bool, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return b, nil
+}
+
+// writeDryRun writes the objects collected by an operation called with a context of cluster.WithDryRun.
+func writeDryRun(ctx context.Context, w http.ResponseWriter) {
+	prettyJSON, err := json.MarshalIndent(api.DryRunResult{Objects: cluster.DryRunObjects(ctx)}, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(prettyJSON)
+}
+
+// writeClusterError writes the status that matches the error of a ClusterManager
+// operation, or status if the error has no specific one.
+func writeClusterError(w http.ResponseWriter, err error, status int) {
+	var conflict *cluster.ConflictError
+	var tlsConflict *cluster.TLSConflictError
+	if errors.As(err, &conflict) || errors.As(err, &tlsConflict) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	var exceeded *cluster.QuotaExceededError
+	if errors.As(err, &exceeded) {
+		prettyJSON, jsonErr := json.MarshalIndent(api.QuotaExceeded{
+			Error:  "request exceeds the quota",
+			Tenant: exceeded.Tenant,
+			Usage:  exceeded.Usage,
+		}, "", "  ")
+		if jsonErr != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write(prettyJSON)
+		return
+	}
+
+	http.Error(w, err.Error(), status)
 }